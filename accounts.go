@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// LocalAccount describes a local user account as stored in /etc/passwd
+type LocalAccount struct {
+	Username string
+	UID      int
+	GID      int
+	Gecos    string
+	Home     string
+	Shell    string
+}
+
+// AccountBackend manages the local users and groups of the system. Each
+// implementation wraps the account tools of a family of distributions, or
+// edits the account files directly.
+type AccountBackend interface {
+	// Name returns the name the backend is configured by
+	Name() string
+	// AddUser creates the account and its home directory, copying the
+	// skeleton directory into it. An empty skel uses the system default.
+	AddUser(account LocalAccount, skel string) error
+	// ModifyUser updates the home, shell and GECOS of an existing account,
+	// moving the contents of its home directory if it changed
+	ModifyUser(account LocalAccount) error
+	// DeleteUser removes the account but leaves its home directory alone
+	DeleteUser(username string) error
+	// LookupUser returns the account of a user, or ErrUnknownAccount
+	LookupUser(username string) (LocalAccount, error)
+	// GroupExists reports whether a group exists
+	GroupExists(group string) (bool, error)
+	// CreateGroup creates a group
+	CreateGroup(group string) error
+	// AddUserToGroup adds a user to the supplementary members of a group
+	AddUserToGroup(group string, username string) error
+	// UsersInGroup returns the supplementary members of a group
+	UsersInGroup(group string) ([]string, error)
+}
+
+// ErrUnknownAccount is returned when looking up an account that doesn't exist
+var ErrUnknownAccount = errors.New("unknown account")
+
+// accountBackends lists the backends that can be set in config.yml
+var accountBackends = []string{"shadow", "debian", "busybox", "native"}
+
+// accountBackend is the globally accessed backend used to manage accounts
+var accountBackend AccountBackend
+
+// NewAccountBackend returns the backend with the given name, managing the
+// accounts of the system installed under root, or of the running system if
+// root is empty. The auto backend picks one based on the distribution found
+// under root.
+func NewAccountBackend(name string, root string) (AccountBackend, error) {
+	if name == "" || strings.EqualFold(name, "auto") {
+		name = detectAccountBackend(root)
+	}
+
+	switch strings.ToLower(name) {
+	case "shadow":
+		return shadowBackend{root: root}, nil
+	case "debian", "busybox":
+		// adduser and the busybox applets can't target another root
+		if root != "" {
+			return nil, fmt.Errorf(
+				"Account backend %s does not support an alternate root, "+
+					"use shadow or native instead", name,
+			)
+		}
+		if strings.EqualFold(name, "debian") {
+			return debianBackend{}, nil
+		}
+		return busyboxBackend{}, nil
+	case "native":
+		return nativeBackend{root: root}, nil
+	}
+	return nil, fmt.Errorf(
+		"Account backend %s not supported! Available choices: auto, %s",
+		name, strings.Join(accountBackends, ", "),
+	)
+}
+
+// detectAccountBackend picks the backend matching the distribution named in
+// the os-release file under root, falling back to whichever account tools
+// are installed and finally to editing the account files directly. Only the
+// shadow and native backends are picked for an alternate root.
+func detectAccountBackend(root string) string {
+	osRelease, _ := readKeyValueFile(
+		filepath.Join(root, "/etc/os-release"), "=",
+	)
+	ids := strings.Fields(osRelease["ID"] + " " + osRelease["ID_LIKE"])
+	if root != "" {
+		ids = nil
+	}
+	for _, id := range ids {
+		switch strings.Trim(id, `"'`) {
+		case "debian", "ubuntu":
+			if commandExists("adduser") && commandExists("deluser") {
+				return "debian"
+			}
+		case "alpine":
+			return "busybox"
+		case "rhel", "fedora", "centos", "suse", "arch":
+			if commandExists("useradd") {
+				return "shadow"
+			}
+		}
+	}
+
+	if commandExists("useradd") && commandExists("userdel") {
+		return "shadow"
+	}
+	return "native"
+}
+
+// commandExists reports whether a command can be found in the PATH
+func commandExists(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+// readKeyValueFile reads a file of KEY<sep>VALUE lines such as
+// /etc/os-release or /etc/login.defs, skipping blank lines and comments.
+// Surrounding quotes are removed from values.
+func readKeyValueFile(path string, sep string) (map[string]string, error) {
+	values := map[string]string{}
+	f, err := os.Open(path)
+	if err != nil {
+		return values, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var key, value string
+		if sep == "" {
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			key, value = fields[0], fields[1]
+		} else {
+			parts := strings.SplitN(line, sep, 2)
+			if len(parts) != 2 {
+				continue
+			}
+			key, value = parts[0], parts[1]
+		}
+		values[strings.TrimSpace(key)] = strings.Trim(
+			strings.TrimSpace(value), `"'`,
+		)
+	}
+	return values, scanner.Err()
+}
+
+// readColonFile reads a colon separated account database such as
+// /etc/passwd or /etc/group, returning the fields of each entry.
+func readColonFile(path string) ([][]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entries := [][]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+	return entries, nil
+}
+
+// parsePasswdEntry converts the fields of an /etc/passwd entry into a
+// LocalAccount
+func parsePasswdEntry(fields []string) (LocalAccount, error) {
+	if len(fields) < 7 {
+		return LocalAccount{}, fmt.Errorf(
+			"malformed passwd entry for %s", fields[0],
+		)
+	}
+	uid, uidErr := strconv.Atoi(fields[2])
+	gid, gidErr := strconv.Atoi(fields[3])
+	if uidErr != nil || gidErr != nil {
+		return LocalAccount{}, fmt.Errorf(
+			"malformed passwd entry for %s", fields[0],
+		)
+	}
+	return LocalAccount{
+		Username: fields[0],
+		UID:      uid,
+		GID:      gid,
+		Gecos:    fields[4],
+		Home:     fields[5],
+		Shell:    fields[6],
+	}, nil
+}
+
+// splitMembers splits the comma separated member list of a group entry
+func splitMembers(list string) []string {
+	members := []string{}
+	for _, member := range strings.Split(strings.TrimSpace(list), ",") {
+		if member != "" {
+			members = append(members, member)
+		}
+	}
+	return members
+}
+
+// lookupUserInFile finds a user in a passwd formatted file
+func lookupUserInFile(path string, username string) (LocalAccount, error) {
+	entries, err := readColonFile(path)
+	if err != nil {
+		return LocalAccount{}, err
+	}
+	for _, fields := range entries {
+		if fields[0] == username {
+			return parsePasswdEntry(fields)
+		}
+	}
+	return LocalAccount{}, ErrUnknownAccount
+}
+
+// findGroupInFile returns the fields of a group in a group formatted file,
+// or nil if the group doesn't exist
+func findGroupInFile(path string, group string) ([]string, error) {
+	entries, err := readColonFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, fields := range entries {
+		if fields[0] == group && len(fields) >= 4 {
+			return fields, nil
+		}
+	}
+	return nil, nil
+}
+
+// getentUser looks up a user through NSS with getent
+func getentUser(username string) (LocalAccount, error) {
+	stdout, err := runCommand("getent", "passwd", username)
+	if err != nil {
+		// getent exits with 2 when the key could not be found
+		var commandErr *CommandError
+		if errors.As(err, &commandErr) && commandErr.ExitCode == 2 {
+			return LocalAccount{}, ErrUnknownAccount
+		}
+		return LocalAccount{}, err
+	}
+	return parsePasswdEntry(
+		strings.Split(strings.TrimSpace(string(stdout)), ":"),
+	)
+}
+
+// getentGroup looks up a group through NSS with getent, returning nil if
+// the group doesn't exist
+func getentGroup(group string) ([]string, error) {
+	stdout, err := runCommand("getent", "group", group)
+	if err != nil {
+		var commandErr *CommandError
+		if errors.As(err, &commandErr) && commandErr.ExitCode == 2 {
+			return nil, nil
+		}
+		return nil, err
+	}
+	fields := strings.Split(strings.TrimSpace(string(stdout)), ":")
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("malformed group entry for %s", group)
+	}
+	return fields, nil
+}
+
+// shadowBackend manages accounts with the shadow-utils tools found on
+// RHEL, Fedora, SUSE, Arch and most other distributions. With an alternate
+// root the tools are run with --root and lookups read the account files
+// under root, as getent only knows about the running system.
+type shadowBackend struct {
+	root string
+}
+
+// run runs a shadow tool, targeting the alternate root if one is set
+func (b shadowBackend) run(name string, args ...string) error {
+	if b.root != "" {
+		args = append([]string{"--root", b.root}, args...)
+	}
+	_, err := runCommand(name, args...)
+	return err
+}
+
+func (shadowBackend) Name() string { return "shadow" }
+
+func (b shadowBackend) AddUser(account LocalAccount, skel string) error {
+	args := []string{"-m", "-d", account.Home}
+	if account.Shell != "" {
+		args = append(args, "-s", account.Shell)
+	}
+	if account.Gecos != "" {
+		args = append(args, "-c", account.Gecos)
+	}
+	if skel != "" {
+		args = append(args, "-k", skel)
+	}
+	return b.run("useradd", append(args, account.Username)...)
+}
+
+func (b shadowBackend) ModifyUser(account LocalAccount) error {
+	current, err := b.LookupUser(account.Username)
+	if err != nil {
+		return err
+	}
+
+	args := []string{}
+	if account.Shell != "" && account.Shell != current.Shell {
+		args = append(args, "-s", account.Shell)
+	}
+	if account.Gecos != current.Gecos {
+		args = append(args, "-c", account.Gecos)
+	}
+	if account.Home != "" && account.Home != current.Home {
+		args = append(args, "-d", account.Home, "-m")
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return b.run("usermod", append(args, account.Username)...)
+}
+
+func (b shadowBackend) DeleteUser(username string) error {
+	return b.run("userdel", username)
+}
+
+func (b shadowBackend) LookupUser(username string) (LocalAccount, error) {
+	if b.root != "" {
+		return lookupUserInFile(
+			filepath.Join(b.root, "/etc/passwd"), username,
+		)
+	}
+	return getentUser(username)
+}
+
+// lookupGroup returns the fields of a group, or nil if it doesn't exist
+func (b shadowBackend) lookupGroup(group string) ([]string, error) {
+	if b.root != "" {
+		return findGroupInFile(filepath.Join(b.root, "/etc/group"), group)
+	}
+	return getentGroup(group)
+}
+
+func (b shadowBackend) GroupExists(group string) (bool, error) {
+	fields, err := b.lookupGroup(group)
+	return fields != nil, err
+}
+
+func (b shadowBackend) CreateGroup(group string) error {
+	return b.run("groupadd", group)
+}
+
+func (b shadowBackend) AddUserToGroup(group string, username string) error {
+	return b.run("usermod", "-aG", group, username)
+}
+
+func (b shadowBackend) UsersInGroup(group string) ([]string, error) {
+	fields, err := b.lookupGroup(group)
+	if err != nil || fields == nil {
+		return []string{}, err
+	}
+	return splitMembers(fields[3]), nil
+}
+
+// debianBackend manages accounts with the adduser and deluser wrappers of
+// Debian and Ubuntu, which apply the policy in /etc/adduser.conf
+type debianBackend struct {
+	shadowBackend
+}
+
+func (debianBackend) Name() string { return "debian" }
+
+func (debianBackend) AddUser(account LocalAccount, skel string) error {
+	// adduser only takes the skeleton directory from adduser.conf
+	if skel != "" {
+		return shadowBackend{}.AddUser(account, skel)
+	}
+
+	args := []string{
+		"--disabled-password", "--gecos", account.Gecos,
+		"--home", account.Home,
+	}
+	if account.Shell != "" {
+		args = append(args, "--shell", account.Shell)
+	}
+	args = append(args, account.Username)
+
+	// adduser refuses names outside its NAME_REGEX, such as jane.doe, unless
+	// told otherwise. Older releases only know the option as
+	// --force-badname.
+	_, err := runCommand("adduser", append([]string{"--allow-bad-names"},
+		args...)...)
+	var cmdErr *CommandError
+	if errors.As(err, &cmdErr) &&
+		strings.Contains(cmdErr.Stderr, "allow-bad-names") {
+		_, err = runCommand("adduser", append([]string{"--force-badname"},
+			args...)...)
+	}
+	return err
+}
+
+func (debianBackend) DeleteUser(username string) error {
+	_, err := runCommand("deluser", username)
+	return err
+}
+
+func (debianBackend) CreateGroup(group string) error {
+	_, err := runCommand("addgroup", group)
+	return err
+}
+
+func (debianBackend) AddUserToGroup(group string, username string) error {
+	_, err := runCommand("adduser", username, group)
+	return err
+}
+
+// busyboxBackend manages accounts with the busybox applets used by Alpine.
+// Lookups read the account files directly as getent may not be installed.
+type busyboxBackend struct{}
+
+func (busyboxBackend) Name() string { return "busybox" }
+
+func (busyboxBackend) AddUser(account LocalAccount, skel string) error {
+	args := []string{"-D", "-g", account.Gecos, "-h", account.Home}
+	if account.Shell != "" {
+		args = append(args, "-s", account.Shell)
+	}
+	if skel != "" {
+		args = append(args, "-k", skel)
+	}
+	_, err := runCommand("adduser", append(args, account.Username)...)
+	return err
+}
+
+// ModifyUser edits the account files directly, as busybox has no usermod
+func (busyboxBackend) ModifyUser(account LocalAccount) error {
+	return nativeBackend{}.ModifyUser(account)
+}
+
+func (busyboxBackend) DeleteUser(username string) error {
+	_, err := runCommand("deluser", username)
+	return err
+}
+
+func (busyboxBackend) LookupUser(username string) (LocalAccount, error) {
+	return lookupUserInFile("/etc/passwd", username)
+}
+
+func (busyboxBackend) GroupExists(group string) (bool, error) {
+	fields, err := findGroupInFile("/etc/group", group)
+	return fields != nil, err
+}
+
+func (busyboxBackend) CreateGroup(group string) error {
+	_, err := runCommand("addgroup", group)
+	return err
+}
+
+func (busyboxBackend) AddUserToGroup(group string, username string) error {
+	_, err := runCommand("addgroup", username, group)
+	return err
+}
+
+func (busyboxBackend) UsersInGroup(group string) ([]string, error) {
+	fields, err := findGroupInFile("/etc/group", group)
+	if err != nil || fields == nil {
+		return []string{}, err
+	}
+	return splitMembers(fields[3]), nil
+}
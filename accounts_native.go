@@ -0,0 +1,623 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The account databases edited by the native backend, relative to its root
+const (
+	passwdFile  = "/etc/passwd"
+	shadowFile  = "/etc/shadow"
+	groupFile   = "/etc/group"
+	gshadowFile = "/etc/gshadow"
+	pwdLockFile = "/etc/.pwd.lock"
+	skelDir     = "/etc/skel"
+)
+
+// pwdLockTimeout is how long to wait for the account files lock, the same
+// as lckpwdf(3)
+const pwdLockTimeout = 15 * time.Second
+
+// nativeBackend manages accounts by editing /etc/passwd, /etc/shadow,
+// /etc/group and /etc/gshadow directly, so no account tools are needed. The
+// files are locked with the same lock used by lckpwdf(3), so the shadow
+// tools and other programs honouring it never see a half applied change.
+// Every path is resolved under root, which is empty for the running system.
+type nativeBackend struct {
+	root string
+}
+
+// path resolves a system path under the backend's root
+func (b nativeBackend) path(name string) string {
+	return filepath.Join(b.root, name)
+}
+
+// accountFiles holds the entries of every account database while they are
+// being edited. Missing shadow files are left nil and never written.
+type accountFiles struct {
+	backend nativeBackend
+	passwd  [][]string
+	shadow  [][]string
+	group   [][]string
+	gshadow [][]string
+}
+
+// lock takes the write lock on /etc/.pwd.lock, retrying until
+// pwdLockTimeout has passed. Closing the returned file releases the lock.
+func (b nativeBackend) lock() (*os.File, error) {
+	f, err := os.OpenFile(
+		b.path(pwdLockFile), os.O_WRONLY|os.O_CREATE|syscall.O_CLOEXEC, 0600,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: io.SeekStart}
+	deadline := time.Now().Add(pwdLockTimeout)
+	for {
+		err = syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lock)
+		if err == nil {
+			return f, nil
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf(
+				"timed out waiting for the lock on %s: %v",
+				b.path(pwdLockFile), err,
+			)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// readOptionalColonFile reads an account database that may not exist, as
+// /etc/gshadow is missing on some distributions
+func readOptionalColonFile(path string) ([][]string, error) {
+	entries, err := readColonFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return entries, err
+}
+
+// load reads every account database
+func (b nativeBackend) load() (*accountFiles, error) {
+	var err error
+	files := &accountFiles{backend: b}
+	if files.passwd, err = readColonFile(b.path(passwdFile)); err != nil {
+		return nil, err
+	}
+	if files.group, err = readColonFile(b.path(groupFile)); err != nil {
+		return nil, err
+	}
+	files.shadow, err = readOptionalColonFile(b.path(shadowFile))
+	if err != nil {
+		return nil, err
+	}
+	files.gshadow, err = readOptionalColonFile(b.path(gshadowFile))
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// save writes every account database back, group files first so a new
+// user's primary group exists by the time the user does
+func (files *accountFiles) save() error {
+	b := files.backend
+	err := writeColonFile(b.path(groupFile), files.group)
+	if err == nil && files.gshadow != nil {
+		err = writeColonFile(b.path(gshadowFile), files.gshadow)
+	}
+	if err == nil {
+		err = writeColonFile(b.path(passwdFile), files.passwd)
+	}
+	if err == nil && files.shadow != nil {
+		err = writeColonFile(b.path(shadowFile), files.shadow)
+	}
+	return err
+}
+
+// writeColonFile replaces an account database, keeping the mode and owner
+// of the existing file. The previous version is kept as path- the same way
+// the shadow tools do, and the new one is renamed into place atomically.
+func writeColonFile(path string, entries [][]string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	stat, _ := info.Sys().(*syscall.Stat_t)
+
+	old, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path+"-", old, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	var data strings.Builder
+	for _, fields := range entries {
+		data.WriteString(strings.Join(fields, ":") + "\n")
+	}
+
+	tmp, err := ioutil.TempFile(
+		filepath.Dir(path), "."+filepath.Base(path)+"-*",
+	)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.WriteString(data.String())
+	if err == nil {
+		err = tmp.Chmod(info.Mode().Perm())
+	}
+	if err == nil && stat != nil {
+		err = tmp.Chown(int(stat.Uid), int(stat.Gid))
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// findEntry returns the index of the entry with the given name, or -1
+func findEntry(entries [][]string, name string) int {
+	for i, fields := range entries {
+		if fields[0] == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// removeEntry removes the entry with the given name, if present
+func removeEntry(entries [][]string, name string) [][]string {
+	if i := findEntry(entries, name); i != -1 {
+		return append(entries[:i], entries[i+1:]...)
+	}
+	return entries
+}
+
+// idsInUse collects the numeric IDs held in the given field of every entry
+func idsInUse(entries [][]string, field int) map[int]bool {
+	used := map[int]bool{}
+	for _, fields := range entries {
+		if len(fields) > field {
+			if id, err := strconv.Atoi(fields[field]); err == nil {
+				used[id] = true
+			}
+		}
+	}
+	return used
+}
+
+// allocateID picks the ID following the highest one in use within
+// [min, max], like useradd does, so the IDs of recently deleted accounts
+// aren't handed out again while their files may still be around. The first
+// free ID is used once the top of the range is reached.
+func allocateID(used map[int]bool, min int, max int) (int, error) {
+	highest := min - 1
+	for id := range used {
+		if id >= min && id <= max && id > highest {
+			highest = id
+		}
+	}
+	if highest < max {
+		return highest + 1, nil
+	}
+	for id := min; id <= max; id++ {
+		if !used[id] {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("no free ID left between %d and %d", min, max)
+}
+
+// loginDefsInt reads a numeric setting from /etc/login.defs, falling back to
+// def when it is unset or invalid. Octal values such as UMASK are accepted.
+func loginDefsInt(defs map[string]string, key string, def int) int {
+	value, err := strconv.ParseInt(defs[key], 0, 64)
+	if err != nil {
+		return def
+	}
+	return int(value)
+}
+
+// addMember adds a user to a comma separated member list if not present
+func addMember(list string, username string) string {
+	members := splitMembers(list)
+	for _, member := range members {
+		if member == username {
+			return list
+		}
+	}
+	return strings.Join(append(members, username), ",")
+}
+
+// removeMember removes a user from a comma separated member list
+func removeMember(list string, username string) string {
+	kept := []string{}
+	for _, member := range splitMembers(list) {
+		if member != username {
+			kept = append(kept, member)
+		}
+	}
+	return strings.Join(kept, ",")
+}
+
+// addGroupEntry appends a group to the group databases and returns its GID
+func (files *accountFiles) addGroupEntry(
+	group string,
+	preferredGID int,
+	defs map[string]string,
+) (int, error) {
+	used := idsInUse(files.group, 2)
+	gid := preferredGID
+	if gid < 0 || used[gid] {
+		var err error
+		gid, err = allocateID(
+			used,
+			loginDefsInt(defs, "GID_MIN", 1000),
+			loginDefsInt(defs, "GID_MAX", 60000),
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	files.group = append(
+		files.group, []string{group, "x", strconv.Itoa(gid), ""},
+	)
+	if files.gshadow != nil {
+		files.gshadow = append(files.gshadow, []string{group, "!", "", ""})
+	}
+	return gid, nil
+}
+
+func (nativeBackend) Name() string { return "native" }
+
+func (b nativeBackend) AddUser(account LocalAccount, skel string) error {
+	lock, err := b.lock()
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	files, err := b.load()
+	if err != nil {
+		return err
+	}
+	if findEntry(files.passwd, account.Username) != -1 {
+		return fmt.Errorf("user %s already exists", account.Username)
+	}
+
+	defs, _ := readKeyValueFile(b.path("/etc/login.defs"), "")
+	useraddDefaults, _ := readKeyValueFile(
+		b.path("/etc/default/useradd"), "=",
+	)
+
+	uid, err := allocateID(
+		idsInUse(files.passwd, 2),
+		loginDefsInt(defs, "UID_MIN", 1000),
+		loginDefsInt(defs, "UID_MAX", 60000),
+	)
+	if err != nil {
+		return err
+	}
+
+	// Give the user a private group unless disabled in login.defs
+	gid := loginDefsInt(useraddDefaults, "GROUP", 100)
+	if !strings.EqualFold(defs["USERGROUPS_ENAB"], "no") {
+		if findEntry(files.group, account.Username) != -1 {
+			return fmt.Errorf(
+				"group %s already exists, cannot create the user's group",
+				account.Username,
+			)
+		}
+		gid, err = files.addGroupEntry(account.Username, uid, defs)
+		if err != nil {
+			return err
+		}
+	}
+
+	shell := account.Shell
+	if shell == "" {
+		shell = useraddDefaults["SHELL"]
+	}
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+
+	// "*" rather than "!" so the account has no password but key based
+	// logins still work when sshd runs without PAM
+	password := "*"
+	if files.shadow != nil {
+		password = "x"
+		lastChange := strconv.FormatInt(time.Now().Unix()/86400, 10)
+		files.shadow = append(files.shadow, []string{
+			account.Username, "*", lastChange,
+			strconv.Itoa(loginDefsInt(defs, "PASS_MIN_DAYS", 0)),
+			strconv.Itoa(loginDefsInt(defs, "PASS_MAX_DAYS", 99999)),
+			strconv.Itoa(loginDefsInt(defs, "PASS_WARN_AGE", 7)),
+			"", "", "",
+		})
+	}
+	files.passwd = append(files.passwd, []string{
+		account.Username, password, strconv.Itoa(uid), strconv.Itoa(gid),
+		account.Gecos, account.Home, shell,
+	})
+
+	err = files.save()
+	if err != nil {
+		return err
+	}
+
+	// Create the home directory from the skeleton, unless it already exists
+	home := b.path(account.Home)
+	if _, statErr := os.Lstat(home); statErr == nil {
+		return nil
+	}
+	homeMode := os.FileMode(loginDefsInt(
+		defs, "HOME_MODE", 0777&^loginDefsInt(defs, "UMASK", 022),
+	))
+	if skel == "" {
+		skel = skelDir
+	}
+	return createHomeFromSkel(home, b.path(skel), uid, gid, homeMode)
+}
+
+func (b nativeBackend) ModifyUser(account LocalAccount) error {
+	lock, err := b.lock()
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	files, err := b.load()
+	if err != nil {
+		return err
+	}
+	i := findEntry(files.passwd, account.Username)
+	if i == -1 {
+		return ErrUnknownAccount
+	}
+	current, err := parsePasswdEntry(files.passwd[i])
+	if err != nil {
+		return err
+	}
+
+	if account.Shell != "" {
+		files.passwd[i][6] = account.Shell
+	}
+	files.passwd[i][4] = account.Gecos
+
+	// Move the home directory before the passwd entry points to it
+	moved := false
+	if account.Home != "" && account.Home != current.Home {
+		oldHome, newHome := b.path(current.Home), b.path(account.Home)
+		if _, statErr := os.Lstat(newHome); statErr == nil {
+			return fmt.Errorf("%s already exists", newHome)
+		}
+		if _, statErr := os.Lstat(oldHome); statErr == nil {
+			err = os.MkdirAll(filepath.Dir(newHome), 0755)
+			if err == nil {
+				err = os.Rename(oldHome, newHome)
+			}
+			if err != nil {
+				return err
+			}
+			moved = true
+		}
+		files.passwd[i][5] = account.Home
+	}
+
+	err = files.save()
+	if err != nil && moved {
+		os.Rename(b.path(account.Home), b.path(current.Home))
+	}
+	return err
+}
+
+// createHomeFromSkel creates a home directory and copies the skeleton
+// directory into it, handing every copied file to the new user
+func createHomeFromSkel(
+	home string,
+	skel string,
+	uid int,
+	gid int,
+	mode os.FileMode,
+) error {
+	err := os.MkdirAll(filepath.Dir(home), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Mkdir(home, mode)
+	if err != nil {
+		return err
+	}
+	// Mkdir is subject to the umask
+	err = os.Chmod(home, mode)
+	if err == nil {
+		err = os.Chown(home, uid, gid)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, statErr := os.Stat(skel); statErr != nil {
+		return nil
+	}
+	return filepath.Walk(skel, func(
+		path string, info os.FileInfo, walkErr error,
+	) error {
+		if walkErr != nil || path == skel {
+			return walkErr
+		}
+		rel, err := filepath.Rel(skel, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(home, rel)
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			err = os.Symlink(link, target)
+			if err != nil {
+				return err
+			}
+		case info.IsDir():
+			err = os.Mkdir(target, info.Mode().Perm())
+			if err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			err = ioutil.WriteFile(target, data, info.Mode().Perm())
+			if err != nil {
+				return err
+			}
+		default:
+			// Devices, sockets and pipes are never copied
+			return nil
+		}
+		return os.Lchown(target, uid, gid)
+	})
+}
+
+func (b nativeBackend) DeleteUser(username string) error {
+	lock, err := b.lock()
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	files, err := b.load()
+	if err != nil {
+		return err
+	}
+	i := findEntry(files.passwd, username)
+	if i == -1 {
+		return ErrUnknownAccount
+	}
+	account, err := parsePasswdEntry(files.passwd[i])
+	if err != nil {
+		return err
+	}
+
+	files.passwd = removeEntry(files.passwd, username)
+	files.shadow = removeEntry(files.shadow, username)
+	for _, fields := range files.group {
+		if len(fields) >= 4 {
+			fields[3] = removeMember(fields[3], username)
+		}
+	}
+	for _, fields := range files.gshadow {
+		if len(fields) >= 4 {
+			fields[2] = removeMember(fields[2], username)
+			fields[3] = removeMember(fields[3], username)
+		}
+	}
+
+	// Remove the user's private group once nobody else relies on it
+	g := findEntry(files.group, username)
+	if g != -1 && len(files.group[g]) >= 4 &&
+		files.group[g][2] == strconv.Itoa(account.GID) &&
+		files.group[g][3] == "" &&
+		!idsInUse(files.passwd, 3)[account.GID] {
+		files.group = removeEntry(files.group, username)
+		files.gshadow = removeEntry(files.gshadow, username)
+	}
+
+	return files.save()
+}
+
+func (b nativeBackend) LookupUser(username string) (LocalAccount, error) {
+	return lookupUserInFile(b.path(passwdFile), username)
+}
+
+func (b nativeBackend) GroupExists(group string) (bool, error) {
+	fields, err := findGroupInFile(b.path(groupFile), group)
+	return fields != nil, err
+}
+
+func (b nativeBackend) CreateGroup(group string) error {
+	lock, err := b.lock()
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	files, err := b.load()
+	if err != nil {
+		return err
+	}
+	if findEntry(files.group, group) != -1 {
+		return fmt.Errorf("group %s already exists", group)
+	}
+
+	defs, _ := readKeyValueFile(b.path("/etc/login.defs"), "")
+	_, err = files.addGroupEntry(group, -1, defs)
+	if err != nil {
+		return err
+	}
+	return files.save()
+}
+
+func (b nativeBackend) AddUserToGroup(group string, username string) error {
+	lock, err := b.lock()
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	files, err := b.load()
+	if err != nil {
+		return err
+	}
+	if findEntry(files.passwd, username) == -1 {
+		return ErrUnknownAccount
+	}
+	g := findEntry(files.group, group)
+	if g == -1 || len(files.group[g]) < 4 {
+		return fmt.Errorf("group %s does not exist", group)
+	}
+	files.group[g][3] = addMember(files.group[g][3], username)
+	if gs := findEntry(files.gshadow, group); gs != -1 &&
+		len(files.gshadow[gs]) >= 4 {
+		files.gshadow[gs][3] = addMember(files.gshadow[gs][3], username)
+	}
+	return files.save()
+}
+
+func (b nativeBackend) UsersInGroup(group string) ([]string, error) {
+	fields, err := findGroupInFile(b.path(groupFile), group)
+	if err != nil || fields == nil {
+		return []string{}, err
+	}
+	return splitMembers(fields[3]), nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestNativeBackend returns a native backend rooted in a temporary
+// directory holding minimal account files
+func newTestNativeBackend(t *testing.T) nativeBackend {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("creating home directories needs root to chown them")
+	}
+	b := nativeBackend{root: t.TempDir()}
+	files := map[string]string{
+		passwdFile:           "root:x:0:0:root:/root:/bin/bash\n",
+		shadowFile:           "root:*:19000:0:99999:7:::\n",
+		groupFile:            "root:x:0:\nusers:x:100:\n",
+		gshadowFile:          "root:*::\nusers:*::\n",
+		"/etc/login.defs":    "UID_MIN 2000\nUID_MAX 2002\nGID_MIN 2000\n",
+		skelDir + "/.bashrc": "# ~/.bashrc\n",
+	}
+	for name, content := range files {
+		path := b.path(name)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte(content), 0640)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b
+}
+
+// readTestFile returns the content of a file under the backend's root
+func readTestFile(t *testing.T, b nativeBackend, name string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(b.path(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestNativeBackendRoundTrip(t *testing.T) {
+	b := newTestNativeBackend(t)
+	ada := LocalAccount{
+		Username: "ada.lovelace", Gecos: "Ada Lovelace",
+		Home: "/home/ada.lovelace", Shell: "/bin/bash",
+	}
+	if err := b.AddUser(ada, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddUser(ada, ""); err == nil {
+		t.Error("adding an existing user succeeded")
+	}
+
+	got, err := b.LookupUser("ada.lovelace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ada.UID, ada.GID = 2000, 2000
+	if got != ada {
+		t.Errorf("account = %+v, want %+v", got, ada)
+	}
+	if !strings.Contains(readTestFile(t, b, shadowFile),
+		"\nada.lovelace:*:") {
+		t.Errorf("shadow has no locked entry for ada.lovelace")
+	}
+	if !strings.Contains(readTestFile(t, b, groupFile),
+		"\nada.lovelace:x:2000:\n") {
+		t.Errorf("group has no private group for ada.lovelace")
+	}
+	if !strings.Contains(readTestFile(t, b, gshadowFile),
+		"\nada.lovelace:!::\n") {
+		t.Errorf("gshadow has no entry for ada.lovelace")
+	}
+	if readTestFile(t, b, "/home/ada.lovelace/.bashrc") != "# ~/.bashrc\n" {
+		t.Error("skeleton not copied into the home directory")
+	}
+
+	// The files keep their mode, and the previous version is kept as path-
+	info, err := os.Stat(b.path(passwdFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("passwd mode = %v, want 0640", info.Mode().Perm())
+	}
+	backup := readTestFile(t, b, passwdFile+"-")
+	if strings.Contains(backup, "ada.lovelace") ||
+		!strings.HasPrefix(backup, "root:") {
+		t.Errorf("passwd- = %q, want the passwd before the change", backup)
+	}
+
+	if err := b.CreateGroup("sre"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddUserToGroup("sre", "ada.lovelace"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddUserToGroup("sre", "ada.lovelace"); err != nil {
+		t.Fatal(err)
+	}
+	members, err := b.UsersInGroup("sre")
+	if err != nil || len(members) != 1 || members[0] != "ada.lovelace" {
+		t.Errorf("sre members = %q, %v, want ada.lovelace", members, err)
+	}
+
+	ada.Shell, ada.Home = "/bin/sh", "/srv/home/ada.lovelace"
+	if err := b.ModifyUser(ada); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := b.LookupUser("ada.lovelace"); got != ada {
+		t.Errorf("modified account = %+v, want %+v", got, ada)
+	}
+	if _, err := os.Stat(b.path("/srv/home/ada.lovelace/.bashrc")); err != nil {
+		t.Errorf("home not moved: %v", err)
+	}
+
+	if err := b.DeleteUser("ada.lovelace"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DeleteUser("ada.lovelace"); err != ErrUnknownAccount {
+		t.Errorf("deleting again: error = %v, want ErrUnknownAccount", err)
+	}
+	for _, name := range []string{passwdFile, shadowFile, gshadowFile} {
+		if strings.Contains(readTestFile(t, b, name), "ada.lovelace") {
+			t.Errorf("%s still mentions ada.lovelace", name)
+		}
+	}
+	if group := readTestFile(t, b, groupFile); group !=
+		"root:x:0:\nusers:x:100:\nsre:x:2001:\n" {
+		t.Errorf("group = %q, want the private group and member removed",
+			group)
+	}
+}
+
+func TestNativeBackendIDRange(t *testing.T) {
+	b := newTestNativeBackend(t)
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("user%d", i)
+		err := b.AddUser(LocalAccount{Username: name, Home: "/home/" + name},
+			"")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := b.AddUser(LocalAccount{Username: "user3", Home: "/home/user3"}, "")
+	if err == nil || !strings.Contains(err.Error(), "no free ID") {
+		t.Errorf("error = %v, want the UID range exhausted", err)
+	}
+	if strings.Contains(readTestFile(t, b, passwdFile), "user3") {
+		t.Error("user3 written although no UID was left")
+	}
+}
+
+// TestNativeBackendHoldLock is run by TestNativeBackendWaitsForLock in a
+// separate process, as fcntl locks never conflict within one process. It
+// holds the lock until its stdin is closed.
+func TestNativeBackendHoldLock(t *testing.T) {
+	root := os.Getenv("IAMUSERSYNC_TEST_LOCK_ROOT")
+	if root == "" {
+		t.Skip("only run as a helper process")
+	}
+	lock, err := nativeBackend{root: root}.lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+	fmt.Println("locked")
+	ioutil.ReadAll(os.Stdin)
+}
+
+func TestNativeBackendWaitsForLock(t *testing.T) {
+	b := newTestNativeBackend(t)
+	helper := exec.Command(os.Args[0], "-test.run=^TestNativeBackendHoldLock$")
+	helper.Env = append(os.Environ(), "IAMUSERSYNC_TEST_LOCK_ROOT="+b.root)
+	stdin, err := helper.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := helper.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := helper.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer helper.Wait()
+	defer stdin.Close()
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil || line != "locked\n" {
+		t.Fatalf("helper printed %q, %v, want locked", line, err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- b.AddUser(LocalAccount{Username: "ada", Home: "/home/ada"},
+			"")
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("AddUser returned %v while the lock was held", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+	if strings.Contains(readTestFile(t, b, passwdFile), "ada") {
+		t.Fatal("passwd written while the lock was held")
+	}
+
+	stdin.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("AddUser still waiting after the lock was released")
+	}
+	if _, err := b.LookupUser("ada"); err != nil {
+		t.Errorf("ada not added once the lock was released: %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// recordingRunner records the commands it is asked to run and fails those
+// with an entry in stderr
+type recordingRunner struct {
+	commands []string
+	stderr   map[string]string
+}
+
+func (r *recordingRunner) Run(
+	ctx context.Context,
+	name string,
+	args ...string,
+) (CommandResult, error) {
+	command := strings.Join(append([]string{name}, args...), " ")
+	r.commands = append(r.commands, command)
+	for prefix, stderr := range r.stderr {
+		if strings.HasPrefix(command, prefix) {
+			return CommandResult{Stderr: []byte(stderr), ExitCode: 1}, nil
+		}
+	}
+	return CommandResult{}, nil
+}
+
+// useRecordingRunner replaces commandRunner for the duration of the test
+func useRecordingRunner(
+	t *testing.T,
+	stderr map[string]string,
+) *recordingRunner {
+	t.Helper()
+	useTestLogger(t)
+	previous := commandRunner
+	t.Cleanup(func() { commandRunner = previous })
+	runner := &recordingRunner{stderr: stderr}
+	commandRunner = runner
+	return runner
+}
+
+func TestDebianAddUserAllowsBadNames(t *testing.T) {
+	account := LocalAccount{
+		Username: "jane.doe", Gecos: "Jane Doe", Home: "/home/jane.doe",
+		Shell: "/bin/bash",
+	}
+	args := " --disabled-password --gecos Jane Doe --home /home/jane.doe " +
+		"--shell /bin/bash jane.doe"
+
+	runner := useRecordingRunner(t, nil)
+	if err := (debianBackend{}).AddUser(account, ""); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"adduser --allow-bad-names" + args}
+	if !reflect.DeepEqual(runner.commands, want) {
+		t.Errorf("commands = %q, want %q", runner.commands, want)
+	}
+
+	// Older adduser releases only know --force-badname
+	runner = useRecordingRunner(t, map[string]string{
+		"adduser --allow-bad-names": "Unknown option: allow-bad-names",
+	})
+	if err := (debianBackend{}).AddUser(account, ""); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, "adduser --force-badname"+args)
+	if !reflect.DeepEqual(runner.commands, want) {
+		t.Errorf("commands = %q, want %q", runner.commands, want)
+	}
+
+	// Other failures aren't retried
+	runner = useRecordingRunner(t, map[string]string{
+		"adduser": "adduser: The user `jane.doe' already exists.",
+	})
+	if err := (debianBackend{}).AddUser(account, ""); err == nil {
+		t.Error("AddUser succeeded, want the adduser error")
+	}
+	if len(runner.commands) != 1 {
+		t.Errorf("commands = %q, want a single adduser", runner.commands)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// AccountAttributes defines the attributes given to the local accounts of
+// synced users. Empty values are left to the account backend's defaults.
+type AccountAttributes struct {
+	HomeBase string `yaml:"homebase"`
+	Shell    string `yaml:"shell"`
+	Skel     string `yaml:"skel"`
+	Gecos    string `yaml:"gecos"`
+}
+
+// AccountOverride applies account attributes to the members of a directory
+// group, taking precedence over the global defaults
+type AccountOverride struct {
+	Group             string `yaml:"group"`
+	AccountAttributes `yaml:",inline"`
+}
+
+// AccountConfig holds the global account attributes and the per group
+// overrides, the first matching override winning for each attribute
+type AccountConfig struct {
+	AccountAttributes `yaml:",inline"`
+	Overrides         []AccountOverride `yaml:"overrides"`
+}
+
+// checkForUnsetAccountConfig sets the default account attributes and
+// validates the configured ones
+func checkForUnsetAccountConfig() error {
+	accounts := &Cfg.Accounts
+	if accounts.HomeBase == "" {
+		accounts.HomeBase = "/home"
+	}
+	if accounts.Gecos == "" {
+		accounts.Gecos = "{name},,,,{email}"
+	}
+
+	all := []AccountAttributes{accounts.AccountAttributes}
+	for _, o := range accounts.Overrides {
+		if o.Group == "" {
+			return errors.New("Account overrides require a group")
+		}
+		all = append(all, o.AccountAttributes)
+	}
+	for _, attrs := range all {
+		for _, p := range []string{attrs.HomeBase, attrs.Shell, attrs.Skel} {
+			if p != "" && !path.IsAbs(p) {
+				return fmt.Errorf("Account path %s must be absolute", p)
+			}
+		}
+	}
+	return nil
+}
+
+// resolveAccountAttributes merges the global account attributes with the
+// overrides of the groups the user belongs to
+func resolveAccountAttributes(u IAMUser) AccountAttributes {
+	resolved := AccountAttributes{}
+	set := func(field *string, value string) {
+		if *field == "" {
+			*field = value
+		}
+	}
+
+	memberOf := map[string]bool{}
+	for _, g := range u.groups {
+		memberOf[g] = true
+	}
+	for _, o := range Cfg.Accounts.Overrides {
+		if !memberOf[o.Group] {
+			continue
+		}
+		set(&resolved.HomeBase, o.HomeBase)
+		set(&resolved.Shell, o.Shell)
+		set(&resolved.Skel, o.Skel)
+		set(&resolved.Gecos, o.Gecos)
+	}
+
+	set(&resolved.HomeBase, Cfg.Accounts.HomeBase)
+	set(&resolved.Shell, Cfg.Accounts.Shell)
+	set(&resolved.Skel, Cfg.Accounts.Skel)
+	set(&resolved.Gecos, Cfg.Accounts.Gecos)
+	return resolved
+}
+
+// shellAllowed reports whether a shell is listed in /etc/shells. Every
+// shell is allowed when the file doesn't exist.
+func shellAllowed(shell string) bool {
+	data, err := ioutil.ReadFile(filepath.Join(Cfg.Root, "/etc/shells"))
+	if errors.Is(err, os.ErrNotExist) {
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == shell {
+			return true
+		}
+	}
+	return false
+}
+
+// formatGecos fills the GECOS template with the user's details. Colons,
+// commas and newlines are removed from the values as they would break the
+// passwd entry or its subfields.
+func formatGecos(template string, u IAMUser) string {
+	clean := strings.NewReplacer(":", "", ",", "", "\n", "", "\r", "")
+	gecos := strings.NewReplacer(
+		"{name}", clean.Replace(u.fullname),
+		"{email}", clean.Replace(u.email),
+		"{username}", clean.Replace(u.username),
+	).Replace(template)
+	return strings.TrimRight(strings.ReplaceAll(gecos, ":", ""), ",")
+}
+
+// accountFor returns the local account a user should have, along with the
+// skeleton directory its home is created from. A login shell set by the
+// provider takes precedence over the configured one if /etc/shells allows
+// it.
+func accountFor(u IAMUser) (LocalAccount, string) {
+	attrs := resolveAccountAttributes(u)
+
+	shell := attrs.Shell
+	if u.shell != "" {
+		if shellAllowed(u.shell) {
+			shell = u.shell
+		} else {
+			globalLogger.Error(
+				"Shell %s of user %s is not listed in /etc/shells, "+
+					"ignoring it\n",
+				u.shell, u.username,
+			)
+		}
+	}
+
+	return LocalAccount{
+		Username: u.username,
+		Home:     path.Join(attrs.HomeBase, u.username),
+		Shell:    shell,
+		Gecos:    formatGecos(attrs.Gecos, u),
+	}, attrs.Skel
+}
+
+// reconcileAccount updates the home, shell and GECOS of an existing account
+// when they no longer match the configured attributes. Moving the home
+// directory carries its contents over. Only accounts the sync created have
+// their home moved, an adopted account keeps the home it was adopted with.
+func reconcileAccount(u IAMUser, created bool) error {
+	desired, _ := accountFor(u)
+	current, err := accountBackend.LookupUser(u.username)
+	if err != nil {
+		return err
+	}
+
+	if !created {
+		desired.Home = current.Home
+	}
+
+	// An unset shell is left to whatever the account already has
+	if desired.Shell == "" {
+		desired.Shell = current.Shell
+	}
+	if desired.Home == current.Home && desired.Shell == current.Shell &&
+		desired.Gecos == current.Gecos {
+		return nil
+	}
+
+	globalLogger.Info(
+		"Updating account of user %s: home %s, shell %s, GECOS %q\n",
+		u.username, desired.Home, desired.Shell, desired.Gecos,
+	)
+	return accountBackend.ModifyUser(desired)
+}
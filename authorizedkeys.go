@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultKeysFile is where the keys are published when statedir is left at
+// its default, and where the authorized-keys subcommand looks for them
+const defaultKeysFile = "/var/lib/iamusersync/keys.json"
+
+// publishedKeys struct to map the keys published for sshd's
+// AuthorizedKeysCommand to
+type publishedKeys struct {
+	Updated time.Time           `json:"updated"`
+	Users   map[string][]string `json:"users"`
+}
+
+// loadPublishedKeys reads a published keys file
+func loadPublishedKeys(path string) (publishedKeys, error) {
+	keys := publishedKeys{Users: map[string][]string{}}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return keys, err
+	}
+	err = json.Unmarshal(data, &keys)
+	if err != nil {
+		return keys, fmt.Errorf("%s: %v", path, err)
+	}
+	if keys.Users == nil {
+		keys.Users = map[string][]string{}
+	}
+	return keys, nil
+}
+
+// PublishKeys writes the keys of the managed accounts to the keys file read
+// by the authorized-keys subcommand. Accounts in kept, whose provider could
+// not be reached, retain the keys they were last published with. The file
+// holds public keys only, so it is made readable by the unprivileged
+// AuthorizedKeysCommandUser.
+func PublishKeys(
+	users []IAMUser,
+	accounts []string,
+	kept map[string]bool,
+) error {
+	keys := map[string][]string{}
+	for _, u := range users {
+		keys[u.username] = authorizedKeyLines(u)
+	}
+
+	previous, err := loadPublishedKeys(Cfg.KeysFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		globalLogger.Error("Issue loading published keys: %v\n", err)
+	}
+
+	published := publishedKeys{
+		Updated: time.Now().UTC(),
+		Users:   map[string][]string{},
+	}
+	for _, username := range accounts {
+		if userKeys, ok := keys[username]; ok {
+			published.Users[username] = userKeys
+		} else if kept[username] {
+			published.Users[username] = previous.Users[username]
+		}
+	}
+
+	// The directory must be traversable for the keys to be read
+	dir := filepath.Dir(Cfg.KeysFile)
+	err = os.MkdirAll(dir, 0711)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0011 != 0011 {
+		err = os.Chmod(dir, info.Mode().Perm()|0011)
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(published, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(Cfg.KeysFile, data, 0644)
+}
+
+// AuthorizedKeysCommand implements the authorized-keys subcommand, printing
+// the published keys of the given user one per line for sshd. It only reads
+// the local keys file so it never blocks a login on the network. Nothing is
+// printed for unknown users. Returns the process exit code.
+func AuthorizedKeysCommand(args []string) int {
+	flags := flag.NewFlagSet("authorized-keys", flag.ContinueOnError)
+	keysFile := flags.String(
+		"keysfile", defaultKeysFile,
+		"Path to the keys file published by the sync.",
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(
+			flags.Output(),
+			"Usage: %s authorized-keys [--keysfile path] <username>\n",
+			filepath.Base(os.Args[0]),
+		)
+		flags.PrintDefaults()
+	}
+	if flags.Parse(args) != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	keys, err := loadPublishedKeys(*keysFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading published keys: %v\n", err)
+		return 1
+	}
+
+	for _, key := range keys.Users[flags.Arg(0)] {
+		// A key spanning several lines would let a provider inject options
+		// for other keys
+		if strings.ContainsAny(key, "\r\n") {
+			continue
+		}
+		fmt.Println(key)
+	}
+	return 0
+}
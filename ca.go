@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// CAConfig defines the OpenSSH user certificate authority used when
+// keysmode is ca. Hosts trust the CA keys and each synced user is given an
+// AuthorizedPrincipalsFile, while the sign subcommand issues certificates.
+type CAConfig struct {
+	PublicKeys      []string `yaml:"publickeys"`
+	PrivateKey      string   `yaml:"privatekey"`
+	TrustedKeysFile string   `yaml:"trustedkeysfile"`
+	PrincipalsDir   string   `yaml:"principalsdir"`
+	PrincipalPrefix string   `yaml:"principalprefix"`
+	PrincipalGroups []string `yaml:"principalgroups"`
+	Validity        string   `yaml:"validity"`
+}
+
+// checkForUnsetCAConfig sets the default CA options and validates the
+// configured ones
+func checkForUnsetCAConfig() error {
+	ca := &Cfg.CA
+	if ca.TrustedKeysFile == "" {
+		ca.TrustedKeysFile = "/etc/ssh/iamusersync_trusted_ca.pub"
+	}
+	if ca.PrincipalsDir == "" {
+		ca.PrincipalsDir = "/etc/ssh/auth_principals"
+	}
+	// Without a prefix, a group named after a user would grant its members
+	// that user's principal
+	if ca.PrincipalPrefix == "" {
+		ca.PrincipalPrefix = "group:"
+	}
+	if ca.Validity == "" {
+		ca.Validity = "8h"
+	}
+	validity, err := time.ParseDuration(ca.Validity)
+	if err != nil || validity <= 0 {
+		return fmt.Errorf("CA validity %s is invalid", ca.Validity)
+	}
+
+	for _, key := range ca.PublicKeys {
+		_, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+		if err != nil {
+			return fmt.Errorf("CA public key %q is invalid: %v", key, err)
+		}
+	}
+	if Cfg.KeysMode == "ca" && len(ca.PublicKeys) == 0 &&
+		ca.PrivateKey == "" {
+		return errors.New(
+			"CA mode requires ca publickeys or a ca privatekey to trust",
+		)
+	}
+	return nil
+}
+
+// loadCASigner reads the CA private key used to sign certificates
+func loadCASigner() (ssh.Signer, error) {
+	if Cfg.CA.PrivateKey == "" {
+		return nil, errors.New("no CA private key configured")
+	}
+	data, err := ioutil.ReadFile(Cfg.CA.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", Cfg.CA.PrivateKey, err)
+	}
+	return signer, nil
+}
+
+// trustedCAKeys returns the CA public keys hosts should trust, taking them
+// from the private key when none are configured
+func trustedCAKeys() ([]string, error) {
+	if len(Cfg.CA.PublicKeys) > 0 {
+		return Cfg.CA.PublicKeys, nil
+	}
+	signer, err := loadCASigner()
+	if err != nil {
+		return nil, err
+	}
+	key := strings.TrimSpace(
+		string(ssh.MarshalAuthorizedKey(signer.PublicKey())),
+	)
+	return []string{key}, nil
+}
+
+// writeRootFile atomically replaces a root owned file that sshd reads, only
+// when its content changed. It returns whether the file was written.
+func writeRootFile(path string, content []byte) (bool, error) {
+	existing, err := ioutil.ReadFile(path)
+	if err == nil && bytes.Equal(existing, content) {
+		return false, nil
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return false, err
+	}
+	return true, writeFileAtomic(path, content, 0644)
+}
+
+// writeTrustedCAKeys maintains the file set as TrustedUserCAKeys in
+// sshd_config
+func writeTrustedCAKeys() error {
+	keys, err := trustedCAKeys()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(Cfg.Root, Cfg.CA.TrustedKeysFile)
+	written, err := writeRootFile(
+		path, []byte(strings.Join(keys, "\n")+"\n"),
+	)
+	if written {
+		globalLogger.Info("Updated trusted CA keys in %s\n", path)
+	}
+	return err
+}
+
+// principalsPath returns the AuthorizedPrincipalsFile of a user
+func principalsPath(username string) string {
+	return filepath.Join(Cfg.Root, Cfg.CA.PrincipalsDir, username)
+}
+
+// certPrincipals returns the principals a certificate issued to the user
+// carries: the username and a prefixed principal per directory group
+func certPrincipals(u IAMUser) []string {
+	principals := []string{u.username}
+	for _, g := range u.groups {
+		principals = append(principals, Cfg.CA.PrincipalPrefix+g)
+	}
+	return principals
+}
+
+// extraPrincipalRefused returns why a principal can't be added to the
+// certificate of user, or an empty string. Without an AuthorizedPrincipalsFile
+// sshd accepts a certificate for any account named in its principals, so a
+// protected name or the name of another IAM user would let the holder log
+// in as that account. Group principals are only issued from the directory.
+func extraPrincipalRefused(
+	principal string,
+	user IAMUser,
+	users []IAMUser,
+) string {
+	if reason := protectedName(principal); reason != "" {
+		return reason
+	}
+	for _, u := range users {
+		if u.username == principal && u.username != user.username {
+			return "it is the username of another IAM user"
+		}
+	}
+	if Cfg.CA.PrincipalPrefix != "" &&
+		strings.HasPrefix(principal, Cfg.CA.PrincipalPrefix) {
+		for _, p := range certPrincipals(user) {
+			if p == principal {
+				return ""
+			}
+		}
+		return "it is the principal of a group the user isn't in"
+	}
+	return ""
+}
+
+// accountPrincipals returns the principals allowed to log in to the user's
+// account: the username, and the group principals of the user's groups
+// listed in principalgroups, which lets any member log in as any other
+// member of those groups
+func accountPrincipals(u IAMUser) []string {
+	principals := []string{u.username}
+	for _, g := range u.groups {
+		for _, shared := range Cfg.CA.PrincipalGroups {
+			if g == shared {
+				principals = append(principals, Cfg.CA.PrincipalPrefix+g)
+			}
+		}
+	}
+	return principals
+}
+
+// writeAuthorizedPrincipals maintains the AuthorizedPrincipalsFile of a
+// synced user, prefixing the principals with the user's key options
+func writeAuthorizedPrincipals(u IAMUser) error {
+	// Principal lines take the same options as keys
+	lines := accountPrincipals(u)
+	if options := keyOptionsFor(u); options != "" {
+		for i, principal := range lines {
+			lines[i] = options + " " + principal
+		}
+	}
+	path := principalsPath(u.username)
+	written, err := writeRootFile(
+		path, []byte(strings.Join(lines, "\n")+"\n"),
+	)
+	if written {
+		globalLogger.Info("Updated principals in %s\n", path)
+	}
+	return err
+}
+
+// removeAuthorizedPrincipals removes the AuthorizedPrincipalsFile of a user
+// that is being deleted
+func removeAuthorizedPrincipals(username string) error {
+	err := os.Remove(principalsPath(username))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// signUserKey issues a user certificate for a public key
+func signUserKey(
+	signer ssh.Signer,
+	u IAMUser,
+	key ssh.PublicKey,
+	principals []string,
+	validity time.Duration,
+) (*ssh.Certificate, error) {
+	var serial [8]byte
+	_, err := rand.Read(serial[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// Backdate the start a little to allow for clock skew between hosts
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        ssh.UserCert,
+		KeyId:           "iamusersync:" + u.username,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Add(-5 * time.Minute).Unix()),
+		ValidBefore:     uint64(now.Add(validity).Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: map[string]string{
+				"permit-X11-forwarding":   "",
+				"permit-agent-forwarding": "",
+				"permit-port-forwarding":  "",
+				"permit-pty":              "",
+				"permit-user-rc":          "",
+			},
+		},
+	}
+	err = cert.SignCert(rand.Reader, signer)
+	if err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// SignCommand implements the sign subcommand, issuing a certificate for
+// each of the user's directory keys, or only the key matching the given
+// fingerprint. Certificates are printed one per line. Returns the process
+// exit code.
+func SignCommand(args []string) int {
+	flags := flag.NewFlagSet("sign", flag.ContinueOnError)
+	config := flags.String("config", "", "Full path to config file.")
+	validityFlag := flags.String(
+		"validity", "",
+		"How long the certificate is valid for. (Default: ca validity)",
+	)
+	extraPrincipals := flags.String(
+		"principals", "",
+		"Comma separated principals to add to the user's own.",
+	)
+	fingerprint := flags.String(
+		"fingerprint", "",
+		"Only sign the key with this SHA256 fingerprint.",
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(
+			flags.Output(),
+			"Usage: %s sign --config path [options] <username>\n",
+			filepath.Base(os.Args[0]),
+		)
+		flags.PrintDefaults()
+	}
+	if flags.Parse(args) != nil {
+		return 2
+	}
+	if flags.NArg() != 1 || *config == "" {
+		flags.Usage()
+		return 2
+	}
+
+	err := LoadConfigFile(*config)
+	if err == nil {
+		err = CheckForUnsetConfig()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error processing config: %v\n", err)
+		return 1
+	}
+	if *validityFlag != "" {
+		Cfg.CA.Validity = *validityFlag
+	}
+	validity, err := time.ParseDuration(Cfg.CA.Validity)
+	if err != nil || validity <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid validity %s\n", Cfg.CA.Validity)
+		return 2
+	}
+
+	signer, err := loadCASigner()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading CA key: %v\n", err)
+		return 1
+	}
+
+	// Certificates are written to stdout, so keep it free of log messages
+	globalLogger, err = NewFileLogger(Cfg.LogFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error while initializing logging: %v\n", err)
+		return 1
+	}
+	defer globalLogger.CloseFile()
+	globalLogger.RedirectInfoToStderr()
+
+	users, _, err := PullUsersFromIAM()
+	if err != nil {
+		globalLogger.Error("Issue pulling users from IAM: %v\n", err)
+		return 1
+	}
+	// A certificate for root or a protected account would let the holder log
+	// in as it on every host trusting the CA
+	if reason := protectedName(flags.Arg(0)); reason != "" {
+		globalLogger.Error(
+			"REFUSING to sign for protected account %s as %s\n",
+			flags.Arg(0), reason,
+		)
+		return 1
+	}
+	var user *IAMUser
+	for i := range users {
+		if users[i].username == flags.Arg(0) {
+			user = &users[i]
+		}
+	}
+	if user == nil {
+		globalLogger.Error("User %s not found in IAM\n", flags.Arg(0))
+		return 1
+	}
+
+	principals := certPrincipals(*user)
+	for _, p := range strings.Split(*extraPrincipals, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if reason := extraPrincipalRefused(p, *user, users); reason != "" {
+			globalLogger.Error(
+				"REFUSING to sign with principal %s as %s\n", p, reason,
+			)
+			return 1
+		}
+		principals = append(principals, p)
+	}
+
+	signed := 0
+	for _, line := range user.publickeys {
+		key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			globalLogger.Error(
+				"Skipping invalid key of user %s: %v\n", user.username, err,
+			)
+			continue
+		}
+		if *fingerprint != "" && ssh.FingerprintSHA256(key) != *fingerprint {
+			continue
+		}
+
+		cert, err := signUserKey(signer, *user, key, principals, validity)
+		if err != nil {
+			globalLogger.Error("Issue signing key: %v\n", err)
+			return 1
+		}
+		fmt.Printf(
+			"%s %s\n",
+			strings.TrimSpace(string(ssh.MarshalAuthorizedKey(cert))),
+			comment,
+		)
+		globalLogger.Info(
+			"Issued certificate %d for %s key %s, principals %s, valid "+
+				"until %s\n",
+			cert.Serial, user.username, ssh.FingerprintSHA256(key),
+			strings.Join(principals, ","),
+			time.Unix(int64(cert.ValidBefore), 0).UTC().Format(time.RFC3339),
+		)
+		signed++
+	}
+
+	if signed == 0 {
+		globalLogger.Error("No key of user %s was signed\n", user.username)
+		return 1
+	}
+	return 0
+}
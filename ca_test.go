@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestExtraPrincipalRefused(t *testing.T) {
+	previousCfg := Cfg
+	t.Cleanup(func() { Cfg = previousCfg })
+	Cfg = Config{}
+	Cfg.CA.PrincipalPrefix = "group:"
+	Cfg.Protected.Users = []string{"deploy"}
+
+	ada := IAMUser{username: "ada", groups: []string{"sre"}}
+	users := []IAMUser{ada, {username: "alan"}}
+	tests := []struct {
+		principal string
+		refused   bool
+	}{
+		{"shared", false},
+		{"ada", false},
+		{"group:sre", false},
+		{"root", true},
+		{"deploy", true},
+		{"alan", true},
+		{"group:admins", true},
+	}
+	for _, tt := range tests {
+		reason := extraPrincipalRefused(tt.principal, ada, users)
+		if (reason != "") != tt.refused {
+			t.Errorf("%s: reason = %q, want refused %t", tt.principal,
+				reason, tt.refused)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cachedUser struct to map a cached IAMUser to
+type cachedUser struct {
+	Username   string   `json:"username"`
+	Email      string   `json:"email,omitempty"`
+	PublicKeys []string `json:"publickeys"`
+	Groups     []string `json:"groups,omitempty"`
+	FullName   string   `json:"fullname,omitempty"`
+	Shell      string   `json:"shell,omitempty"`
+}
+
+// providerCache struct to map the last known good result of a provider to
+type providerCache struct {
+	Provider string       `json:"provider"`
+	Fetched  time.Time    `json:"fetched"`
+	Users    []cachedUser `json:"users"`
+}
+
+// providerCachePath returns the path of the cache file for a provider
+func providerCachePath(name string) string {
+	return filepath.Join(Cfg.StateDir, "cache", name+".json")
+}
+
+// loadProviderCache reads the cache file for a provider. The returned bool
+// is false if the provider has never been cached.
+func loadProviderCache(name string) (providerCache, bool, error) {
+	var cache providerCache
+
+	data, err := ioutil.ReadFile(providerCachePath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return cache, false, nil
+	}
+	if err != nil {
+		return cache, false, err
+	}
+
+	err = json.Unmarshal(data, &cache)
+	if err != nil {
+		return cache, false, fmt.Errorf(
+			"%s: %v", providerCachePath(name), err,
+		)
+	}
+	return cache, true, nil
+}
+
+// saveProviderCache persists the users returned by a provider along with the
+// time they were fetched
+func saveProviderCache(name string, users []IAMUser) error {
+	err := os.MkdirAll(filepath.Dir(providerCachePath(name)), 0700)
+	if err != nil {
+		return err
+	}
+
+	cache := providerCache{
+		Provider: name,
+		Fetched:  time.Now().UTC(),
+		Users:    []cachedUser{},
+	}
+	for _, u := range users {
+		cache.Users = append(cache.Users, cachedUser{
+			Username:   u.username,
+			Email:      u.email,
+			PublicKeys: u.publickeys,
+			Groups:     u.groups,
+			FullName:   u.fullname,
+			Shell:      u.shell,
+		})
+	}
+
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(providerCachePath(name), data, 0600)
+}
+
+// iamUsers converts the cached users back to IAMUser objects
+func (c providerCache) iamUsers() []IAMUser {
+	users := []IAMUser{}
+	for _, u := range c.Users {
+		users = append(users, IAMUser{
+			username:   u.Username,
+			email:      u.Email,
+			publickeys: u.PublicKeys,
+			groups:     u.Groups,
+			fullname:   u.FullName,
+			shell:      u.Shell,
+		})
+	}
+	return users
+}
+
+// fresh reports whether the cache is young enough to be used in place of a
+// live provider result
+func (c providerCache) fresh(maxAge time.Duration) bool {
+	return maxAge > 0 && time.Since(c.Fetched) <= maxAge
+}
+
+// isSuspiciousResult reports whether a live result dropped more than
+// maxDropPercent of the users held in the cache, which usually means the
+// provider returned partial data rather than that users were removed
+func isSuspiciousResult(live int, cached int, maxDropPercent int) bool {
+	if cached == 0 || live >= cached {
+		return false
+	}
+	dropped := (cached - live) * 100 / cached
+	return dropped > maxDropPercent
+}
+
+// PullUsersWithCache pulls the users from a provider instance, falling back
+// to its last known good result when the provider fails or returns a
+// suspiciously smaller list of users, as long as that result is no older
+// than the configured max age. Successful results are cached for next time.
+// The outcome of the pull is recorded for the sync report.
+func PullUsersWithCache(p ProviderConfig) ([]IAMUser, error) {
+	maxAge, _ := time.ParseDuration(Cfg.CacheMaxAge)
+
+	ctx, cancel := providerContext()
+	defer cancel()
+	ctx, stats := withProviderStats(ctx)
+	report := providerReport{Name: p.Name, Status: "ok"}
+	start := time.Now()
+	defer func() { recordProviderReport(report, stats, start) }()
+
+	cache, cached, cacheErr := loadProviderCache(p.Name)
+	if cacheErr != nil {
+		// A corrupt cache must not stop the live result from being used
+		globalLogger.Error(
+			"Issue loading cache for provider %s: %v\n", p.Name, cacheErr,
+		)
+	}
+	usable := cached && cache.fresh(maxAge)
+
+	users, err := PullUsersFromProvider(ctx, p)
+	if err != nil {
+		report.Category, _ = classifyError(err)
+		report.Error = err.Error()
+		report.Status = "failed"
+		if !usable {
+			return nil, err
+		}
+		report.Status = "cached"
+		globalLogger.Error(
+			"Issue pulling users from provider %s: %v. Using %d cached "+
+				"users fetched at %s instead.\n",
+			p.Name, err, len(cache.Users), cache.Fetched.Format(time.RFC3339),
+		)
+		return cache.iamUsers(), nil
+	}
+
+	if cached &&
+		isSuspiciousResult(len(users), len(cache.Users), Cfg.CacheMaxDrop) {
+		if usable {
+			globalLogger.Error(
+				"Provider %s returned %d users but %d were cached, more "+
+					"than %d%% fewer. Using the cached users fetched at %s "+
+					"instead.\n",
+				p.Name, len(users), len(cache.Users), Cfg.CacheMaxDrop,
+				cache.Fetched.Format(time.RFC3339),
+			)
+			report.Status = "cached"
+			return cache.iamUsers(), nil
+		}
+		globalLogger.Info(
+			"Provider %s returned %d users but %d were cached. The cache "+
+				"is older than %s so the new result is accepted.\n",
+			p.Name, len(users), len(cache.Users), maxAge,
+		)
+	}
+
+	saveErr := saveProviderCache(p.Name, users)
+	if saveErr != nil {
+		globalLogger.Error(
+			"Issue saving cache for provider %s: %v\n", p.Name, saveErr,
+		)
+	}
+	return users, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// CommandResult describes a finished external command
+type CommandResult struct {
+	Command  string
+	Stdout   []byte
+	Stderr   []byte
+	ExitCode int
+	Duration time.Duration
+}
+
+// CommandRunner runs external commands. The account backends run every
+// command through commandRunner, so it can be replaced to simulate the
+// outcome of commands without root.
+type CommandRunner interface {
+	// Run runs a command until it exits or ctx is done. The error is only
+	// set when the command could not be started or was killed, a non-zero
+	// exit code is reported in the result.
+	Run(ctx context.Context, name string, args ...string) (CommandResult, error)
+}
+
+// execRunner runs commands with os/exec
+type execRunner struct{}
+
+func (execRunner) Run(
+	ctx context.Context,
+	name string,
+	args ...string,
+) (CommandResult, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	start := time.Now()
+	err := cmd.Run()
+	result := CommandResult{
+		Command:  strings.Join(append([]string{name}, args...), " "),
+		Stdout:   stdout.Bytes(),
+		Stderr:   stderr.Bytes(),
+		ExitCode: -1,
+		Duration: time.Since(start),
+	}
+	if cmd.ProcessState != nil {
+		result.ExitCode = cmd.ProcessState.ExitCode()
+	}
+
+	// A command killed at the deadline is a timeout, not an exit status
+	if ctx.Err() != nil {
+		return result, ctx.Err()
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return result, nil
+	}
+	return result, err
+}
+
+// commandRunner is the globally accessed runner of external commands
+var commandRunner CommandRunner = execRunner{}
+
+// CommandError is returned when an external command fails. It carries the
+// command's stderr and exit code, as the exit status alone rarely explains
+// why an account tool failed.
+type CommandError struct {
+	Command  string
+	Stderr   string
+	ExitCode int
+	Duration time.Duration
+	Err      error
+}
+
+func (e *CommandError) Error() string {
+	msg := fmt.Sprintf(
+		"%s: exit status %d after %s", e.Command, e.ExitCode, e.Duration,
+	)
+	if e.Err != nil {
+		msg = fmt.Sprintf("%s: %v", e.Command, e.Err)
+	}
+	if e.Stderr != "" {
+		msg += ": " + e.Stderr
+	}
+	return msg
+}
+
+func (e *CommandError) Unwrap() error { return e.Err }
+
+// runCommandResult runs a command through commandRunner within the command
+// timeout, logging its outcome at debug level. A CommandError is returned
+// when the command couldn't be run, timed out or exited with a non-zero
+// code.
+func runCommandResult(name string, args ...string) (CommandResult, error) {
+	timeout, _ := time.ParseDuration(Cfg.CommandTimeout)
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	result, err := commandRunner.Run(ctx, name, args...)
+	if result.Command == "" {
+		result.Command = strings.Join(append([]string{name}, args...), " ")
+	}
+	stderr := strings.TrimSpace(string(result.Stderr))
+	if globalLogger != nil {
+		globalLogger.Debug(
+			"Ran %s: exit code %d in %s, stdout %q, stderr %q\n",
+			result.Command, result.ExitCode, result.Duration.Round(
+				time.Millisecond,
+			),
+			strings.TrimSpace(string(result.Stdout)), stderr,
+		)
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	if err != nil || result.ExitCode != 0 {
+		return result, &CommandError{
+			Command:  result.Command,
+			Stderr:   stderr,
+			ExitCode: result.ExitCode,
+			Duration: result.Duration.Round(time.Millisecond),
+			Err:      err,
+		}
+	}
+	return result, nil
+}
+
+// runCommand runs a command, returning its stdout, or a CommandError with
+// its stderr if it fails
+func runCommand(name string, args ...string) ([]byte, error) {
+	result, err := runCommandResult(name, args...)
+	return result.Stdout, err
+}
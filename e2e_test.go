@@ -0,0 +1,714 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// useTestLogger logs to a file in a temporary directory for the rest of
+// the test
+func useTestLogger(t *testing.T) {
+	t.Helper()
+	previous := globalLogger
+	logger, err := NewFileLogger(filepath.Join(t.TempDir(), "test.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	globalLogger = logger
+	t.Cleanup(func() {
+		logger.CloseFile()
+		globalLogger = previous
+	})
+}
+
+// testSystem is a system installed under a temporary root, which a sync
+// manages through the native account backend
+type testSystem struct {
+	Root     string
+	StateDir string
+}
+
+// newTestSystem creates a minimal system under a temporary root and loads
+// the given configuration to sync it, with the root, state directory, log
+// file and native backend set. The configuration is reset when the test
+// ends. The home directories are owned by the synced accounts, so the
+// tests need to run as root.
+func newTestSystem(t *testing.T, config string) *testSystem {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("syncing accounts needs root to chown home directories")
+	}
+
+	dir := t.TempDir()
+	sys := &testSystem{
+		Root:     filepath.Join(dir, "root"),
+		StateDir: filepath.Join(dir, "state"),
+	}
+	files := map[string]string{
+		"etc/passwd":        "root:x:0:0:root:/root:/bin/bash\n",
+		"etc/shadow":        "root:*:19000:0:99999:7:::\n",
+		"etc/group":         "root:x:0:\n",
+		"etc/gshadow":       "root:*::\n",
+		"etc/login.defs":    "UID_MIN 1000\nUID_MAX 60000\nGID_MIN 1000\n",
+		"etc/shells":        "/bin/sh\n/bin/bash\n/bin/zsh\n",
+		"etc/skel/.profile": "# ~/.profile\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(sys.Root, name)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.MkdirAll(filepath.Join(sys.Root, "home"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previousCfg := Cfg
+	previousBackend := accountBackend
+	t.Cleanup(func() {
+		Cfg = previousCfg
+		accountBackend = previousBackend
+	})
+	useTestLogger(t)
+
+	Cfg = Config{}
+	configPath := filepath.Join(dir, "config.yml")
+	config += fmt.Sprintf(
+		"root: %s\nstatedir: %s\nlogfile: %s\naccountbackend: native\n",
+		sys.Root, sys.StateDir, filepath.Join(dir, "iamusersync.log"),
+	)
+	err = ioutil.WriteFile(configPath, []byte(config), 0600)
+	if err == nil {
+		err = LoadConfigFile(configPath)
+	}
+	if err == nil {
+		err = CheckForUnsetConfig()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err := NewAccountBackend(Cfg.AccountBackend, Cfg.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountBackend = newLockedBackend(backend)
+	return sys
+}
+
+// entries reads a colon separated account database, keyed by name
+func (sys *testSystem) entries(t *testing.T, name string) map[string][]string {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join(sys.Root, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := map[string][]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.Split(line, ":")
+		entries[fields[0]] = fields
+	}
+	return entries
+}
+
+// groupMembers returns the sorted members of a group
+func (sys *testSystem) groupMembers(t *testing.T, group string) []string {
+	t.Helper()
+	entry, ok := sys.entries(t, "etc/group")[group]
+	if !ok {
+		t.Fatalf("group %s does not exist", group)
+	}
+	members := []string{}
+	if entry[3] != "" {
+		members = strings.Split(entry[3], ",")
+	}
+	sort.Strings(members)
+	return members
+}
+
+// assertAccount checks the passwd entry of an account, and that its
+// authorized_keys file holds keys and is owned by it with the mode sshd
+// expects
+func (sys *testSystem) assertAccount(
+	t *testing.T,
+	username string,
+	shell string,
+	keys ...string,
+) {
+	t.Helper()
+	entry, ok := sys.entries(t, "etc/passwd")[username]
+	if !ok {
+		t.Errorf("account %s does not exist", username)
+		return
+	}
+	if home := "/home/" + username; entry[5] != home {
+		t.Errorf("home of %s = %s, want %s", username, entry[5], home)
+	}
+	if entry[6] != shell {
+		t.Errorf("shell of %s = %s, want %s", username, entry[6], shell)
+	}
+
+	path := filepath.Join(sys.Root, entry[5], ".ssh", "authorized_keys")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if want := strings.Join(keys, "\n") + "\n"; string(data) != want {
+		t.Errorf("%s = %q, want %q", path, data, want)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("mode of %s = %o, want 600", path, info.Mode().Perm())
+	}
+	uid, _ := strconv.Atoi(entry[2])
+	if owner := fileOwner(info); owner != uid {
+		t.Errorf("owner of %s = %d, want %d", path, owner, uid)
+	}
+}
+
+// fileOwner returns the UID owning a file
+func fileOwner(info os.FileInfo) int {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return -1
+	}
+	return int(stat.Uid)
+}
+
+// assertNoAccount checks an account and its home directory don't exist
+func (sys *testSystem) assertNoAccount(t *testing.T, username string) {
+	t.Helper()
+	if _, ok := sys.entries(t, "etc/passwd")[username]; ok {
+		t.Errorf("account %s exists", username)
+	}
+	home := filepath.Join(sys.Root, "home", username)
+	if _, err := os.Lstat(home); !os.IsNotExist(err) {
+		t.Errorf("home %s exists", home)
+	}
+}
+
+// writeHomeMarker writes a file to the home of an account, which is only
+// still there if the account was never deleted and created again
+func (sys *testSystem) writeHomeMarker(t *testing.T, username string) string {
+	t.Helper()
+	path := filepath.Join(sys.Root, "home", username, "marker")
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// report reads the report of the last sync
+func (sys *testSystem) report(t *testing.T) syncReport {
+	t.Helper()
+	var report syncReport
+	data, err := ioutil.ReadFile(filepath.Join(sys.StateDir, "report.json"))
+	if err == nil {
+		err = json.Unmarshal(data, &report)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+// gsuiteTestConfig returns the configuration of a GSUITE provider pulling
+// users from a fake Directory API, which is called without credentials
+func gsuiteTestConfig(t *testing.T, fake *fakeDirectory) string {
+	previous := gsuiteHTTPClient
+	gsuiteHTTPClient = http.DefaultClient
+	t.Cleanup(func() { gsuiteHTTPClient = previous })
+
+	return fmt.Sprintf(
+		"provider: GSUITE\n"+
+			"provider-options:\n"+
+			"  gsuiteadmin: admin@%s\n"+
+			"  credentials: unused.json\n"+
+			"  gsuiteendpoint: %s\n",
+		fake.Domain, fake.URL,
+	)
+}
+
+func TestSyncGsuiteEndToEnd(t *testing.T) {
+	fake := newFakeDirectory(t, "example.com")
+	fake.PageSize = 2
+	adaKey := testPublicKey(t, "ada@laptop")
+	graceKey := testPublicKey(t, "grace@laptop")
+	fake.setUsers(
+		fakeDirectoryUser{Email: "ada@example.com", GivenName: "Ada",
+			FamilyName: "Lovelace", SSHKey: adaKey, Shell: "/bin/zsh"},
+		fakeDirectoryUser{Email: "alan@example.com", GivenName: "Alan",
+			FamilyName: "Turing", SSHKey: testPublicKey(t, "alan"),
+			Suspended: true},
+		fakeDirectoryUser{Email: "grace@example.com", GivenName: "Grace",
+			FamilyName: "Hopper", SSHKey: graceKey},
+		fakeDirectoryUser{Email: "edsger@example.com", GivenName: "Edsger",
+			FamilyName: "Dijkstra"},
+	)
+	sys := newTestSystem(t, gsuiteTestConfig(t, fake)+"group: sshusers\n")
+
+	err := SyncUsers()
+	if err != nil {
+		t.Fatalf("first sync: %v", err)
+	}
+	sys.assertAccount(t, "ada.lovelace", "/bin/zsh", adaKey)
+	sys.assertAccount(t, "grace.hopper", "/bin/sh", graceKey)
+	sys.assertNoAccount(t, "alan.turing")
+	sys.assertNoAccount(t, "edsger.dijkstra")
+	want := []string{"ada.lovelace", "grace.hopper"}
+	if got := sys.groupMembers(t, "sshusers"); !reflect.DeepEqual(got, want) {
+		t.Errorf("members = %v, want %v", got, want)
+	}
+	if report := sys.report(t); report.Status != "success" {
+		t.Errorf("report = %+v, want success", report)
+	}
+
+	// Rotate a key and remove a user from the directory
+	rotatedKey := testPublicKey(t, "ada@desktop")
+	fake.setUsers(
+		fakeDirectoryUser{Email: "ada@example.com", GivenName: "Ada",
+			FamilyName: "Lovelace", SSHKey: rotatedKey, Shell: "/bin/zsh"},
+	)
+	err = SyncUsers()
+	if err != nil {
+		t.Fatalf("second sync: %v", err)
+	}
+	sys.assertAccount(t, "ada.lovelace", "/bin/zsh", rotatedKey)
+	sys.assertNoAccount(t, "grace.hopper")
+	want = []string{"ada.lovelace"}
+	if got := sys.groupMembers(t, "sshusers"); !reflect.DeepEqual(got, want) {
+		t.Errorf("members = %v, want %v", got, want)
+	}
+	if _, ok := sys.entries(t, "etc/group")["grace.hopper"]; ok {
+		t.Error("private group of grace.hopper was not deleted")
+	}
+}
+
+func TestSyncGsuiteEndToEndProviderFailure(t *testing.T) {
+	fake := newFakeDirectory(t, "example.com")
+	adaKey := testPublicKey(t, "ada@laptop")
+	fake.setUsers(
+		fakeDirectoryUser{Email: "ada@example.com", GivenName: "Ada",
+			FamilyName: "Lovelace", SSHKey: adaKey},
+	)
+	sys := newTestSystem(t, gsuiteTestConfig(t, fake)+
+		"cachemaxage: 0s\n"+
+		"retry: {attempts: 2, initialbackoff: 1ms, maxbackoff: 1ms}\n")
+
+	err := SyncUsers()
+	if err != nil {
+		t.Fatalf("first sync: %v", err)
+	}
+	sys.assertAccount(t, "ada.lovelace", "/bin/sh", adaKey)
+
+	// An unreachable directory must not delete anyone
+	fake.fail(http.StatusServiceUnavailable, "backendError")
+	fake.fail(http.StatusServiceUnavailable, "backendError")
+	err = SyncUsers()
+	if syncExitCode(err) != exitTotalFailure {
+		t.Errorf("sync error = %v, want a total failure", err)
+	}
+	sys.assertAccount(t, "ada.lovelace", "/bin/sh", adaKey)
+	report := sys.report(t)
+	if report.Status != "failed" || len(report.Providers) != 1 ||
+		report.Providers[0].Category != errorTransient ||
+		report.Providers[0].Requests != 2 {
+		t.Errorf("report = %+v, want a transient provider failure", report)
+	}
+}
+
+func TestSyncGsuiteEndToEndRateLimited(t *testing.T) {
+	fake := newFakeDirectory(t, "example.com")
+	adaKey := testPublicKey(t, "ada@laptop")
+	fake.setUsers(
+		fakeDirectoryUser{Email: "ada@example.com", GivenName: "Ada",
+			FamilyName: "Lovelace", SSHKey: adaKey},
+	)
+	fake.rateLimit(2, "0")
+	sys := newTestSystem(t, gsuiteTestConfig(t, fake)+
+		"retry: {initialbackoff: 1ms, maxbackoff: 1ms}\n")
+
+	err := SyncUsers()
+	if err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	sys.assertAccount(t, "ada.lovelace", "/bin/sh", adaKey)
+	report := sys.report(t)
+	if len(report.Providers) != 1 || report.Providers[0].Status != "ok" ||
+		report.Providers[0].Retries != 2 {
+		t.Errorf("report = %+v, want ok after 2 retries", report)
+	}
+}
+
+func TestSyncGsuiteEndToEndMissingHome(t *testing.T) {
+	fake := newFakeDirectory(t, "example.com")
+	adaKey := testPublicKey(t, "ada@laptop")
+	fake.setUsers(
+		fakeDirectoryUser{Email: "ada@example.com", GivenName: "Ada",
+			FamilyName: "Lovelace", SSHKey: adaKey},
+	)
+	sys := newTestSystem(t, gsuiteTestConfig(t, fake))
+	err := SyncUsers()
+	if err != nil {
+		t.Fatalf("first sync: %v", err)
+	}
+
+	// The home and the directory holding it are recreated, with only the
+	// home itself private
+	err = os.RemoveAll(filepath.Join(sys.Root, "home"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SyncUsers()
+	if err != nil {
+		t.Fatalf("second sync: %v", err)
+	}
+	sys.assertAccount(t, "ada.lovelace", "/bin/sh", adaKey)
+	for dir, mode := range map[string]os.FileMode{
+		"home":              0755,
+		"home/ada.lovelace": 0700,
+	} {
+		info, err := os.Stat(filepath.Join(sys.Root, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != mode {
+			t.Errorf("mode of %s = %o, want %o", dir, info.Mode().Perm(), mode)
+		}
+	}
+}
+
+func TestSyncRecoversOnlyCreatedAccounts(t *testing.T) {
+	for _, created := range []bool{false, true} {
+		t.Run(fmt.Sprintf("created %t", created), func(t *testing.T) {
+			fake := newFakeDirectory(t, "example.com")
+			graceKey := testPublicKey(t, "grace@laptop")
+			fake.setUsers(
+				fakeDirectoryUser{Email: "grace@example.com",
+					GivenName: "Grace", FamilyName: "Hopper",
+					SSHKey: graceKey},
+			)
+			sys := newTestSystem(t, gsuiteTestConfig(t, fake))
+
+			// An interrupted sync journaled the creation of an account,
+			// which an administrator may have created meanwhile
+			err := accountBackend.AddUser(LocalAccount{
+				Username: "ada.lovelace",
+				Home:     "/home/ada.lovelace",
+				Shell:    "/bin/sh",
+			}, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := json.Marshal(syncJournal{Entries: []journalEntry{{
+				Op:       "add",
+				Username: "ada.lovelace",
+				Provider: "gsuite",
+				Created:  created,
+			}}})
+			if err == nil {
+				err = os.MkdirAll(sys.StateDir, 0700)
+			}
+			if err == nil {
+				err = ioutil.WriteFile(journalPath(), data, 0600)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = SyncUsers()
+			if err != nil {
+				t.Fatalf("sync: %v", err)
+			}
+			sys.assertAccount(t, "grace.hopper", "/bin/sh", graceKey)
+			_, exists := sys.entries(t, "etc/passwd")["ada.lovelace"]
+			if created && exists {
+				t.Error("account created by the sync was not deleted")
+			}
+			if !created && !exists {
+				t.Error("account that may not be the sync's was deleted")
+			}
+			if _, err := os.Stat(journalPath()); !os.IsNotExist(err) {
+				t.Errorf("journal was not cleared: %v", err)
+			}
+		})
+	}
+}
+
+func TestSyncKeepsHomeOfAdoptedAccounts(t *testing.T) {
+	fake := newFakeDirectory(t, "example.com")
+	adaKey := testPublicKey(t, "ada@laptop")
+	graceKey := testPublicKey(t, "grace@laptop")
+	fake.setUsers(
+		fakeDirectoryUser{Email: "ada@example.com", GivenName: "Ada",
+			FamilyName: "Lovelace", SSHKey: adaKey},
+		fakeDirectoryUser{Email: "grace@example.com", GivenName: "Grace",
+			FamilyName: "Hopper", SSHKey: graceKey},
+	)
+	sys := newTestSystem(t, gsuiteTestConfig(t, fake)+"adoption: always\n")
+
+	// An administrator created ada's account with a home of their choosing
+	err := accountBackend.AddUser(LocalAccount{
+		Username: "ada.lovelace",
+		Home:     "/srv/ada",
+		Shell:    "/bin/bash",
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SyncUsers()
+	if err != nil {
+		t.Fatalf("first sync: %v", err)
+	}
+
+	// Moving the homebase moves the homes the sync created, only
+	for _, homeBase := range []string{"/home", "/srv/home"} {
+		Cfg.Accounts.HomeBase = homeBase
+		err = SyncUsers()
+		if err != nil {
+			t.Fatalf("sync with homebase %s: %v", homeBase, err)
+		}
+		passwd := sys.entries(t, "etc/passwd")
+		if home := passwd["ada.lovelace"][5]; home != "/srv/ada" {
+			t.Errorf("home of adopted ada.lovelace = %s, want /srv/ada", home)
+		}
+		if shell := passwd["ada.lovelace"][6]; shell != "/bin/bash" {
+			t.Errorf("shell of ada.lovelace = %s, want /bin/bash", shell)
+		}
+		want := homeBase + "/grace.hopper"
+		if home := passwd["grace.hopper"][5]; home != want {
+			t.Errorf("home of grace.hopper = %s, want %s", home, want)
+		}
+	}
+	keys, err := ioutil.ReadFile(filepath.Join(
+		sys.Root, "srv", "ada", ".ssh", "authorized_keys",
+	))
+	if err != nil || string(keys) != adaKey+"\n" {
+		t.Errorf("authorized_keys of ada.lovelace = %q, %v", keys, err)
+	}
+}
+
+func TestSyncRefusesHomeOwnedByAnotherUser(t *testing.T) {
+	fake := newFakeDirectory(t, "example.com")
+	adaKey := testPublicKey(t, "ada@laptop")
+	fake.setUsers(
+		fakeDirectoryUser{Email: "ada@example.com", GivenName: "Ada",
+			FamilyName: "Lovelace", SSHKey: adaKey},
+	)
+	sys := newTestSystem(t, gsuiteTestConfig(t, fake))
+	err := SyncUsers()
+	if err != nil {
+		t.Fatalf("first sync: %v", err)
+	}
+
+	// Another user took over the home, which must not be handed back
+	home := filepath.Join(sys.Root, "home", "ada.lovelace")
+	if err := os.Chown(home, 4242, 4242); err != nil {
+		t.Fatal(err)
+	}
+	newKey := testPublicKey(t, "ada@desktop")
+	fake.setUsers(
+		fakeDirectoryUser{Email: "ada@example.com", GivenName: "Ada",
+			FamilyName: "Lovelace", SSHKey: newKey},
+	)
+	err = SyncUsers()
+	if err == nil {
+		t.Error("sync succeeded, want a failure for ada.lovelace")
+	}
+	info, err := os.Stat(home)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner := fileOwner(info); owner != 4242 {
+		t.Errorf("owner of %s = %d, want 4242", home, owner)
+	}
+	keys, err := ioutil.ReadFile(
+		filepath.Join(home, ".ssh", "authorized_keys"),
+	)
+	if err != nil || string(keys) != adaKey+"\n" {
+		t.Errorf("authorized_keys = %q, %v, want the old key", keys, err)
+	}
+	report := sys.report(t)
+	if len(report.Failures) != 1 ||
+		report.Failures[0].Username != "ada.lovelace" ||
+		!strings.Contains(report.Failures[0].Error, "owned by UID 4242") {
+		t.Errorf("failures = %+v, want ada.lovelace refused",
+			report.Failures)
+	}
+}
+
+func TestSyncKeepsAccountsWithRejectedKeys(t *testing.T) {
+	fake := newFakeDirectory(t, "example.com")
+	adaKey := testPublicKey(t, "ada@laptop")
+	graceKey := testPublicKey(t, "grace@laptop")
+	fake.setUsers(
+		fakeDirectoryUser{Email: "ada@example.com", GivenName: "Ada",
+			FamilyName: "Lovelace", SSHKey: adaKey},
+		fakeDirectoryUser{Email: "grace@example.com", GivenName: "Grace",
+			FamilyName: "Hopper", SSHKey: graceKey},
+	)
+	sys := newTestSystem(t, gsuiteTestConfig(t, fake))
+	err := SyncUsers()
+	if err != nil {
+		t.Fatalf("first sync: %v", err)
+	}
+
+	// Tightening the policy so ada's only key fails must not delete her
+	fake.setUsers(
+		fakeDirectoryUser{Email: "ada@example.com", GivenName: "Ada",
+			FamilyName: "Lovelace", SSHKey: "ssh-dss AAAAB3NzaC1kc3M= old"},
+		fakeDirectoryUser{Email: "grace@example.com", GivenName: "Grace",
+			FamilyName: "Hopper", SSHKey: graceKey},
+	)
+	err = SyncUsers()
+	var failure *SyncFailureError
+	if !errors.As(err, &failure) || failure.Total {
+		t.Errorf("sync error = %v, want a partial failure", err)
+	}
+	sys.assertAccount(t, "grace.hopper", "/bin/sh", graceKey)
+	if _, ok := sys.entries(t, "etc/passwd")["ada.lovelace"]; !ok {
+		t.Fatal("account of ada.lovelace was deleted")
+	}
+	keys, err := ioutil.ReadFile(filepath.Join(
+		sys.Root, "home", "ada.lovelace", ".ssh", "authorized_keys",
+	))
+	if err != nil || len(keys) != 0 {
+		t.Errorf("authorized_keys of ada.lovelace = %q, %v, want empty",
+			keys, err)
+	}
+	report := sys.report(t)
+	if len(report.Failures) != 1 ||
+		report.Failures[0].Username != "ada.lovelace" ||
+		report.Failures[0].Op != "keypolicy" {
+		t.Errorf("failures = %+v, want ada.lovelace's keys rejected",
+			report.Failures)
+	}
+}
+
+// failingDeleteBackend is an account backend whose deletions fail
+type failingDeleteBackend struct {
+	AccountBackend
+}
+
+func (failingDeleteBackend) DeleteUser(username string) error {
+	return fmt.Errorf(
+		"userdel: user %s is currently used by process 1", username,
+	)
+}
+
+func TestSyncKeepsAccountsBackInIAMAfterFailedDelete(t *testing.T) {
+	fake := newFakeDirectory(t, "example.com")
+	ada := fakeDirectoryUser{Email: "ada@example.com", GivenName: "Ada",
+		FamilyName: "Lovelace", SSHKey: testPublicKey(t, "ada@laptop")}
+	grace := fakeDirectoryUser{Email: "grace@example.com",
+		GivenName: "Grace", FamilyName: "Hopper",
+		SSHKey: testPublicKey(t, "grace@laptop")}
+	fake.setUsers(ada, grace)
+	sys := newTestSystem(t, gsuiteTestConfig(t, fake))
+	err := SyncUsers()
+	if err != nil {
+		t.Fatalf("first sync: %v", err)
+	}
+
+	// Deleting ada fails, leaving nothing for the next sync to finish
+	marker := sys.writeHomeMarker(t, "ada.lovelace")
+	fake.setUsers(grace)
+	backend := accountBackend
+	accountBackend = failingDeleteBackend{backend}
+	err = SyncUsers()
+	if err == nil {
+		t.Fatal("sync succeeded, want the delete of ada.lovelace to fail")
+	}
+	accountBackend = backend
+	if _, err := os.Stat(journalPath()); !os.IsNotExist(err) {
+		t.Errorf("failed delete left in the journal: %v", err)
+	}
+
+	// ada is back before the next sync, which must not delete her
+	fake.setUsers(ada, grace)
+	err = SyncUsers()
+	if err != nil {
+		t.Fatalf("sync after ada is back: %v", err)
+	}
+	sys.assertAccount(t, "ada.lovelace", "/bin/sh", ada.SSHKey)
+	sys.assertAccount(t, "grace.hopper", "/bin/sh", grace.SSHKey)
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("home of ada.lovelace was recreated: %v", err)
+	}
+}
+
+func TestSyncRecoversDeletesOfUsersStillMissing(t *testing.T) {
+	for _, back := range []bool{false, true} {
+		t.Run(fmt.Sprintf("back %t", back), func(t *testing.T) {
+			fake := newFakeDirectory(t, "example.com")
+			ada := fakeDirectoryUser{Email: "ada@example.com",
+				GivenName: "Ada", FamilyName: "Lovelace",
+				SSHKey: testPublicKey(t, "ada@laptop")}
+			grace := fakeDirectoryUser{Email: "grace@example.com",
+				GivenName: "Grace", FamilyName: "Hopper",
+				SSHKey: testPublicKey(t, "grace@laptop")}
+			fake.setUsers(ada, grace)
+			sys := newTestSystem(t, gsuiteTestConfig(t, fake))
+			err := SyncUsers()
+			if err != nil {
+				t.Fatalf("first sync: %v", err)
+			}
+
+			// A sync was interrupted while deleting ada
+			marker := sys.writeHomeMarker(t, "ada.lovelace")
+			data, err := json.Marshal(syncJournal{Entries: []journalEntry{{
+				Op:       "delete",
+				Username: "ada.lovelace",
+				Home:     "/home/ada.lovelace",
+			}}})
+			if err == nil {
+				err = ioutil.WriteFile(journalPath(), data, 0600)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if back {
+				fake.setUsers(ada, grace)
+			} else {
+				fake.setUsers(grace)
+			}
+
+			err = SyncUsers()
+			if err != nil {
+				t.Fatalf("sync: %v", err)
+			}
+			if back {
+				sys.assertAccount(t, "ada.lovelace", "/bin/sh", ada.SSHKey)
+				if _, err := os.Stat(marker); err != nil {
+					t.Errorf("home of ada.lovelace was recreated: %v", err)
+				}
+			} else {
+				sys.assertNoAccount(t, "ada.lovelace")
+			}
+			sys.assertAccount(t, "grace.hopper", "/bin/sh", grace.SSHKey)
+			if _, err := os.Stat(journalPath()); !os.IsNotExist(err) {
+				t.Errorf("journal was not cleared: %v", err)
+			}
+		})
+	}
+}
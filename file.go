@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// fileRoster struct to map a roster file to
+type fileRoster struct {
+	Users  []fileUser          `yaml:"users" json:"users"`
+	Groups map[string][]string `yaml:"groups" json:"groups"`
+}
+
+// fileUser struct to map a single roster user entry to
+type fileUser struct {
+	Username string   `yaml:"username" json:"username"`
+	Name     string   `yaml:"name" json:"name"`
+	Email    string   `yaml:"email" json:"email"`
+	Shell    string   `yaml:"shell" json:"shell"`
+	Keys     []string `yaml:"keys" json:"keys"`
+	Groups   []string `yaml:"groups" json:"groups"`
+	Disabled bool     `yaml:"disabled" json:"disabled"`
+}
+
+// rosterExtensions lists the file extensions read from a roster directory
+var rosterExtensions = map[string]bool{
+	".yml":  true,
+	".yaml": true,
+	".json": true,
+}
+
+// decodeRosterFile strictly decodes a YAML or JSON file into out, so that
+// misspelled or unknown fields are reported instead of silently ignored.
+func decodeRosterFile(path string, out interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(out)
+	} else {
+		err = yaml.UnmarshalStrict(data, out)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// listRosterFiles returns the sorted list of roster files in a directory
+func listRosterFiles(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		if rosterExtensions[strings.ToLower(filepath.Ext(entry.Name()))] {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// loadRoster reads the roster from either a single file holding every user
+// and group mapping, or a directory holding one file per user. In the
+// directory layout the username defaults to the file name.
+func loadRoster(path string) (fileRoster, error) {
+	var roster fileRoster
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return roster, err
+	}
+	if !info.IsDir() {
+		err = decodeRosterFile(path, &roster)
+		return roster, err
+	}
+
+	files, err := listRosterFiles(path)
+	if err != nil {
+		return roster, err
+	}
+	for _, f := range files {
+		var u fileUser
+		err = decodeRosterFile(f, &u)
+		if err != nil {
+			return roster, err
+		}
+		if u.Username == "" {
+			u.Username = strings.TrimSuffix(filepath.Base(f), filepath.Ext(f))
+		}
+		roster.Users = append(roster.Users, u)
+	}
+	return roster, nil
+}
+
+// validateRoster checks the roster for missing or duplicate usernames,
+// malformed keys and group mappings referencing unknown users. Every problem
+// found is reported in the returned error.
+func validateRoster(roster fileRoster) error {
+	problems := []string{}
+	known := map[string]bool{}
+
+	for i, u := range roster.Users {
+		if strings.TrimSpace(u.Username) == "" {
+			problems = append(
+				problems, fmt.Sprintf("user #%d has no username", i+1),
+			)
+			continue
+		}
+		name := strings.ToLower(u.Username)
+		if known[name] {
+			problems = append(
+				problems, fmt.Sprintf("user %s is defined twice", u.Username),
+			)
+		}
+		known[name] = true
+
+		for j, key := range u.Keys {
+			// A public key line holds at least a key type and key data
+			if len(strings.Fields(key)) < 2 {
+				problems = append(problems, fmt.Sprintf(
+					"user %s key #%d is not a public key", u.Username, j+1,
+				))
+			}
+		}
+	}
+
+	for group, members := range roster.Groups {
+		for _, member := range members {
+			if !known[strings.ToLower(member)] {
+				problems = append(problems, fmt.Sprintf(
+					"group %s references unknown user %s", group, member,
+				))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New(
+			"invalid roster: " + strings.Join(problems, "; "),
+		)
+	}
+	return nil
+}
+
+// PullFileUsers reads and validates the roster at the given path, which is
+// either a YAML/JSON file or a directory of per-user files. Disabled users
+// and users without keys are skipped. Group mappings from the roster are
+// merged into each user's groups. Returns a list of IAMUser objects.
+func PullFileUsers(path string) ([]IAMUser, error) {
+	// fileUsers List of fileUser objects
+	var fileUsers = []IAMUser{}
+
+	roster, err := loadRoster(path)
+	if err != nil {
+		return nil, err
+	}
+	err = validateRoster(roster)
+	if err != nil {
+		return nil, err
+	}
+
+	// Invert the group mappings so they can be looked up per user
+	mappedGroups := map[string][]string{}
+	groupNames := []string{}
+	for group := range roster.Groups {
+		groupNames = append(groupNames, group)
+	}
+	sort.Strings(groupNames)
+	for _, group := range groupNames {
+		for _, member := range roster.Groups[group] {
+			name := strings.ToLower(member)
+			mappedGroups[name] = append(mappedGroups[name], group)
+		}
+	}
+
+	for _, u := range roster.Users {
+		if u.Disabled || len(u.Keys) == 0 {
+			continue
+		}
+
+		name := strings.ToLower(u.Username)
+		keys := []string{}
+		for _, key := range u.Keys {
+			keys = append(keys, strings.TrimSpace(key))
+		}
+		groups := append([]string{}, u.Groups...)
+		groups = append(groups, mappedGroups[name]...)
+		fUser := IAMUser{
+			username:   name,
+			email:      u.Email,
+			publickeys: keys,
+			groups:     groups,
+			fullname:   u.Name,
+			shell:      u.Shell,
+		}
+		fileUsers = append(fileUsers, fUser)
+	}
+	return fileUsers, nil
+}
+
+// rosterModTime returns the most recent modification time of the roster file
+// or of any roster file in the roster directory, including the directory
+// itself so that added or removed files are noticed.
+func rosterModTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	latest := info.ModTime()
+	if !info.IsDir() {
+		return latest, nil
+	}
+
+	files, err := listRosterFiles(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, f := range files {
+		fInfo, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fInfo.ModTime().After(latest) {
+			latest = fInfo.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// WatchFileProvider runs a sync immediately and then polls the roster at
+// the given interval, running another sync whenever it changes. A roster
+// that temporarily can't be read, for example during a git checkout, is
+// logged and checked again on the next interval.
+func WatchFileProvider(path string, interval time.Duration) {
+	lastMod, err := rosterModTime(path)
+	if err != nil {
+		globalLogger.Error("Unable to read roster %s: %v\n", path, err)
+	}
+	// Errors are logged as they occur
+	SyncUsers()
+
+	globalLogger.Info(
+		"Watching roster %s for changes every %s\n", path, interval,
+	)
+	for {
+		time.Sleep(interval)
+
+		modTime, err := rosterModTime(path)
+		if err != nil {
+			globalLogger.Error("Unable to read roster %s: %v\n", path, err)
+			continue
+		}
+		if modTime.Equal(lastMod) {
+			continue
+		}
+		lastMod = modTime
+
+		globalLogger.Info("Roster %s changed, syncing users\n", path)
+		SyncUsers()
+	}
+}
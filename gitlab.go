@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gitlabMember struct to map a GitLab group member to
+type gitlabMember struct {
+	ID          int    `json:"id"`
+	Username    string `json:"username"`
+	Name        string `json:"name"`
+	State       string `json:"state"`
+	AccessLevel int    `json:"access_level"`
+}
+
+// gitlabKey struct to map a GitLab user SSH key to
+type gitlabKey struct {
+	ID    int    `json:"id"`
+	Title string `json:"title"`
+	Key   string `json:"key"`
+}
+
+// gitlabPageSize is the number of records requested per API page
+const gitlabPageSize = 100
+
+// gitlabGet performs an authenticated GET request against the GitLab API and
+// decodes the JSON response into out, retrying quota and transient errors.
+// It returns the next page number as reported by the X-Next-Page header, or
+// an empty string on the last page.
+func gitlabGet(
+	ctx context.Context,
+	client *http.Client,
+	requestURL string,
+	token string,
+	out interface{},
+) (string, error) {
+	var nextPage string
+	err := withRetry(
+		ctx,
+		"GitLab API request "+requestURL,
+		func(ctx context.Context) error {
+			req, err := http.NewRequestWithContext(
+				ctx, http.MethodGet, requestURL, nil,
+			)
+			if err != nil {
+				return err
+			}
+			// PRIVATE-TOKEN is accepted for both personal and group access
+			// tokens
+			req.Header.Set("PRIVATE-TOKEN", token)
+			req.Header.Set("Accept", "application/json")
+
+			resp, err := client.Do(req)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			err = checkHTTPResponse(resp, "GitLab API request "+requestURL)
+			if err != nil {
+				return err
+			}
+
+			err = json.NewDecoder(resp.Body).Decode(out)
+			if err != nil {
+				return err
+			}
+			nextPage = resp.Header.Get("X-Next-Page")
+			return nil
+		},
+	)
+	return nextPage, err
+}
+
+// PullGitlabUsers queries the GitLab API for the members of each configured
+// group, including inherited members, that hold at least the given access
+// level. Blocked or deactivated users are skipped. The SSH keys for each
+// remaining member are then fetched and returned as a list of IAMUser objects.
+func PullGitlabUsers(
+	ctx context.Context,
+	baseURL string,
+	token string,
+	groups []string,
+	minAccessLevel int,
+) ([]IAMUser, error) {
+	// gitlabUsers List of gitlabUser objects
+	var gitlabUsers = []IAMUser{}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	apiURL := strings.TrimRight(baseURL, "/") + "/api/v4"
+
+	// Collect the members of every group, keyed by GitLab user ID so a user
+	// belonging to several groups is only processed once
+	members := map[int]gitlabMember{}
+	memberGroups := map[int][]string{}
+	memberOrder := []int{}
+	for _, group := range groups {
+		page := "1"
+		for page != "" {
+			var groupMembers []gitlabMember
+			membersURL := fmt.Sprintf(
+				"%s/groups/%s/members/all?per_page=%d&page=%s",
+				apiURL, url.PathEscape(group), gitlabPageSize, page,
+			)
+			nextPage, err := gitlabGet(
+				ctx, client, membersURL, token, &groupMembers,
+			)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, m := range groupMembers {
+				// Only active users are synced, this excludes blocked,
+				// deactivated and pending approval accounts
+				if m.State != "active" || m.AccessLevel < minAccessLevel {
+					continue
+				}
+				if _, ok := members[m.ID]; !ok {
+					members[m.ID] = m
+					memberOrder = append(memberOrder, m.ID)
+				}
+				memberGroups[m.ID] = append(memberGroups[m.ID], group)
+			}
+			page = nextPage
+		}
+	}
+
+	// Fetch the SSH keys for each member
+	for _, id := range memberOrder {
+		m := members[id]
+		keys := []string{}
+		page := "1"
+		for page != "" {
+			var userKeys []gitlabKey
+			keysURL := fmt.Sprintf(
+				"%s/users/%s/keys?per_page=%d&page=%s",
+				apiURL, strconv.Itoa(m.ID), gitlabPageSize, page,
+			)
+			nextPage, err := gitlabGet(
+				ctx, client, keysURL, token, &userKeys,
+			)
+			if err != nil {
+				return nil, err
+			}
+			for _, k := range userKeys {
+				keys = append(keys, strings.TrimSpace(k.Key))
+			}
+			page = nextPage
+		}
+
+		// Users without any SSH keys are not given a local account
+		if len(keys) == 0 {
+			continue
+		}
+
+		gUser := IAMUser{
+			username:   strings.ToLower(m.Username),
+			publickeys: keys,
+			groups:     memberGroups[id],
+			fullname:   m.Name,
+		}
+		gitlabUsers = append(gitlabUsers, gUser)
+	}
+	return gitlabUsers, nil
+}
@@ -2,10 +2,9 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
+	"net/http"
 
 	"golang.org/x/net/context"
-	"golang.org/x/oauth2/google"
 
 	"encoding/json"
 	admin "google.golang.org/api/admin/directory/v1"
@@ -18,32 +17,76 @@ type RsaKey struct {
 	Key string `json:"Public_SSH_Key"`
 }
 
+// posixAccount struct to map the posixAccounts of a directory user to
+type posixAccount struct {
+	Shell   string `json:"shell"`
+	Primary bool   `json:"primary"`
+}
+
+// gsuiteShell returns the login shell of the user's primary POSIX account,
+// or an empty string if none is set
+func gsuiteShell(u *admin.User) string {
+	if u.PosixAccounts == nil {
+		return ""
+	}
+	data, err := json.Marshal(u.PosixAccounts)
+	if err != nil {
+		return ""
+	}
+	var accounts []posixAccount
+	if json.Unmarshal(data, &accounts) != nil {
+		return ""
+	}
+	shell := ""
+	for _, account := range accounts {
+		if shell == "" || account.Primary {
+			shell = account.Shell
+		}
+	}
+	return shell
+}
+
+// gsuiteHTTPClient is the HTTP client the GSUITE providers call the
+// Directory API with instead of one authorized with the service account.
+// It is nil unless replaced, e.g. to talk to a fake Directory API.
+var gsuiteHTTPClient *http.Client
+
+// gsuitePageSize is the number of users requested per page, the most the
+// Directory API returns at once
+const gsuitePageSize = 500
+
 // CreateDirectoryService builds and returns an Admin SDK Directory service
 // object authorized with the service accounts that act on behalf of the
-// given user.
+// given user, authenticating as set by auth (see gsuiteTokenSource). The
+// service calls endpoint instead of the Google API when set. When client is
+// set, requests are sent with it as is and no credentials are looked up.
+// Tokens are fetched within ctx.
 func CreateDirectoryService(
+	ctx context.Context,
 	userEmail string,
+	auth string,
 	credentialsPath string,
+	serviceAccount string,
+	endpoint string,
+	client *http.Client,
 ) (*admin.Service, error) {
-	ctx := context.Background()
-
-	jsonCredentials, err := ioutil.ReadFile(credentialsPath)
-	if err != nil {
-		return nil, err
+	opts := []option.ClientOption{}
+	if endpoint != "" {
+		opts = append(opts, option.WithEndpoint(endpoint))
 	}
-
-	config, err := google.JWTConfigFromJSON(
-		jsonCredentials,
-		admin.AdminDirectoryUserScope,
-	)
-	if err != nil {
-		return nil, fmt.Errorf("JWTConfigFromJSON: %v", err)
+	if client != nil {
+		opts = append(opts, option.WithHTTPClient(client))
+	} else {
+		ts, err := gsuiteTokenSource(
+			ctx, auth, credentialsPath, serviceAccount, userEmail,
+		)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, option.WithTokenSource(ts))
 	}
-	config.Subject = userEmail
-
-	ts := config.TokenSource(ctx)
 
-	srv, err := admin.NewService(ctx, option.WithTokenSource(ts))
+	srv, err := admin.NewService(ctx, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("NewService: %v", err)
 	}
@@ -51,47 +94,94 @@ func CreateDirectoryService(
 }
 
 // PullGsuiteUsers Creates a Google Workspace API Directory Service and
-// authenticates. It then queries the API for a list of domain users with
-// the appropriate custom attribute set. Returns a list of gsuiteUser objects.
+// authenticates. It then queries the API for every page of domain users
+// with the appropriate custom attribute set, skipping suspended users. A
+// page failing with a quota or transient error is retried. Returns a list
+// of gsuiteUser objects.
 func PullGsuiteUsers(
+	ctx context.Context,
 	email string,
 	domain string,
 	mask string,
+	auth string,
 	credentialsPath string,
+	serviceAccount string,
+	endpoint string,
+	client *http.Client,
 ) ([]IAMUser, error) {
 	// gsuiteUsers List of gsuiteUser objects
 	var gsuiteUsers = []IAMUser{}
 
-	srv, e := CreateDirectoryService(email, credentialsPath)
+	srv, e := CreateDirectoryService(
+		ctx, email, auth, credentialsPath, serviceAccount, endpoint, client,
+	)
 	if e != nil {
 		return nil, e
 	}
-	r, err := srv.Users.List().Domain(domain).Projection(
+	call := srv.Users.List().Domain(domain).Projection(
 		"Custom",
-	).CustomFieldMask(mask).Do()
-	if err != nil {
-		return nil, err
-	}
+	).CustomFieldMask(mask).MaxResults(gsuitePageSize)
+
+	for page := 1; ; page++ {
+		var r *admin.Users
+		err := withRetry(
+			ctx,
+			fmt.Sprintf("GSuite users list page %d", page),
+			func(ctx context.Context) error {
+				var err error
+				r, err = call.Context(ctx).Do()
+				return err
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
 
-	if len(r.Users) != 0 {
 		for _, u := range r.Users {
-			if val, ok := u.CustomSchemas["SSHKEY"]; ok {
-				// Custom Schema SSHKEY exists
-
-				var rsakey RsaKey
-				err := json.Unmarshal(val, &rsakey)
-				if err != nil {
-					return nil, err
-				}
-
-				uName := u.Name.GivenName + "." + u.Name.FamilyName
-				gUser := IAMUser{
-					username:  strings.ToLower(uName),
-					publickey: rsakey.Key,
-				}
+			if gUser, ok := gsuiteUser(u, mask); ok {
 				gsuiteUsers = append(gsuiteUsers, gUser)
 			}
 		}
+		if r.NextPageToken == "" {
+			return gsuiteUsers, nil
+		}
+		call.PageToken(r.NextPageToken)
 	}
-	return gsuiteUsers, nil
+}
+
+// gsuiteUser maps a directory user to an IAMUser, returning false for a
+// user that is suspended or has no SSH key attribute in the custom schema
+// named by schema
+func gsuiteUser(u *admin.User, schema string) (IAMUser, bool) {
+	val, ok := u.CustomSchemas[schema]
+	if !ok {
+		return IAMUser{}, false
+	}
+	// Custom Schema exists
+
+	// A suspended user can't sign in, so no account is kept for them
+	if u.Suspended {
+		globalLogger.Info("Skipping suspended user %s\n", u.PrimaryEmail)
+		return IAMUser{}, false
+	}
+
+	// A malformed attribute only skips this user
+	var rsakey RsaKey
+	err := json.Unmarshal(val, &rsakey)
+	if err != nil {
+		globalLogger.Error(
+			"Skipping user %s, the SSH key attribute is malformed: %v\n",
+			u.PrimaryEmail, err,
+		)
+		return IAMUser{}, false
+	}
+
+	uName := u.Name.GivenName + "." + u.Name.FamilyName
+	return IAMUser{
+		username:   strings.ToLower(uName),
+		email:      u.PrimaryEmail,
+		publickeys: []string{rsakey.Key},
+		fullname:   u.Name.FullName,
+		shell:      gsuiteShell(u),
+	}, true
 }
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	admin "google.golang.org/api/admin/directory/v1"
+)
+
+// gsuiteAuthModes lists how the GSUITE provider can authenticate
+var gsuiteAuthModes = []string{"key", "adc", "signjwt"}
+
+// cloudPlatformScope is the scope the host's own identity needs to have
+// the IAM Credentials API sign for a service account
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// iamCredentialsEndpoint is the base URL of the IAM Credentials API
+var iamCredentialsEndpoint = "https://iamcredentials.googleapis.com/"
+
+// gsuiteTokenURL is the OAuth 2.0 token endpoint delegation JWTs are
+// exchanged at, which is also their audience
+var gsuiteTokenURL = google.JWTTokenURL
+
+// gsuiteTokenSource returns the source of the tokens the Directory API is
+// called with for the given auth mode:
+//   - key signs the delegation JWT locally with the private key of the
+//     service account key file at credentialsPath
+//   - adc uses the credentials file at credentialsPath, or Application
+//     Default Credentials when unset. A service account key acts on behalf
+//     of subject, other identities call the API as themselves.
+//   - signjwt has the IAM Credentials API sign the delegation JWT for
+//     serviceAccount as the identity found like adc, so no private key is
+//     needed on the host
+func gsuiteTokenSource(
+	ctx context.Context,
+	auth string,
+	credentialsPath string,
+	serviceAccount string,
+	subject string,
+) (oauth2.TokenSource, error) {
+	switch auth {
+	case "adc":
+		creds, err := googleCredentials(
+			ctx, credentialsPath, google.CredentialsParams{
+				Scopes:  []string{admin.AdminDirectoryUserScope},
+				Subject: subject,
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+		return creds.TokenSource, nil
+	case "signjwt":
+		creds, err := googleCredentials(
+			ctx, credentialsPath, google.CredentialsParams{
+				Scopes: []string{cloudPlatformScope},
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+		return oauth2.ReuseTokenSource(nil, newSignJWTTokenSource(
+			ctx, creds.TokenSource, serviceAccount, subject,
+			[]string{admin.AdminDirectoryUserScope},
+		)), nil
+	}
+
+	jsonCredentials, err := ioutil.ReadFile(credentialsPath)
+	if err != nil {
+		return nil, err
+	}
+	config, err := google.JWTConfigFromJSON(
+		jsonCredentials,
+		admin.AdminDirectoryUserScope,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("JWTConfigFromJSON: %v", err)
+	}
+	config.Subject = subject
+	return config.TokenSource(ctx), nil
+}
+
+// googleCredentials loads the credentials file at path, or finds the
+// Application Default Credentials when path is empty: the file named by
+// GOOGLE_APPLICATION_CREDENTIALS, the gcloud credentials, or the service
+// account of the GCE metadata server. A file may hold a service account key
+// or a workload identity federation or other external account
+// configuration.
+func googleCredentials(
+	ctx context.Context,
+	path string,
+	params google.CredentialsParams,
+) (*google.Credentials, error) {
+	if path == "" {
+		creds, err := google.FindDefaultCredentialsWithParams(ctx, params)
+		if err != nil {
+			return nil, fmt.Errorf("Application Default Credentials: %v", err)
+		}
+		return creds, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := google.CredentialsFromJSONWithParams(ctx, data, params)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return creds, nil
+}
+
+// signJWTTokenSource fetches tokens for a service account acting on behalf
+// of a Google Workspace admin without holding a key of the service
+// account. The delegation JWT is signed by the IAM Credentials API as the
+// host's own identity, which needs the Service Account Token Creator role
+// on the service account, and then exchanged for an access token.
+type signJWTTokenSource struct {
+	ctx            context.Context
+	client         *http.Client
+	serviceAccount string
+	subject        string
+	scopes         []string
+}
+
+// newSignJWTTokenSource returns a token source signing with the IAM
+// Credentials API, called with the tokens of identity
+func newSignJWTTokenSource(
+	ctx context.Context,
+	identity oauth2.TokenSource,
+	serviceAccount string,
+	subject string,
+	scopes []string,
+) oauth2.TokenSource {
+	return signJWTTokenSource{
+		ctx:            ctx,
+		client:         oauth2.NewClient(ctx, identity),
+		serviceAccount: serviceAccount,
+		subject:        subject,
+		scopes:         scopes,
+	}
+}
+
+// signJWTResponse struct to map the response of signJwt to
+type signJWTResponse struct {
+	KeyID     string `json:"keyId"`
+	SignedJWT string `json:"signedJwt"`
+}
+
+// jwtBearerResponse struct to map an OAuth 2.0 token response to
+type jwtBearerResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// Token signs a delegation JWT valid for an hour and exchanges it
+func (s signJWTTokenSource) Token() (*oauth2.Token, error) {
+	now := time.Now()
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   s.serviceAccount,
+		"sub":   s.subject,
+		"scope": strings.Join(s.scopes, " "),
+		"aud":   gsuiteTokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(map[string]string{
+		"payload": string(claims),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	signURL := fmt.Sprintf(
+		"%sv1/projects/-/serviceAccounts/%s:signJwt",
+		iamCredentialsEndpoint, url.PathEscape(s.serviceAccount),
+	)
+	var signed signJWTResponse
+	err = s.post(
+		s.client, signURL, "application/json", string(payload),
+		"IAM Credentials signJwt for "+s.serviceAccount, &signed,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", signed.SignedJWT)
+	var token jwtBearerResponse
+	err = s.post(
+		http.DefaultClient, gsuiteTokenURL,
+		"application/x-www-form-urlencoded", form.Encode(),
+		"Token request for "+s.serviceAccount+" acting as "+s.subject,
+		&token,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf(
+			"Token request for %s returned no access token", s.serviceAccount,
+		)
+	}
+	return &oauth2.Token{
+		AccessToken: token.AccessToken,
+		TokenType:   token.TokenType,
+		Expiry:      now.Add(time.Duration(token.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// post sends body to requestURL and decodes the JSON response into out. A
+// failed request returns an HTTPStatusError with the reason Google gave.
+func (s signJWTTokenSource) post(
+	client *http.Client,
+	requestURL string,
+	contentType string,
+	body string,
+	request string,
+	out interface{},
+) error {
+	req, err := http.NewRequestWithContext(
+		s.ctx, http.MethodPost, requestURL, strings.NewReader(body),
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	err = checkHTTPResponse(resp, request)
+	if err != nil {
+		if detail := googleErrorDetail(data); detail != "" {
+			return fmt.Errorf("%w: %s", err, detail)
+		}
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// googleErrorDetail returns the reason given in the body of a failed
+// Google API or OAuth 2.0 token response, or an empty string
+func googleErrorDetail(body []byte) string {
+	var apiErr struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &apiErr) == nil && apiErr.Error.Message != "" {
+		return apiErr.Error.Message
+	}
+	var oauthErr struct {
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if json.Unmarshal(body, &oauthErr) == nil && oauthErr.Error != "" {
+		if oauthErr.Description != "" {
+			return oauthErr.Error + ": " + oauthErr.Description
+		}
+		return oauthErr.Error
+	}
+	return ""
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/oauth2"
+	admin "google.golang.org/api/admin/directory/v1"
+)
+
+const testServiceAccount = "user-sync@project.iam.gserviceaccount.com"
+
+// fakeIAMCredentials is an in-process fake of the signJwt method of the IAM
+// Credentials API and of the OAuth 2.0 token endpoint. It signs for
+// testServiceAccount when called with HostToken, and grants AccessToken for
+// the JWTs it signed. A denied fake lacks the Service Account Token
+// Creator role, and a refusing fake doesn't grant tokens, like for a
+// service account whose client ID isn't authorized for delegation.
+type fakeIAMCredentials struct {
+	HostToken   string
+	AccessToken string
+
+	mu       sync.Mutex
+	claims   []map[string]interface{}
+	denied   bool
+	refusing bool
+}
+
+// newFakeIAMCredentials starts a fake IAM Credentials API and token
+// endpoint, which the signjwt auth uses until the test ends
+func newFakeIAMCredentials(t *testing.T) *fakeIAMCredentials {
+	t.Helper()
+	fake := &fakeIAMCredentials{
+		HostToken:   "host-token",
+		AccessToken: "directory-token",
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(
+		"/v1/projects/-/serviceAccounts/"+testServiceAccount+":signJwt",
+		fake.signJWT,
+	)
+	mux.HandleFunc("/token", fake.token)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	previousEndpoint := iamCredentialsEndpoint
+	previousTokenURL := gsuiteTokenURL
+	iamCredentialsEndpoint = server.URL + "/"
+	gsuiteTokenURL = server.URL + "/token"
+	t.Cleanup(func() {
+		iamCredentialsEndpoint = previousEndpoint
+		gsuiteTokenURL = previousTokenURL
+	})
+	return fake
+}
+
+func (f *fakeIAMCredentials) signJWT(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Method != http.MethodPost ||
+		r.Header.Get("Authorization") != "Bearer "+f.HostToken {
+		writeDirectoryError(w, fakeDirectoryError{
+			Status: http.StatusUnauthorized,
+			Reason: "authError",
+		})
+		return
+	}
+	if f.denied {
+		writeDirectoryError(w, fakeDirectoryError{
+			Status: http.StatusForbidden,
+			Reason: "forbidden",
+		})
+		return
+	}
+	var request struct {
+		Payload string `json:"payload"`
+	}
+	var claims map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err == nil {
+		err = json.Unmarshal([]byte(request.Payload), &claims)
+	}
+	if err != nil {
+		writeDirectoryError(w, fakeDirectoryError{
+			Status: http.StatusBadRequest,
+			Reason: "invalid",
+		})
+		return
+	}
+	f.claims = append(f.claims, claims)
+	json.NewEncoder(w).Encode(map[string]string{
+		"keyId":     "key-1",
+		"signedJwt": "signed." + testServiceAccount,
+	})
+}
+
+func (f *fakeIAMCredentials) token(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.refusing || r.FormValue("grant_type") !=
+		"urn:ietf:params:oauth:grant-type:jwt-bearer" ||
+		r.FormValue("assertion") != "signed."+testServiceAccount {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "unauthorized_client",
+			"error_description": "Client is unauthorized to retrieve " +
+				"access tokens using this method.",
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": f.AccessToken,
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+	})
+}
+
+// signedClaims returns the claims of the JWTs signed so far
+func (f *fakeIAMCredentials) signedClaims() []map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.claims
+}
+
+func TestSignJWTTokenSource(t *testing.T) {
+	useTestLogger(t)
+	iam := newFakeIAMCredentials(t)
+	fake := newFakeDirectory(t, "example.com")
+	fake.Token = iam.AccessToken
+	fake.setUsers(fakeDirectoryUser{
+		Email: "ada@example.com", GivenName: "Ada", FamilyName: "Lovelace",
+		SSHKey: testPublicKey(t, "ada"),
+	})
+
+	ctx := context.Background()
+	ts := oauth2.ReuseTokenSource(nil, newSignJWTTokenSource(
+		ctx,
+		oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "host-token"}),
+		testServiceAccount, "admin@example.com",
+		[]string{admin.AdminDirectoryUserScope},
+	))
+	users, err := PullGsuiteUsers(
+		ctx, "admin@example.com", "example.com", "SSHKEY", "signjwt", "",
+		testServiceAccount, fake.URL, oauth2.NewClient(ctx, ts),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := usernamesOf(users); !reflect.DeepEqual(got,
+		[]string{"ada.lovelace"}) {
+		t.Errorf("usernames = %v, want ada.lovelace", got)
+	}
+
+	claims := iam.signedClaims()
+	if len(claims) != 1 {
+		t.Fatalf("%d JWTs signed, want 1", len(claims))
+	}
+	want := map[string]interface{}{
+		"iss":   testServiceAccount,
+		"sub":   "admin@example.com",
+		"scope": admin.AdminDirectoryUserScope,
+		"aud":   gsuiteTokenURL,
+	}
+	for claim, value := range want {
+		if claims[0][claim] != value {
+			t.Errorf("claim %s = %v, want %v", claim, claims[0][claim], value)
+		}
+	}
+	iat, _ := claims[0]["iat"].(float64)
+	exp, _ := claims[0]["exp"].(float64)
+	if exp-iat != 3600 {
+		t.Errorf("JWT valid for %vs, want an hour", exp-iat)
+	}
+}
+
+func TestSignJWTTokenSourceErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		hostToken string
+		account   string
+		denied    bool
+		wantErr   string
+	}{
+		{"host token refused", "expired", testServiceAccount, false,
+			"Unauthorized"},
+		{"token creator role missing", "host-token", testServiceAccount,
+			true, "Forbidden"},
+		{"unknown service account", "host-token", "other@example.com",
+			false, "Not Found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iam := newFakeIAMCredentials(t)
+			iam.denied = tt.denied
+			ctx := context.Background()
+			_, err := newSignJWTTokenSource(
+				ctx,
+				oauth2.StaticTokenSource(&oauth2.Token{
+					AccessToken: tt.hostToken,
+				}),
+				tt.account, "admin@example.com",
+				[]string{admin.AdminDirectoryUserScope},
+			).Token()
+
+			var statusErr *HTTPStatusError
+			if !errors.As(err, &statusErr) {
+				t.Fatalf("error = %v, want an HTTPStatusError", err)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSignJWTTokenSourceGrantRefused(t *testing.T) {
+	iam := newFakeIAMCredentials(t)
+	iam.refusing = true
+
+	_, err := newSignJWTTokenSource(
+		context.Background(),
+		oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "host-token"}),
+		testServiceAccount, "admin@example.com",
+		[]string{admin.AdminDirectoryUserScope},
+	).Token()
+	if err == nil || !strings.Contains(err.Error(),
+		"unauthorized_client: Client is unauthorized") {
+		t.Errorf("error = %v, want the reason of the refused grant", err)
+	}
+	if category, _ := classifyError(err); category != errorAuth {
+		t.Errorf("category = %s, want %s", category, errorAuth)
+	}
+}
+
+func TestCheckForUnsetGsuiteConfigAuth(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    ProviderOptions
+		want    string
+		wantErr bool
+	}{
+		{"key by default", ProviderOptions{Credentials: "key.json"},
+			"key", false},
+		{"key without credentials", ProviderOptions{GsuiteAuth: "key"},
+			"", true},
+		{"application default credentials", ProviderOptions{
+			GsuiteAuth: "adc"}, "adc", false},
+		{"workload identity federation", ProviderOptions{
+			GsuiteAuth: "adc", Credentials: "wif.json"}, "adc", false},
+		{"signjwt", ProviderOptions{GsuiteAuth: "signjwt",
+			GsuiteServiceAccount: testServiceAccount}, "signjwt", false},
+		{"signjwt without service account", ProviderOptions{
+			GsuiteAuth: "signjwt"}, "", true},
+		{"unknown", ProviderOptions{GsuiteAuth: "password",
+			Credentials: "key.json"}, "", true},
+	}
+	for _, tt := range tests {
+		opts := tt.opts
+		opts.Email = "admin@example.com"
+		err := checkForUnsetGsuiteConfig(&opts)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %t", tt.name, err,
+				tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && opts.GsuiteAuth != tt.want {
+			t.Errorf("%s: auth = %q, want %q", tt.name, opts.GsuiteAuth,
+				tt.want)
+		}
+	}
+}
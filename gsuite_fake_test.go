@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeDirectoryUser is a user served by the fake Directory API
+type fakeDirectoryUser struct {
+	Email      string
+	GivenName  string
+	FamilyName string
+	Suspended  bool
+	Shell      string
+
+	// SSHKey is the Public_SSH_Key of the SSHKEY custom schema, which is
+	// left out when empty. RawSSHKey replaces the whole schema when set.
+	SSHKey    string
+	RawSSHKey string
+}
+
+// fakeDirectoryError is a failure served instead of a page. It answers the
+// next request, or the given request number counting from 1.
+type fakeDirectoryError struct {
+	Status     int
+	Reason     string
+	RetryAfter string
+	Request    int
+}
+
+// fakeDirectory is an in-process fake of the users list of the Admin SDK
+// Directory API. It serves its users in pages of at most PageSize, and
+// answers with the queued errors in order instead of serving pages. When
+// Token is set, requests without it as bearer token are unauthorized. The
+// SSH keys of the users are held in the custom schema named Schema.
+type fakeDirectory struct {
+	URL      string
+	Domain   string
+	PageSize int
+	Token    string
+	Schema   string
+
+	mu       sync.Mutex
+	users    []fakeDirectoryUser
+	errors   []fakeDirectoryError
+	requests []*http.Request
+}
+
+// newFakeDirectory starts a fake Directory API serving users of domain,
+// stopped when the test ends
+func newFakeDirectory(t *testing.T, domain string) *fakeDirectory {
+	t.Helper()
+	fake := &fakeDirectory{Domain: domain, PageSize: 100, Schema: "SSHKEY"}
+	server := httptest.NewServer(http.HandlerFunc(fake.serveHTTP))
+	t.Cleanup(server.Close)
+	fake.URL = server.URL + "/"
+	return fake
+}
+
+// setUsers replaces the users served
+func (f *fakeDirectory) setUsers(users ...fakeDirectoryUser) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.users = users
+}
+
+// fail queues an error answered to the next request
+func (f *fakeDirectory) fail(status int, reason string) {
+	f.failRequest(0, status, reason)
+}
+
+// failRequest queues an error answered to the request with the given
+// number, counting from 1, so a list can fail after its first pages
+func (f *fakeDirectory) failRequest(request int, status int, reason string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errors = append(f.errors, fakeDirectoryError{
+		Status:  status,
+		Reason:  reason,
+		Request: request,
+	})
+}
+
+// rateLimit queues n quota errors, as answered once the queries per minute
+// of a project are used up
+func (f *fakeDirectory) rateLimit(n int, retryAfter string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := 0; i < n; i++ {
+		f.errors = append(f.errors, fakeDirectoryError{
+			Status:     http.StatusTooManyRequests,
+			Reason:     "rateLimitExceeded",
+			RetryAfter: retryAfter,
+		})
+	}
+}
+
+// requestCount returns the number of requests served
+func (f *fakeDirectory) requestCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.requests)
+}
+
+// request returns the i-th request served
+func (f *fakeDirectory) request(i int) *http.Request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[i]
+}
+
+func (f *fakeDirectory) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r)
+
+	if r.Method != http.MethodGet || r.URL.Path != "/admin/directory/v1/users" {
+		writeDirectoryError(w, fakeDirectoryError{
+			Status: http.StatusNotFound,
+			Reason: "notFound",
+		})
+		return
+	}
+	if f.Token != "" && r.Header.Get("Authorization") != "Bearer "+f.Token {
+		writeDirectoryError(w, fakeDirectoryError{
+			Status: http.StatusUnauthorized,
+			Reason: "authError",
+		})
+		return
+	}
+	if len(f.errors) > 0 &&
+		(f.errors[0].Request == 0 || f.errors[0].Request == len(f.requests)) {
+		failure := f.errors[0]
+		f.errors = f.errors[1:]
+		writeDirectoryError(w, failure)
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("domain") != f.Domain {
+		writeDirectoryError(w, fakeDirectoryError{
+			Status: http.StatusForbidden,
+			Reason: "forbidden",
+		})
+		return
+	}
+
+	pageSize := f.PageSize
+	if max, err := strconv.Atoi(query.Get("maxResults")); err == nil &&
+		max > 0 && max < pageSize {
+		pageSize = max
+	}
+	start := 0
+	if token := query.Get("pageToken"); token != "" {
+		offset, err := strconv.Atoi(strings.TrimPrefix(token, "page-"))
+		if err != nil || offset < 0 || offset > len(f.users) {
+			writeDirectoryError(w, fakeDirectoryError{
+				Status: http.StatusBadRequest,
+				Reason: "invalid",
+			})
+			return
+		}
+		start = offset
+	}
+	end := start + pageSize
+	if end > len(f.users) {
+		end = len(f.users)
+	}
+
+	// Custom schemas are only included in the custom projection, and only
+	// those listed in the field mask
+	schema := ""
+	if strings.EqualFold(query.Get("projection"), "custom") {
+		mask := strings.Split(query.Get("customFieldMask"), ",")
+		for _, masked := range mask {
+			if masked == f.Schema {
+				schema = f.Schema
+			}
+		}
+	}
+	page := map[string]interface{}{"kind": "admin#directory#users"}
+	users := []map[string]interface{}{}
+	for _, u := range f.users[start:end] {
+		users = append(users, u.resource(schema))
+	}
+	page["users"] = users
+	if end < len(f.users) {
+		page["nextPageToken"] = fmt.Sprintf("page-%d", end)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// resource returns the user as the Directory API renders it, with the SSH
+// key in the custom schema named schema unless it is empty
+func (u fakeDirectoryUser) resource(schema string) map[string]interface{} {
+	resource := map[string]interface{}{
+		"kind":         "admin#directory#user",
+		"primaryEmail": u.Email,
+		"name": map[string]string{
+			"givenName":  u.GivenName,
+			"familyName": u.FamilyName,
+			"fullName":   u.GivenName + " " + u.FamilyName,
+		},
+		"suspended": u.Suspended,
+	}
+	if u.Shell != "" {
+		resource["posixAccounts"] = []map[string]interface{}{{
+			"username": strings.Split(u.Email, "@")[0],
+			"shell":    u.Shell,
+			"primary":  true,
+		}}
+	}
+	switch {
+	case schema == "":
+	case u.RawSSHKey != "":
+		resource["customSchemas"] = map[string]json.RawMessage{
+			schema: json.RawMessage(u.RawSSHKey),
+		}
+	case u.SSHKey != "":
+		resource["customSchemas"] = map[string]interface{}{
+			schema: map[string]string{"Public_SSH_Key": u.SSHKey},
+		}
+	}
+	return resource
+}
+
+// writeDirectoryError answers with an error in the format of Google APIs
+func writeDirectoryError(w http.ResponseWriter, failure fakeDirectoryError) {
+	message := http.StatusText(failure.Status)
+	if failure.RetryAfter != "" {
+		w.Header().Set("Retry-After", failure.RetryAfter)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(failure.Status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    failure.Status,
+			"message": message,
+			"errors": []map[string]string{{
+				"domain":  "global",
+				"reason":  failure.Reason,
+				"message": message,
+			}},
+		},
+	})
+}
+
+// testPublicKey returns a new ed25519 public key in authorized_keys format
+func testPublicKey(t *testing.T, comment string) string {
+	t.Helper()
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	return line + " " + comment
+}
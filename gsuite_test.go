@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// pullFakeDirectory pulls the users of a fake Directory API
+func pullFakeDirectory(fake *fakeDirectory) ([]IAMUser, error) {
+	return PullGsuiteUsers(
+		context.Background(), "admin@"+fake.Domain, fake.Domain, "SSHKEY",
+		"key", "", "", fake.URL, http.DefaultClient,
+	)
+}
+
+func usernamesOf(users []IAMUser) []string {
+	names := []string{}
+	for _, u := range users {
+		names = append(names, u.username)
+	}
+	return names
+}
+
+func TestPullGsuiteUsersPaginates(t *testing.T) {
+	useTestLogger(t)
+	fake := newFakeDirectory(t, "example.com")
+	fake.PageSize = 2
+	key := testPublicKey(t, "ada")
+	fake.setUsers(
+		fakeDirectoryUser{Email: "ada@example.com", GivenName: "Ada",
+			FamilyName: "Lovelace", SSHKey: key, Shell: "/bin/zsh"},
+		fakeDirectoryUser{Email: "alan@example.com", GivenName: "Alan",
+			FamilyName: "Turing", SSHKey: key},
+		fakeDirectoryUser{Email: "grace@example.com", GivenName: "Grace",
+			FamilyName: "Hopper", SSHKey: key},
+		fakeDirectoryUser{Email: "edsger@example.com", GivenName: "Edsger",
+			FamilyName: "Dijkstra", SSHKey: key},
+		fakeDirectoryUser{Email: "barbara@example.com", GivenName: "Barbara",
+			FamilyName: "Liskov", SSHKey: key},
+	)
+
+	users, err := pullFakeDirectory(fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"ada.lovelace", "alan.turing", "grace.hopper", "edsger.dijkstra",
+		"barbara.liskov",
+	}
+	if got := usernamesOf(users); !reflect.DeepEqual(got, want) {
+		t.Errorf("usernames = %v, want %v", got, want)
+	}
+	if fake.requestCount() != 3 {
+		t.Errorf("%d requests, want 3 pages", fake.requestCount())
+	}
+
+	first := users[0]
+	if first.email != "ada@example.com" || first.fullname != "Ada Lovelace" ||
+		first.shell != "/bin/zsh" ||
+		!reflect.DeepEqual(first.publickeys, []string{key}) {
+		t.Errorf("first user = %+v", first)
+	}
+
+	query := fake.request(0).URL.Query()
+	if query.Get("customFieldMask") != "SSHKEY" ||
+		query.Get("projection") != "Custom" {
+		t.Errorf("query = %v, want the SSHKEY custom projection", query)
+	}
+	token := fake.request(2).URL.Query().Get("pageToken")
+	if token != "page-4" {
+		t.Errorf("last page token = %q, want page-4", token)
+	}
+}
+
+func TestPullGsuiteUsersSkipsUnusableUsers(t *testing.T) {
+	useTestLogger(t)
+	fake := newFakeDirectory(t, "example.com")
+	key := testPublicKey(t, "key")
+	fake.setUsers(
+		fakeDirectoryUser{Email: "ada@example.com", GivenName: "Ada",
+			FamilyName: "Lovelace", SSHKey: key},
+		fakeDirectoryUser{Email: "alan@example.com", GivenName: "Alan",
+			FamilyName: "Turing", SSHKey: key, Suspended: true},
+		fakeDirectoryUser{Email: "grace@example.com", GivenName: "Grace",
+			FamilyName: "Hopper"},
+		fakeDirectoryUser{Email: "edsger@example.com", GivenName: "Edsger",
+			FamilyName: "Dijkstra", RawSSHKey: `"not an object"`},
+	)
+
+	users, err := pullFakeDirectory(fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"ada.lovelace"}
+	if got := usernamesOf(users); !reflect.DeepEqual(got, want) {
+		t.Errorf("usernames = %v, want %v", got, want)
+	}
+}
+
+func TestPullGsuiteUsersCustomAttributeKey(t *testing.T) {
+	useTestLogger(t)
+	fake := newFakeDirectory(t, "example.com")
+	fake.Schema = "Access"
+	key := testPublicKey(t, "ada")
+	fake.setUsers(fakeDirectoryUser{Email: "ada@example.com",
+		GivenName: "Ada", FamilyName: "Lovelace", SSHKey: key})
+
+	users, err := PullGsuiteUsers(
+		context.Background(), "admin@example.com", "example.com", "Access",
+		"key", "", "", fake.URL, http.DefaultClient,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || !reflect.DeepEqual(users[0].publickeys,
+		[]string{key}) {
+		t.Errorf("users = %+v, want ada with the key", users)
+	}
+
+	// The default key isn't in the field mask, so no user has it
+	users, err = pullFakeDirectory(fake)
+	if err != nil || len(users) != 0 {
+		t.Errorf("users = %+v, error = %v, want none", users, err)
+	}
+}
+
+func TestPullGsuiteUsersErrors(t *testing.T) {
+	useTestLogger(t)
+	useTestRetries(t)
+	tests := []struct {
+		name     string
+		status   int
+		reason   string
+		category string
+	}{
+		{"unauthorized", http.StatusUnauthorized, "authError", errorAuth},
+		{"forbidden", http.StatusForbidden, "forbidden", errorAuth},
+		{"quota", http.StatusForbidden, "userRateLimitExceeded", errorQuota},
+		{"rate limited", http.StatusTooManyRequests, "rateLimitExceeded",
+			errorQuota},
+		{"server error", http.StatusInternalServerError, "backendError",
+			errorTransient},
+		{"bad request", http.StatusBadRequest, "invalid", errorPermanent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeDirectory(t, "example.com")
+			fake.setUsers(fakeDirectoryUser{
+				Email: "ada@example.com", GivenName: "Ada",
+				FamilyName: "Lovelace", SSHKey: testPublicKey(t, "ada"),
+			})
+			for i := 0; i < Cfg.Retry.Attempts; i++ {
+				fake.fail(tt.status, tt.reason)
+			}
+
+			users, err := pullFakeDirectory(fake)
+			var apiErr *googleapi.Error
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("error = %v, want a googleapi.Error", err)
+			}
+			if apiErr.Code != tt.status {
+				t.Errorf("code = %d, want %d", apiErr.Code, tt.status)
+			}
+			if category, _ := classifyError(err); category != tt.category {
+				t.Errorf("category = %s, want %s", category, tt.category)
+			}
+			if users != nil {
+				t.Errorf("users = %v, want none", users)
+			}
+
+			// Only quota and transient errors are worth retrying
+			requests := 1
+			if tt.category == errorQuota || tt.category == errorTransient {
+				requests = Cfg.Retry.Attempts
+			}
+			if fake.requestCount() != requests {
+				t.Errorf("%d requests, want %d", fake.requestCount(), requests)
+			}
+		})
+	}
+}
+
+func TestPullGsuiteUsersRetries(t *testing.T) {
+	useTestLogger(t)
+	delays := useTestRetries(t)
+	fake := newFakeDirectory(t, "example.com")
+	fake.PageSize = 1
+	key := testPublicKey(t, "key")
+	fake.setUsers(
+		fakeDirectoryUser{Email: "ada@example.com", GivenName: "Ada",
+			FamilyName: "Lovelace", SSHKey: key},
+		fakeDirectoryUser{Email: "alan@example.com", GivenName: "Alan",
+			FamilyName: "Turing", SSHKey: key},
+	)
+	fake.rateLimit(1, "7")
+	fake.failRequest(3, http.StatusServiceUnavailable, "backendError")
+
+	users, err := pullFakeDirectory(fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"ada.lovelace", "alan.turing"}
+	if got := usernamesOf(users); !reflect.DeepEqual(got, want) {
+		t.Errorf("usernames = %v, want %v", got, want)
+	}
+	if fake.requestCount() != 4 {
+		t.Errorf("%d requests, want 4", fake.requestCount())
+	}
+	// The rate limit asks for 7 seconds, longer than the backoff
+	if len(*delays) != 2 || (*delays)[0] != 7*time.Second {
+		t.Errorf("delays = %v, want 7s and a backoff", *delays)
+	}
+}
+
+func TestPullGsuiteUsersFailingPage(t *testing.T) {
+	useTestLogger(t)
+	useTestRetries(t)
+	fake := newFakeDirectory(t, "example.com")
+	fake.PageSize = 1
+	key := testPublicKey(t, "key")
+	fake.setUsers(
+		fakeDirectoryUser{Email: "ada@example.com", GivenName: "Ada",
+			FamilyName: "Lovelace", SSHKey: key},
+		fakeDirectoryUser{Email: "alan@example.com", GivenName: "Alan",
+			FamilyName: "Turing", SSHKey: key},
+	)
+	fake.failRequest(2, http.StatusBadRequest, "invalid")
+
+	// A list cut short would delete the users of the missing pages
+	users, err := pullFakeDirectory(fake)
+	if err == nil {
+		t.Fatalf("users = %v, want an error for the failed page", users)
+	}
+	if fake.requestCount() != 2 {
+		t.Errorf("%d requests, want 2", fake.requestCount())
+	}
+}
+
+func TestPullGsuiteUsersOtherDomain(t *testing.T) {
+	useTestLogger(t)
+	fake := newFakeDirectory(t, "example.com")
+	_, err := PullGsuiteUsers(
+		context.Background(), "admin@example.com", "other.example.com",
+		"SSHKEY", "key", "", "", fake.URL, http.DefaultClient,
+	)
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusForbidden {
+		t.Errorf("error = %v, want 403", err)
+	}
+}
+
+func TestCheckForUnsetGsuiteConfigEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		want     string
+		wantErr  bool
+	}{
+		{"", "", false},
+		{"http://127.0.0.1:8080", "http://127.0.0.1:8080/", false},
+		{"https://directory.example.com/", "https://directory.example.com/",
+			false},
+		{"ftp://directory.example.com/", "", true},
+		{"directory.example.com", "", true},
+	}
+	for _, tt := range tests {
+		opts := ProviderOptions{
+			Email:          "admin@example.com",
+			Credentials:    "credentials.json",
+			GsuiteEndpoint: tt.endpoint,
+		}
+		err := checkForUnsetGsuiteConfig(&opts)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error = %v, want error %t", tt.endpoint, err,
+				tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && opts.GsuiteEndpoint != tt.want {
+			t.Errorf("%q: endpoint = %q, want %q", tt.endpoint,
+				opts.GsuiteEndpoint, tt.want)
+		}
+	}
+}
+
+func TestCheckForUnsetGsuiteConfigAdmin(t *testing.T) {
+	tests := []struct {
+		email   string
+		domain  string
+		wantErr bool
+	}{
+		{"admin@example.com", "example.com", false},
+		{"", "", true},
+		{"admin", "", true},
+		{"admin@", "", true},
+		{"@example.com", "", true},
+	}
+	for _, tt := range tests {
+		opts := ProviderOptions{Email: tt.email, GsuiteAuth: "adc"}
+		err := checkForUnsetGsuiteConfig(&opts)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error = %v, want error %t", tt.email, err,
+				tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && opts.Domain != tt.domain {
+			t.Errorf("%q: domain = %q, want %q", tt.email, opts.Domain,
+				tt.domain)
+		}
+	}
+}
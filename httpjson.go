@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// httpMaxPages guards against a misbehaving API returning the same cursor
+// or next link forever
+const httpMaxPages = 1000
+
+// HTTPProviderOptions defines how users are fetched from a generic JSON API
+// and how the fields of each user are mapped. It is inlined into
+// ProviderOptions so every option is prefixed with http in config.yml.
+type HTTPProviderOptions struct {
+	URL string `yaml:"httpurl"`
+
+	BearerToken   string `yaml:"httpbearertoken"`
+	BasicUser     string `yaml:"httpbasicuser"`
+	BasicPassword string `yaml:"httpbasicpassword"`
+	ClientCert    string `yaml:"httpclientcert"`
+	ClientKey     string `yaml:"httpclientkey"`
+	CACert        string `yaml:"httpcacert"`
+
+	Pagination  string `yaml:"httppagination"`
+	CursorPath  string `yaml:"httpcursorpath"`
+	CursorParam string `yaml:"httpcursorparam"`
+
+	UsersPath      string   `yaml:"httpuserspath"`
+	UsernamePath   string   `yaml:"httpusernamepath"`
+	EmailPath      string   `yaml:"httpemailpath"`
+	NamePath       string   `yaml:"httpnamepath"`
+	ShellPath      string   `yaml:"httpshellpath"`
+	KeysPath       string   `yaml:"httpkeyspath"`
+	GroupsPath     string   `yaml:"httpgroupspath"`
+	StatusPath     string   `yaml:"httpstatuspath"`
+	ActiveStatuses []string `yaml:"httpactivestatuses"`
+
+	SignatureKey    string `yaml:"httpsignaturekey"`
+	SignatureHeader string `yaml:"httpsignatureheader"`
+}
+
+// newHTTPProviderClient builds an HTTP client, configuring a client
+// certificate for mTLS and a custom CA bundle when set. The transport is a
+// copy of the default one, so proxies set in the environment and the
+// default dial and handshake timeouts still apply.
+func newHTTPProviderClient(opts HTTPProviderOptions) (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+
+	if opts.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(opts.ClientCert, opts.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if opts.CACert != "" {
+		caPEM, err := ioutil.ReadFile(opts.CACert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: transport,
+	}, nil
+}
+
+// loadSignatureKey reads an Ed25519 public key used to verify responses. The
+// file may hold either a PEM encoded PKIX public key or the raw key encoded
+// as base64.
+func loadSignatureKey(path string) (ed25519.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if block, _ := pem.Decode(data); block != nil {
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		edKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an Ed25519 public key", path)
+		}
+		return edKey, nil
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%s is not an Ed25519 public key", path)
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// nextLink returns the URL of the rel="next" entry of an RFC 8288 Link
+// header, resolved against the request URL, or an empty string if none.
+func nextLink(header string, base *url.URL) string {
+	for _, link := range strings.Split(header, ",") {
+		parts := strings.Split(link, ";")
+		if len(parts) < 2 {
+			continue
+		}
+		target := strings.Trim(strings.TrimSpace(parts[0]), "<>")
+		for _, param := range parts[1:] {
+			param = strings.ReplaceAll(strings.TrimSpace(param), " ", "")
+			if param == `rel="next"` || param == "rel=next" {
+				ref, err := url.Parse(target)
+				if err != nil {
+					return ""
+				}
+				return base.ResolveReference(ref).String()
+			}
+		}
+	}
+	return ""
+}
+
+// httpFetchPage requests a single page of users, verifying the response
+// signature when a signature key is configured, and returns the decoded
+// body along with the response headers. Quota and transient errors are
+// retried.
+func httpFetchPage(
+	ctx context.Context,
+	client *http.Client,
+	requestURL string,
+	opts HTTPProviderOptions,
+	signatureKey ed25519.PublicKey,
+) (interface{}, http.Header, error) {
+	var doc interface{}
+	var header http.Header
+	err := withRetry(
+		ctx,
+		"HTTP provider request "+requestURL,
+		func(ctx context.Context) error {
+			var err error
+			doc, header, err = httpFetchPageOnce(
+				ctx, client, requestURL, opts, signatureKey,
+			)
+			return err
+		},
+	)
+	return doc, header, err
+}
+
+// httpFetchPageOnce makes a single attempt at requesting a page of users
+func httpFetchPageOnce(
+	ctx context.Context,
+	client *http.Client,
+	requestURL string,
+	opts HTTPProviderOptions,
+	signatureKey ed25519.PublicKey,
+) (interface{}, http.Header, error) {
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodGet, requestURL, nil,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if opts.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+opts.BearerToken)
+	} else if opts.BasicUser != "" {
+		req.SetBasicAuth(opts.BasicUser, opts.BasicPassword)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	err = checkHTTPResponse(resp, "HTTP provider request "+requestURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The signature is detached from the body and covers the raw bytes
+	if signatureKey != nil {
+		encoded := resp.Header.Get(opts.SignatureHeader)
+		if encoded == "" {
+			return nil, nil, fmt.Errorf(
+				"HTTP provider response from %s is missing the %s header",
+				requestURL, opts.SignatureHeader,
+			)
+		}
+		signature, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, nil, fmt.Errorf(
+				"HTTP provider response signature is not base64: %v", err,
+			)
+		}
+		if !ed25519.Verify(signatureKey, body, signature) {
+			return nil, nil, fmt.Errorf(
+				"HTTP provider response from %s failed signature "+
+					"verification", requestURL,
+			)
+		}
+	}
+
+	var doc interface{}
+	err = json.Unmarshal(body, &doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return doc, resp.Header, nil
+}
+
+// mapHTTPUser extracts an IAMUser from a single user object using the
+// configured JSONPath expressions. The returned bool is false when the user
+// should be skipped because it is inactive or has no username or keys.
+func mapHTTPUser(
+	doc interface{},
+	opts HTTPProviderOptions,
+) (IAMUser, bool, error) {
+	usernames, err := jsonPathStrings(opts.UsernamePath, doc)
+	if err != nil || len(usernames) == 0 || usernames[0] == "" {
+		return IAMUser{}, false, err
+	}
+
+	if opts.StatusPath != "" {
+		statuses, err := jsonPathStrings(opts.StatusPath, doc)
+		if err != nil {
+			return IAMUser{}, false, err
+		}
+		active := false
+		for _, status := range statuses {
+			for _, activeStatus := range opts.ActiveStatuses {
+				if strings.EqualFold(status, activeStatus) {
+					active = true
+				}
+			}
+		}
+		if !active {
+			return IAMUser{}, false, nil
+		}
+	}
+
+	keyValues, err := jsonPathStrings(opts.KeysPath, doc)
+	if err != nil {
+		return IAMUser{}, false, err
+	}
+	keys := []string{}
+	for _, value := range keyValues {
+		// A single field may hold several keys, one per line
+		for _, line := range strings.Split(value, "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" {
+				keys = append(keys, line)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return IAMUser{}, false, nil
+	}
+
+	email := ""
+	if opts.EmailPath != "" {
+		emails, err := jsonPathStrings(opts.EmailPath, doc)
+		if err != nil {
+			return IAMUser{}, false, err
+		}
+		if len(emails) > 0 {
+			email = emails[0]
+		}
+	}
+
+	fullname := ""
+	if opts.NamePath != "" {
+		names, err := jsonPathStrings(opts.NamePath, doc)
+		if err != nil {
+			return IAMUser{}, false, err
+		}
+		if len(names) > 0 {
+			fullname = names[0]
+		}
+	}
+
+	shell := ""
+	if opts.ShellPath != "" {
+		shells, err := jsonPathStrings(opts.ShellPath, doc)
+		if err != nil {
+			return IAMUser{}, false, err
+		}
+		if len(shells) > 0 {
+			shell = shells[0]
+		}
+	}
+
+	groups := []string{}
+	if opts.GroupsPath != "" {
+		groups, err = jsonPathStrings(opts.GroupsPath, doc)
+		if err != nil {
+			return IAMUser{}, false, err
+		}
+	}
+
+	return IAMUser{
+		username:   strings.ToLower(usernames[0]),
+		email:      email,
+		publickeys: keys,
+		groups:     groups,
+		fullname:   fullname,
+		shell:      shell,
+	}, true, nil
+}
+
+// PullHTTPUsers requests the configured URL, following link or cursor
+// pagination, and maps every user object found at the users path to an
+// IAMUser using the configured JSONPath expressions. Inactive users and
+// users without keys are skipped. Returns a list of IAMUser objects.
+func PullHTTPUsers(
+	ctx context.Context,
+	opts HTTPProviderOptions,
+) ([]IAMUser, error) {
+	// httpUsers List of httpUser objects
+	var httpUsers = []IAMUser{}
+
+	client, err := newHTTPProviderClient(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var signatureKey ed25519.PublicKey
+	if opts.SignatureKey != "" {
+		signatureKey, err = loadSignatureKey(opts.SignatureKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	baseURL, err := url.Parse(opts.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	requestURL := opts.URL
+	seenCursors := map[string]bool{}
+	for page := 0; requestURL != ""; page++ {
+		if page >= httpMaxPages {
+			return nil, fmt.Errorf(
+				"HTTP provider exceeded %d pages, check the pagination "+
+					"settings", httpMaxPages,
+			)
+		}
+
+		doc, header, err := httpFetchPage(
+			ctx, client, requestURL, opts, signatureKey,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		userDocs, err := evalJSONPath(opts.UsersPath, doc)
+		if err != nil {
+			return nil, err
+		}
+		// A users path pointing at an array selects each of its elements
+		if len(userDocs) == 1 {
+			if list, ok := userDocs[0].([]interface{}); ok {
+				userDocs = list
+			}
+		}
+
+		for _, userDoc := range userDocs {
+			u, ok, err := mapHTTPUser(userDoc, opts)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				httpUsers = append(httpUsers, u)
+			}
+		}
+
+		// Work out the URL of the next page, if any
+		pageURL, err := url.Parse(requestURL)
+		if err != nil {
+			return nil, err
+		}
+		requestURL = ""
+		switch strings.ToLower(opts.Pagination) {
+		case "link":
+			requestURL = nextLink(header.Get("Link"), pageURL)
+		case "cursor":
+			cursors, err := jsonPathStrings(opts.CursorPath, doc)
+			if err != nil {
+				return nil, err
+			}
+			if len(cursors) == 0 || cursors[0] == "" {
+				break
+			}
+			if seenCursors[cursors[0]] {
+				return nil, errors.New(
+					"HTTP provider returned the same cursor twice",
+				)
+			}
+			seenCursors[cursors[0]] = true
+
+			next := *baseURL
+			query := next.Query()
+			query.Set(opts.CursorParam, cursors[0])
+			next.RawQuery = query.Encode()
+			requestURL = next.String()
+		}
+	}
+	return httpUsers, nil
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// syncLock is the exclusive lock held on the lock file in the state
+// directory for the whole sync, so runs started by cron while a previous
+// one is still going don't manage the same accounts at once
+type syncLock struct {
+	file *os.File
+}
+
+// acquireSyncLock takes the sync lock without waiting, returning an error
+// naming the process holding it when another sync is running. The lock is
+// released by the kernel if the process dies.
+func acquireSyncLock() (*syncLock, error) {
+	err := os.MkdirAll(Cfg.StateDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(Cfg.StateDir, "sync.lock")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		holder, _ := ioutil.ReadAll(f)
+		f.Close()
+		return nil, fmt.Errorf(
+			"another sync is running, %s is held by pid %s", path, holder,
+		)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// Record the holder for the error above and for administrators
+	if f.Truncate(0) == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	}
+	return &syncLock{file: f}, nil
+}
+
+// release drops the sync lock
+func (l *syncLock) release() {
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file.Close()
+}
+
+// journalEntry records an account operation the sync is about to perform
+type journalEntry struct {
+	Op       string    `json:"op"`
+	Username string    `json:"username"`
+	Provider string    `json:"provider,omitempty"`
+	Home     string    `json:"home,omitempty"`
+	KeepHome bool      `json:"keephome,omitempty"`
+	Started  time.Time `json:"started"`
+	Done     bool      `json:"done"`
+
+	// Created is set once the account of an add was created by the sync,
+	// telling it apart from an account of the same name created by someone
+	// else in the meantime
+	Created bool `json:"created,omitempty"`
+}
+
+// syncJournal is the write-ahead journal of the account operations of a
+// sync. Entries are written before an account is created or deleted, marked
+// done afterwards, and only cleared once the state recording their outcome
+// has been saved, so a crash at any point can be recovered from.
+type syncJournal struct {
+	Entries []journalEntry `json:"entries"`
+
+	mu sync.Mutex
+}
+
+// journal is the journal of the running sync, nil outside of a sync
+var journal *syncJournal
+
+// journalPath returns the path of the sync journal
+func journalPath() string {
+	return filepath.Join(Cfg.StateDir, "journal.json")
+}
+
+// loadJournal reads the journal left by the previous sync, which is empty
+// unless that sync was interrupted
+func loadJournal() (*syncJournal, error) {
+	j := &syncJournal{}
+	data, err := ioutil.ReadFile(journalPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, j)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", journalPath(), err)
+	}
+	return j, nil
+}
+
+// save writes the journal to disk before the operation it records is run.
+// The caller holds mu.
+func (j *syncJournal) save() error {
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(journalPath(), data, 0600)
+}
+
+// begin records an operation about to be performed, returning its index
+func (j *syncJournal) begin(entry journalEntry) (int, error) {
+	if j == nil {
+		return -1, nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entry.Started = time.Now().UTC()
+	j.Entries = append(j.Entries, entry)
+	return len(j.Entries) - 1, j.save()
+}
+
+// done marks an operation as performed
+func (j *syncJournal) done(i int) error {
+	if j == nil || i < 0 {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Entries[i].Done = true
+	return j.save()
+}
+
+// created records that the account of an add operation was created
+func (j *syncJournal) created(i int) error {
+	if j == nil || i < 0 {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Entries[i].Created = true
+	return j.save()
+}
+
+// drop marks an operation that failed before changing anything the sync
+// could claim, so the next sync doesn't recover it
+func (j *syncJournal) drop(i int) error {
+	return j.done(i)
+}
+
+// clear drops the operations that are done once the state has been saved.
+// Failed operations are kept for the next sync to recover.
+func (j *syncJournal) clear() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	pending := []journalEntry{}
+	for _, entry := range j.Entries {
+		if !entry.Done {
+			pending = append(pending, entry)
+		}
+	}
+	j.Entries = pending
+	if len(pending) > 0 {
+		return j.save()
+	}
+	err := os.Remove(journalPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// recoverJournal finishes or rolls back the account creations of an
+// interrupted sync. An account the sync created is kept and recorded as
+// created, so the sync completes its keys or deletes it like any other
+// account, while an account that may have been created by someone else is
+// only taken over as the adoption policy allows. Deletions are left to
+// recoverDeletes, once the users have been pulled. An operation that can't
+// be recovered is logged and kept for the next sync to retry.
+func recoverJournal(j *syncJournal, state SyncState) {
+	if len(j.Entries) == 0 {
+		return
+	}
+	globalLogger.Error(
+		"Found %d operations of an interrupted sync in %s, recovering\n",
+		len(j.Entries), journalPath(),
+	)
+
+	for i, entry := range j.Entries {
+		if entry.Op != "add" {
+			continue
+		}
+		err := recoverAdd(entry, state)
+		if err != nil {
+			globalLogger.Error(
+				"Issue recovering %s of account %s: %v\n",
+				entry.Op, entry.Username, err,
+			)
+			continue
+		}
+		j.Entries[i].Done = true
+	}
+}
+
+// recoverAdd completes the creation of an account that exists, making sure
+// it is in the managed group and recorded as created. Unless the journal
+// shows the sync created it, the account is treated like any existing
+// account, so a protected account or one the adoption policy doesn't allow
+// to take over is left alone and never deleted by a later sync.
+func recoverAdd(entry journalEntry, state SyncState) error {
+	_, err := accountBackend.LookupUser(entry.Username)
+	if errors.Is(err, ErrUnknownAccount) {
+		globalLogger.Info(
+			"Account %s was never created, nothing to roll back\n",
+			entry.Username,
+		)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if reason := protectedAccount(entry.Username); reason != "" {
+		globalLogger.Error(
+			"Not recovering creation of protected account %s as %s\n",
+			entry.Username, reason,
+		)
+		return nil
+	}
+
+	members, err := getUsersInGroup(Cfg.Group)
+	if err != nil {
+		return err
+	}
+	member := false
+	for _, m := range members {
+		member = member || m == entry.Username
+	}
+	if !entry.Created && !adoptable(member) {
+		globalLogger.Error(
+			"CONFLICT: account %s may not have been created by iamusersync, "+
+				"not recovering its creation (adoption: %s)\n",
+			entry.Username, Cfg.Adoption,
+		)
+		return nil
+	}
+	if !member {
+		err = addUserToGroup(Cfg.Group, entry.Username)
+		if err != nil {
+			return err
+		}
+	}
+	state.setAccount(entry.Username, AccountState{
+		Provider: entry.Provider,
+		Created:  entry.Created,
+		Adopted:  !entry.Created,
+	})
+	globalLogger.Info("Recovered creation of account %s\n", entry.Username)
+	return nil
+}
+
+// recoverDeletes finishes the deletions of an interrupted sync, given the
+// users just pulled from IAM. A deletion is only finished, removing the
+// home directory even if the account itself is already gone, when the user
+// is still missing from IAM. A user that is back keeps their account, and
+// while a provider can't be reached every deletion waits for the next sync,
+// as its users may only be missing because of it.
+func recoverDeletes(
+	j *syncJournal,
+	state SyncState,
+	users []IAMUser,
+	failedProviders map[string]bool,
+) {
+	present := map[string]bool{}
+	for _, u := range users {
+		present[u.username] = true
+	}
+
+	for i, entry := range j.Entries {
+		if entry.Op != "delete" || entry.Done {
+			continue
+		}
+		if present[entry.Username] {
+			globalLogger.Info(
+				"Not recovering deletion of account %s as the user is "+
+					"back in IAM\n",
+				entry.Username,
+			)
+			j.Entries[i].Done = true
+			continue
+		}
+		if len(failedProviders) > 0 {
+			globalLogger.Info(
+				"Not recovering deletion of account %s until every "+
+					"provider can be reached\n",
+				entry.Username,
+			)
+			continue
+		}
+
+		err := recoverDelete(entry, state)
+		if err != nil {
+			globalLogger.Error(
+				"Issue recovering delete of account %s: %v\n",
+				entry.Username, err,
+			)
+			continue
+		}
+		j.Entries[i].Done = true
+	}
+}
+
+// recoverDelete finishes the deletion of an account and its home directory
+func recoverDelete(entry journalEntry, state SyncState) error {
+	_, err := accountBackend.LookupUser(entry.Username)
+	if err == nil {
+		err = deleteUser(entry.Username, entry.KeepHome)
+	} else if errors.Is(err, ErrUnknownAccount) {
+		err = removeAuthorizedPrincipals(entry.Username)
+		if err == nil && !entry.KeepHome && entry.Home != "" &&
+			filepath.Clean(entry.Home) != "/" {
+			err = os.RemoveAll(filepath.Join(Cfg.Root, entry.Home))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	delete(state.Accounts, entry.Username)
+	globalLogger.Info("Recovered deletion of account %s\n", entry.Username)
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestRecoverDeletes(t *testing.T) {
+	previousCfg := Cfg
+	previousBackend := accountBackend
+	t.Cleanup(func() {
+		Cfg = previousCfg
+		accountBackend = previousBackend
+	})
+	useTestLogger(t)
+
+	root := t.TempDir()
+	Cfg = Config{Root: root, StateDir: filepath.Join(root, "state")}
+	accountBackend = nativeBackend{root: root}
+	passwd := filepath.Join(root, passwdFile)
+	err := os.MkdirAll(filepath.Dir(passwd), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(
+			passwd, []byte("root:x:0:0:root:/root:/bin/bash\n"), 0644,
+		)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The accounts of every entry are already gone, leaving their homes
+	names := []string{"ada", "grace", "alan"}
+	homes := map[string]string{}
+	for _, name := range names {
+		homes[name] = filepath.Join(root, "home", name)
+		if err := os.MkdirAll(homes[name], 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	newJournal := func() *syncJournal {
+		j := &syncJournal{}
+		for _, name := range names {
+			j.Entries = append(j.Entries, journalEntry{
+				Op: "delete", Username: name, Home: "/home/" + name,
+			})
+		}
+		j.Entries[2].KeepHome = true
+		return j
+	}
+	state := SyncState{
+		Accounts: map[string]AccountState{
+			"ada":   {Created: true},
+			"grace": {Created: true},
+			"alan":  {Created: true},
+		},
+		mu: &sync.Mutex{},
+	}
+	grace := []IAMUser{{username: "grace", provider: "staff"}}
+
+	// Nothing is deleted while a provider can't be reached
+	j := newJournal()
+	recoverDeletes(j, state, grace, map[string]bool{"contractors": true})
+	for i, entry := range j.Entries {
+		if entry.Done != (entry.Username == "grace") {
+			t.Errorf("%s: done = %t while a provider failed",
+				entry.Username, entry.Done)
+		}
+		if _, err := os.Stat(homes[names[i]]); err != nil {
+			t.Errorf("home of %s removed while a provider failed",
+				entry.Username)
+		}
+	}
+
+	// A user back in IAM keeps their home, the others are finished
+	j = newJournal()
+	recoverDeletes(j, state, grace, nil)
+	for _, entry := range j.Entries {
+		if !entry.Done {
+			t.Errorf("%s: not done", entry.Username)
+		}
+	}
+	if _, err := os.Stat(homes["grace"]); err != nil {
+		t.Errorf("home of grace, who is back in IAM, removed: %v", err)
+	}
+	if _, err := os.Stat(homes["ada"]); !os.IsNotExist(err) {
+		t.Errorf("home of ada not removed: %v", err)
+	}
+	if _, err := os.Stat(homes["alan"]); err != nil {
+		t.Errorf("home of alan removed despite keephome: %v", err)
+	}
+	if _, ok := state.Accounts["grace"]; !ok {
+		t.Error("grace forgotten although back in IAM")
+	}
+	if _, ok := state.Accounts["ada"]; ok {
+		t.Error("ada still recorded after her deletion was recovered")
+	}
+}
+
+func TestRecoverJournalLeavesDeletes(t *testing.T) {
+	useTestLogger(t)
+	j := &syncJournal{Entries: []journalEntry{
+		{Op: "delete", Username: "ada", Home: "/home/ada"},
+	}}
+	recoverJournal(j, SyncState{
+		Accounts: map[string]AccountState{}, mu: &sync.Mutex{},
+	})
+	if j.Entries[0].Done {
+		t.Error("delete recovered before the users were pulled")
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonPathSegment is a single step of a parsed JSONPath expression. A
+// segment selects either an object field by name, an array element by index,
+// or every child when wildcard is set.
+type jsonPathSegment struct {
+	field    string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// parseJSONPath parses the subset of JSONPath used to map provider fields:
+// a leading `$`, dot notation (`.name`), bracket notation (`['name']`),
+// array indexes (`[0]`) and wildcards (`.*` and `[*]`). The leading `$` may
+// be left out, in which case the path is relative to the root.
+func parseJSONPath(path string) ([]jsonPathSegment, error) {
+	segments := []jsonPathSegment{}
+	p := strings.TrimSpace(path)
+	p = strings.TrimPrefix(p, "$")
+
+	for len(p) > 0 {
+		switch p[0] {
+		case '.':
+			p = p[1:]
+			end := strings.IndexAny(p, ".[")
+			if end == -1 {
+				end = len(p)
+			}
+			name := p[:end]
+			if name == "" {
+				return nil, fmt.Errorf("invalid JSONPath %q: empty field", path)
+			}
+			if name == "*" {
+				segments = append(segments, jsonPathSegment{wildcard: true})
+			} else {
+				segments = append(segments, jsonPathSegment{field: name})
+			}
+			p = p[end:]
+		case '[':
+			end := strings.Index(p, "]")
+			if end == -1 {
+				return nil, fmt.Errorf("invalid JSONPath %q: missing ]", path)
+			}
+			inner := strings.TrimSpace(p[1:end])
+			p = p[end+1:]
+
+			switch {
+			case inner == "*":
+				segments = append(segments, jsonPathSegment{wildcard: true})
+			case len(inner) > 0 && (inner[0] == '\'' || inner[0] == '"'):
+				if len(inner) < 2 || inner[len(inner)-1] != inner[0] {
+					return nil, fmt.Errorf(
+						"invalid JSONPath %q: unterminated quote in %q",
+						path, inner,
+					)
+				}
+				segments = append(
+					segments, jsonPathSegment{field: inner[1 : len(inner)-1]},
+				)
+			default:
+				i, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf(
+						"invalid JSONPath %q: bad index %q", path, inner,
+					)
+				}
+				segments = append(
+					segments, jsonPathSegment{index: i, isIndex: true},
+				)
+			}
+		default:
+			// A relative path such as `name.first` starts with a bare field
+			p = "." + p
+		}
+	}
+	return segments, nil
+}
+
+// evalJSONPath evaluates a JSONPath expression against a value decoded by
+// encoding/json and returns every matching value. Wildcards fan out over
+// arrays and objects, missing fields simply produce no match.
+func evalJSONPath(path string, doc interface{}) ([]interface{}, error) {
+	segments, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	current := []interface{}{doc}
+	for _, seg := range segments {
+		next := []interface{}{}
+		for _, node := range current {
+			switch v := node.(type) {
+			case map[string]interface{}:
+				if seg.wildcard {
+					for _, child := range v {
+						next = append(next, child)
+					}
+				} else if child, ok := v[seg.field]; ok && !seg.isIndex {
+					next = append(next, child)
+				}
+			case []interface{}:
+				if seg.wildcard {
+					next = append(next, v...)
+				} else if seg.isIndex {
+					i := seg.index
+					if i < 0 {
+						i += len(v)
+					}
+					if i >= 0 && i < len(v) {
+						next = append(next, v[i])
+					}
+				}
+			}
+		}
+		current = next
+	}
+	return current, nil
+}
+
+// jsonPathStrings evaluates a JSONPath expression and returns every scalar
+// match as a string. Arrays of scalars are flattened so that a path may point
+// at either a single value or a list of values.
+func jsonPathStrings(path string, doc interface{}) ([]string, error) {
+	matches, err := evalJSONPath(path, doc)
+	if err != nil {
+		return nil, err
+	}
+
+	values := []string{}
+	var add func(v interface{})
+	add = func(v interface{}) {
+		switch val := v.(type) {
+		case nil:
+		case string:
+			values = append(values, val)
+		case bool:
+			values = append(values, strconv.FormatBool(val))
+		case float64:
+			values = append(values, strconv.FormatFloat(val, 'f', -1, 64))
+		case []interface{}:
+			for _, child := range val {
+				add(child)
+			}
+		}
+	}
+	for _, m := range matches {
+		add(m)
+	}
+	return values, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+const jsonPathTestDoc = `{
+	"data": {
+		"users": [
+			{"name": "ada", "keys": ["ssh-ed25519 A", "ssh-ed25519 B"],
+				"admin": true, "uid": 1001, "manager": null},
+			{"name": "alan", "keys": "ssh-ed25519 C", "uid": 1002.5},
+			{"name": "grace", "profile": {"first name": "Grace"}}
+		],
+		"count": 3
+	}
+}`
+
+func jsonPathTestValue(t *testing.T) interface{} {
+	t.Helper()
+	var doc interface{}
+	if err := json.Unmarshal([]byte(jsonPathTestDoc), &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestJSONPathStrings(t *testing.T) {
+	doc := jsonPathTestValue(t)
+	tests := []struct {
+		path string
+		want []string
+	}{
+		// Dot notation, with and without the root
+		{"$.data.count", []string{"3"}},
+		{"data.count", []string{"3"}},
+		{" $.data.count ", []string{"3"}},
+		// Indexes, negative from the end
+		{"$.data.users[0].name", []string{"ada"}},
+		{"$.data.users[-1].name", []string{"grace"}},
+		{"$.data.users[ 1 ].name", []string{"alan"}},
+		// Bracket notation with either quote
+		{"$['data']['users'][1]['name']", []string{"alan"}},
+		{`$.data.users[2].profile["first name"]`, []string{"Grace"}},
+		// Wildcards over arrays and objects
+		{"$.data.users[*].name", []string{"ada", "alan", "grace"}},
+		{"$.data.users.*.name", []string{"ada", "alan", "grace"}},
+		{"$.data.users[2].profile.*", []string{"Grace"}},
+		// Arrays of scalars are flattened, scalars formatted
+		{"$.data.users[*].keys",
+			[]string{"ssh-ed25519 A", "ssh-ed25519 B", "ssh-ed25519 C"}},
+		{"$.data.users[0].admin", []string{"true"}},
+		{"$.data.users[*].uid", []string{"1001", "1002.5"}},
+		// The root itself
+		{"$.data.users[0].keys[1]", []string{"ssh-ed25519 B"}},
+		// Missing fields, out of range indexes, nulls and indexing or
+		// naming the wrong kind of node produce no match
+		{"$.data.missing", []string{}},
+		{"$.data.users[3].name", []string{}},
+		{"$.data.users[-4].name", []string{}},
+		{"$.data.users[0].manager", []string{}},
+		{"$.data.count.value", []string{}},
+		{"$.data.count[0]", []string{}},
+		{"$.data[0]", []string{}},
+		{"$.data.users.name", []string{}},
+		{"$.data.users[0].name[0]", []string{}},
+		{"$.data.users[*].profile", []string{}},
+	}
+	for _, tt := range tests {
+		got, err := jsonPathStrings(tt.path, doc)
+		if err != nil {
+			t.Errorf("%q: %v", tt.path, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestJSONPathStringsUnordered(t *testing.T) {
+	// Object wildcards match in no particular order
+	got, err := jsonPathStrings(
+		"$.*", map[string]interface{}{"a": "1", "b": "2"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || (got[0] != "1" && got[0] != "2") {
+		t.Errorf("matches = %q, want 1 and 2", got)
+	}
+}
+
+func TestParseJSONPathErrors(t *testing.T) {
+	for _, path := range []string{
+		"$.",
+		"$..name",
+		"$.data.",
+		"$.users[",
+		"$.users[0",
+		"$.users[?(",
+		"$.users[?(@.name == 'ada')",
+		"$.users[?(@.name == 'ada')]",
+		"$.users[abc]",
+		"$.users[1.5]",
+		"$.users[]",
+		"$['users]",
+		"$[\"users']",
+		"$[']",
+	} {
+		segments, err := parseJSONPath(path)
+		if err == nil {
+			t.Errorf("%q: segments = %+v, want an error", path, segments)
+		}
+		if _, err := jsonPathStrings(path, nil); err == nil {
+			t.Errorf("%q: evaluated without an error", path)
+		}
+	}
+}
+
+func TestParseJSONPath(t *testing.T) {
+	segments, err := parseJSONPath("$.users[*]['first name'][-1].*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []jsonPathSegment{
+		{field: "users"},
+		{wildcard: true},
+		{field: "first name"},
+		{index: -1, isIndex: true},
+		{wildcard: true},
+	}
+	if !reflect.DeepEqual(segments, want) {
+		t.Errorf("segments = %+v, want %+v", segments, want)
+	}
+}
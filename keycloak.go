@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// keycloakToken struct to map an OpenID Connect token response to
+type keycloakToken struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+}
+
+// keycloakGroup struct to map a Keycloak group representation to
+type keycloakGroup struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// keycloakUser struct to map a Keycloak user representation to
+type keycloakUser struct {
+	ID         string              `json:"id"`
+	Username   string              `json:"username"`
+	Enabled    bool                `json:"enabled"`
+	FirstName  string              `json:"firstName"`
+	LastName   string              `json:"lastName"`
+	Email      string              `json:"email"`
+	Attributes map[string][]string `json:"attributes"`
+}
+
+// keycloakPageSize is the number of records requested per admin API page
+const keycloakPageSize = 100
+
+// keycloakClient holds the state needed to query the Keycloak admin REST API
+type keycloakClient struct {
+	httpClient *http.Client
+	baseURL    string
+	realm      string
+	token      string
+}
+
+// newKeycloakClient authenticates against the realm's token endpoint using
+// the client credentials grant of a service account client and returns a
+// client ready to query the admin REST API. The token request is retried on
+// quota and transient errors.
+func newKeycloakClient(
+	ctx context.Context,
+	baseURL string,
+	realm string,
+	clientID string,
+	clientSecret string,
+) (*keycloakClient, error) {
+	kc := &keycloakClient{
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		realm:      realm,
+	}
+
+	tokenURL := fmt.Sprintf(
+		"%s/realms/%s/protocol/openid-connect/token",
+		kc.baseURL, url.PathEscape(realm),
+	)
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", clientID)
+	form.Set("client_secret", clientSecret)
+
+	var token keycloakToken
+	err := withRetry(
+		ctx,
+		"Keycloak token request for client "+clientID,
+		func(ctx context.Context) error {
+			req, err := http.NewRequestWithContext(
+				ctx, http.MethodPost, tokenURL,
+				strings.NewReader(form.Encode()),
+			)
+			if err != nil {
+				return err
+			}
+			req.Header.Set(
+				"Content-Type", "application/x-www-form-urlencoded",
+			)
+
+			resp, err := kc.httpClient.Do(req)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			err = checkHTTPResponse(
+				resp, "Keycloak token request for client "+clientID,
+			)
+			if err != nil {
+				return err
+			}
+			return json.NewDecoder(resp.Body).Decode(&token)
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	kc.token = token.AccessToken
+	return kc, nil
+}
+
+// get performs an authenticated GET request against the admin REST API of
+// the configured realm and decodes the JSON response into out, retrying
+// quota and transient errors.
+func (kc *keycloakClient) get(
+	ctx context.Context,
+	path string,
+	out interface{},
+) error {
+	requestURL := fmt.Sprintf(
+		"%s/admin/realms/%s%s",
+		kc.baseURL, url.PathEscape(kc.realm), path,
+	)
+	return withRetry(
+		ctx,
+		"Keycloak API request "+requestURL,
+		func(ctx context.Context) error {
+			req, err := http.NewRequestWithContext(
+				ctx, http.MethodGet, requestURL, nil,
+			)
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Authorization", "Bearer "+kc.token)
+			req.Header.Set("Accept", "application/json")
+
+			resp, err := kc.httpClient.Do(req)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			err = checkHTTPResponse(resp, "Keycloak API request "+requestURL)
+			if err != nil {
+				return err
+			}
+			return json.NewDecoder(resp.Body).Decode(out)
+		},
+	)
+}
+
+// keycloakGroupByPath returns the admin API path resolving a group path such
+// as /engineering/platform team, escaping each segment so names holding
+// spaces, & or # still name the right group
+func keycloakGroupByPath(groupPath string) string {
+	segments := strings.Split(strings.Trim(groupPath, "/"), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return "/group-by-path/" + strings.Join(segments, "/")
+}
+
+// listUsers pages through the given user listing path, which is either the
+// realm's users or the members of a group, and returns every user found.
+func (kc *keycloakClient) listUsers(
+	ctx context.Context,
+	path string,
+) ([]keycloakUser, error) {
+	users := []keycloakUser{}
+	for first := 0; ; first += keycloakPageSize {
+		var page []keycloakUser
+		err := kc.get(
+			ctx,
+			fmt.Sprintf(
+				"%s?briefRepresentation=false&first=%d&max=%d",
+				path, first, keycloakPageSize,
+			),
+			&page,
+		)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, page...)
+
+		// A short page means there are no more results
+		if len(page) < keycloakPageSize {
+			return users, nil
+		}
+	}
+}
+
+// PullKeycloakUsers authenticates to Keycloak with a service account and
+// queries the admin REST API for either every user in the realm or the
+// members of the configured realm groups. Disabled users are skipped and the
+// SSH keys are read from the given multi-valued user attribute. Returns a
+// list of IAMUser objects.
+func PullKeycloakUsers(
+	ctx context.Context,
+	baseURL string,
+	realm string,
+	clientID string,
+	clientSecret string,
+	groups []string,
+	keyAttribute string,
+) ([]IAMUser, error) {
+	// keycloakUsers List of keycloakUser objects
+	var keycloakUsers = []IAMUser{}
+
+	kc, err := newKeycloakClient(
+		ctx, baseURL, realm, clientID, clientSecret,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Collect the users to sync, keyed by Keycloak user ID so a user
+	// belonging to several groups is only processed once
+	users := map[string]keycloakUser{}
+	userGroups := map[string][]string{}
+	userOrder := []string{}
+	collect := func(list []keycloakUser, group string) {
+		for _, u := range list {
+			if _, ok := users[u.ID]; !ok {
+				users[u.ID] = u
+				userOrder = append(userOrder, u.ID)
+			}
+			if group != "" {
+				userGroups[u.ID] = append(userGroups[u.ID], group)
+			}
+		}
+	}
+
+	if len(groups) == 0 {
+		realmUsers, err := kc.listUsers(ctx, "/users")
+		if err != nil {
+			return nil, err
+		}
+		collect(realmUsers, "")
+	}
+	for _, groupPath := range groups {
+		// Groups are configured by path, resolve them to their ID first
+		var group keycloakGroup
+		err := kc.get(ctx, keycloakGroupByPath(groupPath), &group)
+		if err != nil {
+			return nil, err
+		}
+
+		members, err := kc.listUsers(
+			ctx, "/groups/"+url.PathEscape(group.ID)+"/members",
+		)
+		if err != nil {
+			return nil, err
+		}
+		collect(members, group.Name)
+	}
+
+	for _, id := range userOrder {
+		u := users[id]
+		if !u.Enabled {
+			continue
+		}
+
+		keys := []string{}
+		for _, val := range u.Attributes[keyAttribute] {
+			key := strings.TrimSpace(val)
+			if key != "" {
+				keys = append(keys, key)
+			}
+		}
+
+		// Users without any SSH keys are not given a local account
+		if len(keys) == 0 {
+			continue
+		}
+
+		kUser := IAMUser{
+			username:   strings.ToLower(u.Username),
+			email:      u.Email,
+			publickeys: keys,
+			groups:     userGroups[id],
+			fullname:   strings.TrimSpace(u.FirstName + " " + u.LastName),
+		}
+		keycloakUsers = append(keycloakUsers, kUser)
+	}
+	return keycloakUsers, nil
+}
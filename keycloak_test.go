@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestKeycloakGroupByPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/engineering", "/group-by-path/engineering"},
+		{"engineering/platform/", "/group-by-path/engineering/platform"},
+		{"/R&D/platform team", "/group-by-path/R&D/platform%20team"},
+		{"/ops #1/on?call", "/group-by-path/ops%20%231/on%3Fcall"},
+	}
+	for _, tt := range tests {
+		if got := keycloakGroupByPath(tt.path); got != tt.want {
+			t.Errorf("%q: path = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
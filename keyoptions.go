@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// KeyOptionRule attaches OpenSSH authorized_keys options to the keys of the
+// listed users and the members of the listed directory groups
+type KeyOptionRule struct {
+	Groups           []string `yaml:"groups"`
+	Users            []string `yaml:"users"`
+	From             []string `yaml:"from"`
+	Command          string   `yaml:"command"`
+	Restrict         bool     `yaml:"restrict"`
+	NoPortForwarding bool     `yaml:"noportforwarding"`
+	ExpiryTime       string   `yaml:"expirytime"`
+}
+
+// expiryTimePattern matches the YYYYMMDD[HHMM[SS]][Z] timestamps sshd
+// accepts for expiry-time
+var expiryTimePattern = regexp.MustCompile(
+	`^[0-9]{8}([0-9]{4}([0-9]{2})?)?Z?$`,
+)
+
+// checkForUnsetKeyOptionsConfig validates the key option rules. Values are
+// written inside quoted options, so anything that could end the quotes or
+// the line is refused.
+func checkForUnsetKeyOptionsConfig() error {
+	for i, rule := range Cfg.KeyOptions {
+		if len(rule.Groups) == 0 && len(rule.Users) == 0 {
+			return fmt.Errorf("Key option rule %d requires groups or users", i)
+		}
+		for _, pattern := range rule.From {
+			if pattern == "" ||
+				strings.ContainsAny(pattern, "\", \t\r\n") {
+				return fmt.Errorf(
+					"Key option rule %d has invalid from pattern %q",
+					i, pattern,
+				)
+			}
+		}
+		// A trailing backslash would escape the closing quote
+		if strings.ContainsAny(rule.Command, "\r\n") ||
+			strings.HasSuffix(rule.Command, `\`) {
+			return fmt.Errorf(
+				"Key option rule %d has invalid command %q", i, rule.Command,
+			)
+		}
+		if rule.ExpiryTime != "" &&
+			!expiryTimePattern.MatchString(rule.ExpiryTime) {
+			return fmt.Errorf(
+				"Key option rule %d expiry time %s must be "+
+					"YYYYMMDD[HHMM[SS]][Z]",
+				i, rule.ExpiryTime,
+			)
+		}
+	}
+	return nil
+}
+
+// ruleMatches reports whether a key option rule applies to the user
+func ruleMatches(rule KeyOptionRule, u IAMUser) bool {
+	for _, username := range rule.Users {
+		if username == u.username {
+			return true
+		}
+	}
+	for _, g := range rule.Groups {
+		for _, userGroup := range u.groups {
+			if g == userGroup {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// keyOptionsFor renders the authorized_keys options of a user from every
+// matching rule. The first matching rule setting from, command or
+// expirytime wins, while restrict and noportforwarding apply if any
+// matching rule sets them.
+func keyOptionsFor(u IAMUser) string {
+	var from []string
+	command, expiry := "", ""
+	restrict, noPortForwarding := false, false
+	for _, rule := range Cfg.KeyOptions {
+		if !ruleMatches(rule, u) {
+			continue
+		}
+		if from == nil && len(rule.From) > 0 {
+			from = rule.From
+		}
+		if command == "" {
+			command = rule.Command
+		}
+		if expiry == "" {
+			expiry = rule.ExpiryTime
+		}
+		restrict = restrict || rule.Restrict
+		noPortForwarding = noPortForwarding || rule.NoPortForwarding
+	}
+
+	options := []string{}
+	if restrict {
+		options = append(options, "restrict")
+	}
+	if noPortForwarding {
+		options = append(options, "no-port-forwarding")
+	}
+	if len(from) > 0 {
+		options = append(
+			options, fmt.Sprintf(`from="%s"`, strings.Join(from, ",")),
+		)
+	}
+	if command != "" {
+		escaped := strings.ReplaceAll(command, `"`, `\"`)
+		options = append(options, fmt.Sprintf(`command="%s"`, escaped))
+	}
+	if expiry != "" {
+		options = append(options, fmt.Sprintf(`expiry-time="%s"`, expiry))
+	}
+	return strings.Join(options, ",")
+}
+
+// authorizedKeyLines returns the keys of a user as authorized_keys lines,
+// prefixed with the options of the matching key option rules
+func authorizedKeyLines(u IAMUser) []string {
+	options := keyOptionsFor(u)
+	if options == "" {
+		return u.publickeys
+	}
+	lines := []string{}
+	for _, key := range u.publickeys {
+		lines = append(lines, options+" "+key)
+	}
+	return lines
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestKeyOptionsFor(t *testing.T) {
+	previousCfg := Cfg
+	t.Cleanup(func() { Cfg = previousCfg })
+	Cfg = Config{KeyOptions: []KeyOptionRule{
+		{Users: []string{"deploy"},
+			Command:  `/usr/bin/deploy --message "release \"v1\"" C:\dir`,
+			Restrict: true},
+		{Groups: []string{"contractors"},
+			From:             []string{"10.0.0.0/8", "*.vpn.example.com"},
+			NoPortForwarding: true, ExpiryTime: "20270101"},
+		{Groups: []string{"contractors"}, From: []string{"0.0.0.0/0"},
+			Command: "/bin/false"},
+	}}
+
+	tests := []struct {
+		user IAMUser
+		want string
+	}{
+		{IAMUser{username: "ada"}, ""},
+		{IAMUser{username: "deploy"}, `restrict,command="/usr/bin/deploy ` +
+			`--message \"release \\"v1\\"\" C:\dir"`},
+		{IAMUser{username: "alan", groups: []string{"contractors"}},
+			`no-port-forwarding,from="10.0.0.0/8,*.vpn.example.com",` +
+				`command="/bin/false",expiry-time="20270101"`},
+	}
+	key := testPublicKey(t, "laptop")
+	for _, tt := range tests {
+		options := keyOptionsFor(tt.user)
+		if options != tt.want {
+			t.Errorf("%s: options = %s, want %s", tt.user.username,
+				options, tt.want)
+		}
+
+		// The line must still parse as the one key with every option
+		tt.user.publickeys = []string{key}
+		lines := authorizedKeyLines(tt.user)
+		if len(lines) != 1 {
+			t.Fatalf("%s: lines = %q, want one", tt.user.username, lines)
+		}
+		parsed, _, parsedOptions, rest, err := ssh.ParseAuthorizedKey(
+			[]byte(lines[0]),
+		)
+		if err != nil || len(rest) != 0 {
+			t.Errorf("%s: parsing %q: %v", tt.user.username, lines[0], err)
+			continue
+		}
+		if got := strings.TrimSpace(string(
+			ssh.MarshalAuthorizedKey(parsed),
+		)); !strings.HasPrefix(key, got) {
+			t.Errorf("%s: key = %s, want %s", tt.user.username, got, key)
+		}
+		if options != "" && strings.Join(parsedOptions, ",") != options {
+			t.Errorf("%s: parsed options = %q, want %s", tt.user.username,
+				parsedOptions, options)
+		}
+	}
+}
+
+func TestCheckForUnsetKeyOptionsConfig(t *testing.T) {
+	previousCfg := Cfg
+	t.Cleanup(func() { Cfg = previousCfg })
+
+	tests := []struct {
+		name    string
+		rule    KeyOptionRule
+		wantErr bool
+	}{
+		{"valid", KeyOptionRule{Users: []string{"deploy"},
+			Command: `echo "hi"`, From: []string{"10.0.0.0/8"},
+			ExpiryTime: "202701011200Z"}, false},
+		{"nobody", KeyOptionRule{Command: "/bin/true"}, true},
+		{"command newline", KeyOptionRule{Users: []string{"deploy"},
+			Command: "/bin/true\nssh-ed25519 AAAA"}, true},
+		{"command trailing backslash", KeyOptionRule{
+			Users: []string{"deploy"}, Command: `/bin/true \`}, true},
+		{"from quote", KeyOptionRule{Users: []string{"deploy"},
+			From: []string{`10.0.0.0/8",command="/bin/sh`}}, true},
+		{"from comma", KeyOptionRule{Users: []string{"deploy"},
+			From: []string{"10.0.0.1,10.0.0.2"}}, true},
+		{"from empty", KeyOptionRule{Users: []string{"deploy"},
+			From: []string{""}}, true},
+		{"expiry", KeyOptionRule{Users: []string{"deploy"},
+			ExpiryTime: "2027-01-01"}, true},
+	}
+	for _, tt := range tests {
+		Cfg = Config{KeyOptions: []KeyOptionRule{tt.rule}}
+		err := checkForUnsetKeyOptionsConfig()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %t", tt.name, err,
+				tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// KeyPolicyConfig defines which public keys are accepted from providers
+type KeyPolicyConfig struct {
+	Algorithms     []string `yaml:"algorithms"`
+	MinRSABits     int      `yaml:"minrsabits"`
+	HardwareGroups []string `yaml:"hardwaregroups"`
+	MaxKeys        int      `yaml:"maxkeys"`
+}
+
+// knownKeyAlgorithms lists the public key algorithms that can be allowed
+var knownKeyAlgorithms = []string{
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSA,
+	ssh.KeyAlgoSKED25519,
+	ssh.KeyAlgoSKECDSA256,
+	ssh.KeyAlgoDSA,
+}
+
+// checkForUnsetKeyPolicyConfig sets the default key policy, which allows
+// every algorithm but DSA, and validates the configured one
+func checkForUnsetKeyPolicyConfig() error {
+	policy := &Cfg.KeyPolicy
+	if len(policy.Algorithms) == 0 {
+		for _, algo := range knownKeyAlgorithms {
+			if algo != ssh.KeyAlgoDSA {
+				policy.Algorithms = append(policy.Algorithms, algo)
+			}
+		}
+	}
+	for _, algo := range policy.Algorithms {
+		known := false
+		for _, k := range knownKeyAlgorithms {
+			known = known || algo == k
+		}
+		if !known {
+			return fmt.Errorf(
+				"Key algorithm %s not supported! Available choices: %s",
+				algo, strings.Join(knownKeyAlgorithms, ", "),
+			)
+		}
+	}
+	if policy.MinRSABits == 0 {
+		policy.MinRSABits = 2048
+	}
+	if policy.MaxKeys < 0 {
+		return fmt.Errorf("Max keys %d can't be negative", policy.MaxKeys)
+	}
+	return nil
+}
+
+// checkKey parses a single authorized_keys line and checks it against the
+// key policy. It returns the key in canonical form, or the reason it was
+// rejected.
+func checkKey(line string, hardwareOnly bool) (string, ssh.PublicKey, string) {
+	key, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return "", nil, "it is not a valid public key"
+	}
+
+	allowed := false
+	for _, algo := range Cfg.KeyPolicy.Algorithms {
+		allowed = allowed || key.Type() == algo
+	}
+	if !allowed {
+		return "", nil, fmt.Sprintf(
+			"the %s algorithm is not allowed", key.Type(),
+		)
+	}
+
+	if cryptoKey, ok := key.(ssh.CryptoPublicKey); ok {
+		rsaKey, isRSA := cryptoKey.CryptoPublicKey().(*rsa.PublicKey)
+		if isRSA && rsaKey.N.BitLen() < Cfg.KeyPolicy.MinRSABits {
+			return "", nil, fmt.Sprintf(
+				"the RSA key is %d bits, at least %d are required",
+				rsaKey.N.BitLen(), Cfg.KeyPolicy.MinRSABits,
+			)
+		}
+	}
+
+	if hardwareOnly && !strings.HasPrefix(key.Type(), "sk-") {
+		return "", nil, "a hardware backed sk- key is required"
+	}
+
+	// Options are only ever applied from the configuration
+	if len(options) > 0 {
+		globalLogger.Info(
+			"Ignoring options %s set on key %s\n",
+			strings.Join(options, ","), ssh.FingerprintSHA256(key),
+		)
+	}
+
+	canonical := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	if comment != "" {
+		canonical += " " + comment
+	}
+	return canonical, key, ""
+}
+
+// applyKeyPolicy validates the keys of every user, logging and excluding
+// the rejected ones. Keys are deduplicated and capped at the maximum per
+// user. Users left without any key are kept with no keys, so a key the
+// policy newly rejects never deletes an account and its home, and are
+// reported as failed by the sync.
+func applyKeyPolicy(users []IAMUser) []IAMUser {
+	hardwareGroups := map[string]bool{}
+	for _, g := range Cfg.KeyPolicy.HardwareGroups {
+		hardwareGroups[g] = true
+	}
+
+	valid := []IAMUser{}
+	for _, u := range users {
+		hardwareOnly := false
+		for _, g := range u.groups {
+			hardwareOnly = hardwareOnly || hardwareGroups[g]
+		}
+
+		keys := []string{}
+		seen := map[string]bool{}
+		for _, entry := range u.publickeys {
+			// Never log the entry itself, it may hold a private key
+			if strings.Contains(entry, "PRIVATE KEY") {
+				globalLogger.Error(
+					"Rejected a key of user %s as it looks like a private "+
+						"key\n",
+					u.username,
+				)
+				continue
+			}
+
+			// A single attribute may hold several keys, one per line
+			for _, line := range strings.Split(entry, "\n") {
+				line = strings.TrimSpace(line)
+				if line == "" || strings.HasPrefix(line, "#") {
+					continue
+				}
+
+				canonical, key, reason := checkKey(line, hardwareOnly)
+				if reason != "" {
+					globalLogger.Error(
+						"Rejected a key of user %s as %s\n",
+						u.username, reason,
+					)
+					continue
+				}
+				fingerprint := ssh.FingerprintSHA256(key)
+				if seen[fingerprint] {
+					continue
+				}
+				seen[fingerprint] = true
+
+				if Cfg.KeyPolicy.MaxKeys > 0 &&
+					len(keys) >= Cfg.KeyPolicy.MaxKeys {
+					globalLogger.Error(
+						"Rejected key %s of user %s as the user already "+
+							"has %d keys\n",
+						fingerprint, u.username, Cfg.KeyPolicy.MaxKeys,
+					)
+					continue
+				}
+				keys = append(keys, canonical)
+			}
+		}
+
+		if len(keys) == 0 {
+			globalLogger.Error(
+				"User %s has no key allowed by the key policy, removing "+
+					"their keys\n",
+				u.username,
+			)
+			u.keysRejected = true
+		}
+		u.publickeys = keys
+		valid = append(valid, u)
+	}
+	return valid
+}
@@ -12,6 +12,8 @@ type Logger struct {
 	fileHandle  *os.File
 	infoLogger  *log.Logger
 	errorLogger *log.Logger
+	debugLogger *log.Logger
+	debug       bool
 }
 
 // Info prints and logs a specified info message
@@ -19,11 +21,31 @@ func (l *Logger) Info(format string, v ...interface{}) {
 	l.infoLogger.Printf(format, v...)
 }
 
+// Debug prints and logs a specified debug message, only when debug logging
+// is enabled
+func (l *Logger) Debug(format string, v ...interface{}) {
+	if l.debug {
+		l.debugLogger.Printf(format, v...)
+	}
+}
+
+// SetDebug enables or disables debug messages
+func (l *Logger) SetDebug(enabled bool) {
+	l.debug = enabled
+}
+
 // Error prints and logs a specified error message
 func (l *Logger) Error(format string, v ...interface{}) {
 	l.errorLogger.Printf(format, v...)
 }
 
+// RedirectInfoToStderr sends info and debug messages to stderr instead of
+// stdout, for subcommands whose stdout is read by another program
+func (l *Logger) RedirectInfoToStderr() {
+	l.infoLogger.SetOutput(io.MultiWriter(os.Stderr, l.fileHandle))
+	l.debugLogger.SetOutput(io.MultiWriter(os.Stderr, l.fileHandle))
+}
+
 // CloseFile closes the file handle
 func (l *Logger) CloseFile() error {
 	return l.fileHandle.Close()
@@ -62,5 +84,10 @@ func NewFileLogger(path string) (*Logger, error) {
 			"ERROR: ",
 			log.Ldate|log.Ltime|log.Lmsgprefix,
 		),
+		debugLogger: log.New(
+			infoMultiWriter,
+			"DEBUG: ",
+			log.Ldate|log.Ltime|log.Lmsgprefix,
+		),
 	}, nil
 }
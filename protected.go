@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+)
+
+// ProtectedConfig defines accounts that are never created, modified or
+// deleted, on top of root and the system accounts
+type ProtectedConfig struct {
+	Users   []string `yaml:"users"`
+	Pattern string   `yaml:"pattern"`
+	Shells  []string `yaml:"shells"`
+}
+
+// protectedPattern is the compiled protected username pattern, if any
+var protectedPattern *regexp.Regexp
+
+// checkForUnsetProtectedConfig compiles the protected username pattern and
+// validates the protected shells
+func checkForUnsetProtectedConfig() error {
+	protectedPattern = nil
+	if Cfg.Protected.Pattern != "" {
+		pattern, err := regexp.Compile(Cfg.Protected.Pattern)
+		if err != nil {
+			return fmt.Errorf(
+				"Protected pattern %s is invalid: %v",
+				Cfg.Protected.Pattern, err,
+			)
+		}
+		protectedPattern = pattern
+	}
+	for _, shell := range Cfg.Protected.Shells {
+		if !filepath.IsAbs(shell) {
+			return fmt.Errorf("Protected shell %s must be absolute", shell)
+		}
+	}
+	return nil
+}
+
+// protectedName returns why a username is protected, or an empty string.
+// It only looks at the name, so it also applies to accounts that don't
+// exist yet.
+func protectedName(username string) string {
+	if username == "root" {
+		return "it is root"
+	}
+	for _, protected := range Cfg.Protected.Users {
+		if username == protected {
+			return "it is listed in protected users"
+		}
+	}
+	if protectedPattern != nil && protectedPattern.MatchString(username) {
+		return "it matches the protected pattern"
+	}
+	return ""
+}
+
+// protectedAccount returns why an account is protected, or an empty string.
+// On top of the name, the UID and shell of an existing account are checked,
+// as accounts up to SYS_UID_MAX belong to the system. An account that can't
+// be looked up is treated as protected.
+func protectedAccount(username string) string {
+	if reason := protectedName(username); reason != "" {
+		return reason
+	}
+
+	account, err := accountBackend.LookupUser(username)
+	if errors.Is(err, ErrUnknownAccount) {
+		return ""
+	}
+	if err != nil {
+		return fmt.Sprintf("it could not be looked up: %v", err)
+	}
+
+	defs, _ := readKeyValueFile(
+		filepath.Join(Cfg.Root, "/etc/login.defs"), "",
+	)
+	sysUIDMax := loginDefsInt(defs, "SYS_UID_MAX", 999)
+	if account.UID == 0 {
+		return "it has UID 0"
+	}
+	if account.UID <= sysUIDMax {
+		return fmt.Sprintf(
+			"its UID %d is a system UID, up to %d", account.UID, sysUIDMax,
+		)
+	}
+	for _, shell := range Cfg.Protected.Shells {
+		if account.Shell == shell {
+			return fmt.Sprintf("its shell %s is protected", shell)
+		}
+	}
+	return ""
+}
+
+// filterProtectedUsers drops the IAM users whose accounts are protected, so
+// they are neither created nor updated, and their keys never published
+func filterProtectedUsers(users []IAMUser) []IAMUser {
+	allowed := []IAMUser{}
+	for _, u := range users {
+		if reason := protectedAccount(u.username); reason != "" {
+			globalLogger.Error(
+				"REFUSING to manage protected account %s as %s\n",
+				u.username, reason,
+			)
+			continue
+		}
+		allowed = append(allowed, u)
+	}
+	return allowed
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProtectedAccount(t *testing.T) {
+	previousCfg := Cfg
+	previousBackend := accountBackend
+	t.Cleanup(func() {
+		Cfg = previousCfg
+		accountBackend = previousBackend
+		protectedPattern = nil
+	})
+	useTestLogger(t)
+
+	root := t.TempDir()
+	files := map[string]string{
+		passwdFile: "root:x:0:0:root:/root:/bin/bash\n" +
+			"toor:x:0:0::/root:/bin/sh\n" +
+			"daemon:x:1:1::/usr/sbin:/usr/sbin/nologin\n" +
+			"svc:x:1500:1500::/srv/svc:/bin/sh\n" +
+			"ada:x:2000:2000::/home/ada:/bin/bash\n" +
+			"kiosk:x:2001:2001::/home/kiosk:/usr/bin/kiosk\n",
+		"/etc/login.defs": "SYS_UID_MAX 1500\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	accountBackend = nativeBackend{root: root}
+	Cfg = Config{Root: root, Protected: ProtectedConfig{
+		Users:   []string{"deploy"},
+		Pattern: "^svc-",
+		Shells:  []string{"/usr/bin/kiosk"},
+	}}
+	if err := checkForUnsetProtectedConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		username  string
+		protected bool
+	}{
+		{"root", true},
+		{"deploy", true},
+		{"svc-backup", true},
+		{"toor", true},
+		{"daemon", true},
+		{"svc", true},
+		{"kiosk", true},
+		{"ada", false},
+		{"grace", false},
+	}
+	for _, tt := range tests {
+		reason := protectedAccount(tt.username)
+		if (reason != "") != tt.protected {
+			t.Errorf("%s: reason = %q, want protected %t", tt.username,
+				reason, tt.protected)
+		}
+	}
+
+	users := filterProtectedUsers([]IAMUser{
+		{username: "ada"}, {username: "toor"}, {username: "grace"},
+		{username: "deploy"},
+	})
+	if len(users) != 2 || users[0].username != "ada" ||
+		users[1].username != "grace" {
+		t.Errorf("users = %+v, want ada and grace", users)
+	}
+
+	// An account that can't be looked up is never touched
+	if err := os.Remove(filepath.Join(root, passwdFile)); err != nil {
+		t.Fatal(err)
+	}
+	if protectedAccount("ada") == "" {
+		t.Error("ada not protected although passwd can't be read")
+	}
+}
+
+func TestCheckForUnsetProtectedConfig(t *testing.T) {
+	previousCfg := Cfg
+	t.Cleanup(func() {
+		Cfg = previousCfg
+		protectedPattern = nil
+	})
+
+	tests := []struct {
+		protected ProtectedConfig
+		wantErr   bool
+	}{
+		{ProtectedConfig{Pattern: "^svc-", Shells: []string{"/bin/false"}},
+			false},
+		{ProtectedConfig{Pattern: "^svc-("}, true},
+		{ProtectedConfig{Shells: []string{"nologin"}}, true},
+	}
+	for _, tt := range tests {
+		Cfg = Config{Protected: tt.protected}
+		err := checkForUnsetProtectedConfig()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%+v: error = %v, want error %t", tt.protected, err,
+				tt.wantErr)
+		}
+	}
+}
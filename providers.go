@@ -0,0 +1,734 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ProviderOptions defines parameters for specified provider
+type ProviderOptions struct {
+	Credentials        string `yaml:"credentials"`
+	CustomAttributeKey string `yaml:"customattributekey"`
+	Email              string `yaml:"gsuiteadmin"`
+	Domain             string `yaml:"oauthdomain"`
+	GsuiteEndpoint     string `yaml:"gsuiteendpoint"`
+
+	GsuiteAuth           string `yaml:"gsuiteauth"`
+	GsuiteServiceAccount string `yaml:"gsuiteserviceaccount"`
+
+	GitlabURL            string   `yaml:"gitlaburl"`
+	GitlabToken          string   `yaml:"gitlabtoken"`
+	GitlabGroups         []string `yaml:"gitlabgroups"`
+	GitlabMinAccessLevel int      `yaml:"gitlabminaccesslevel"`
+
+	KeycloakURL          string   `yaml:"keycloakurl"`
+	KeycloakRealm        string   `yaml:"keycloakrealm"`
+	KeycloakClientID     string   `yaml:"keycloakclientid"`
+	KeycloakClientSecret string   `yaml:"keycloakclientsecret"`
+	KeycloakGroups       []string `yaml:"keycloakgroups"`
+	KeycloakKeyAttribute string   `yaml:"keycloakkeyattribute"`
+
+	File              string `yaml:"file"`
+	FileWatch         bool   `yaml:"filewatch"`
+	FileWatchInterval int    `yaml:"filewatchinterval"`
+
+	HTTP HTTPProviderOptions `yaml:",inline"`
+
+	SCIMListen  string `yaml:"scimlisten"`
+	SCIMToken   string `yaml:"scimtoken"`
+	SCIMState   string `yaml:"scimstate"`
+	SCIMTLSCert string `yaml:"scimtlscert"`
+	SCIMTLSKey  string `yaml:"scimtlskey"`
+}
+
+// ProviderConfig defines a single provider instance. Several instances can
+// be configured to merge users from multiple providers in one sync run.
+type ProviderConfig struct {
+	Name            string          `yaml:"name"`
+	Provider        string          `yaml:"provider"`
+	Priority        int             `yaml:"priority"`
+	ProviderOptions ProviderOptions `yaml:"provider-options"`
+}
+
+// supportedProviders lists the providers that can be configured
+var supportedProviders = []string{
+	"GSUITE", "GITLAB", "KEYCLOAK", "FILE", "HTTP", "SCIM",
+}
+
+// providerNamePattern matches the names a provider instance may have. The
+// name is used in file names under statedir, so it can't hold a path.
+var providerNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// providerNames returns the configured provider instance names
+func providerNames() string {
+	names := []string{}
+	for _, p := range Cfg.Providers {
+		names = append(names, p.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+// findProvider returns the first configured instance of the given provider,
+// or nil if there is none
+func findProvider(provider string) *ProviderConfig {
+	for i := range Cfg.Providers {
+		if Cfg.Providers[i].Provider == provider {
+			return &Cfg.Providers[i]
+		}
+	}
+	return nil
+}
+
+// logProviderConfig logs the settings of a provider instance
+func logProviderConfig(p ProviderConfig) {
+	globalLogger.Info(
+		"Provider %s configuration settings: "+
+			"Provider: %s | Priority: %d\n",
+		p.Name, p.Provider, p.Priority,
+	)
+	switch p.Provider {
+	case "GSUITE":
+		globalLogger.Info(
+			"GSUITE configuration settings: "+
+				"Email: %s | Domain: %s | "+
+				"Custom Attribute Key: %s | Path To Credentials: %s | "+
+				"Endpoint: %s | Auth: %s | Service Account: %s\n",
+			p.ProviderOptions.Email,
+			p.ProviderOptions.Domain,
+			p.ProviderOptions.CustomAttributeKey,
+			p.ProviderOptions.Credentials,
+			p.ProviderOptions.GsuiteEndpoint,
+			p.ProviderOptions.GsuiteAuth,
+			p.ProviderOptions.GsuiteServiceAccount,
+		)
+	case "GITLAB":
+		globalLogger.Info(
+			"GITLAB configuration settings: "+
+				"URL: %s | Groups: %s | Minimum Access Level: %d\n",
+			p.ProviderOptions.GitlabURL,
+			strings.Join(p.ProviderOptions.GitlabGroups, ","),
+			p.ProviderOptions.GitlabMinAccessLevel,
+		)
+	case "KEYCLOAK":
+		globalLogger.Info(
+			"KEYCLOAK configuration settings: "+
+				"URL: %s | Realm: %s | Client ID: %s | Groups: %s | "+
+				"Key Attribute: %s\n",
+			p.ProviderOptions.KeycloakURL,
+			p.ProviderOptions.KeycloakRealm,
+			p.ProviderOptions.KeycloakClientID,
+			strings.Join(p.ProviderOptions.KeycloakGroups, ","),
+			p.ProviderOptions.KeycloakKeyAttribute,
+		)
+	case "FILE":
+		globalLogger.Info(
+			"FILE configuration settings: "+
+				"Path: %s | Watch: %t | Watch Interval: %ds\n",
+			p.ProviderOptions.File,
+			p.ProviderOptions.FileWatch,
+			p.ProviderOptions.FileWatchInterval,
+		)
+	case "HTTP":
+		globalLogger.Info(
+			"HTTP configuration settings: "+
+				"URL: %s | Pagination: %s | Users Path: %s | "+
+				"Username Path: %s | Keys Path: %s | Signed: %t\n",
+			p.ProviderOptions.HTTP.URL,
+			p.ProviderOptions.HTTP.Pagination,
+			p.ProviderOptions.HTTP.UsersPath,
+			p.ProviderOptions.HTTP.UsernamePath,
+			p.ProviderOptions.HTTP.KeysPath,
+			p.ProviderOptions.HTTP.SignatureKey != "",
+		)
+	case "SCIM":
+		globalLogger.Info(
+			"SCIM configuration settings: "+
+				"Listen: %s | State: %s | TLS: %t\n",
+			p.ProviderOptions.SCIMListen,
+			p.ProviderOptions.SCIMState,
+			p.ProviderOptions.SCIMTLSCert != "",
+		)
+	}
+}
+
+// CheckForUnsetProviderConfig builds the list of provider instances, falling
+// back to the single provider and provider-options settings when no
+// providers list is configured. Each instance is then validated and sorted
+// by priority.
+func CheckForUnsetProviderConfig() error {
+	if len(Cfg.Providers) == 0 {
+		if Cfg.Provider == "" {
+			providerMissingError := errors.New(
+				"IAM Provider must be set. Please use --provider GSUITE " +
+					"or set the value using --config /path/to/config.yml.",
+			)
+			return providerMissingError
+		}
+		Cfg.Providers = []ProviderConfig{{
+			Name:            strings.ToLower(Cfg.Provider),
+			Provider:        Cfg.Provider,
+			ProviderOptions: Cfg.ProviderOptions,
+		}}
+	}
+
+	names := map[string]bool{}
+	for i := range Cfg.Providers {
+		p := &Cfg.Providers[i]
+		p.Provider = strings.ToUpper(p.Provider)
+		if p.Name == "" {
+			p.Name = strings.ToLower(p.Provider)
+		}
+		if !providerNamePattern.MatchString(p.Name) {
+			return fmt.Errorf(
+				"Provider name %q is invalid. Names may only contain "+
+					"letters, digits, _ and -.", p.Name,
+			)
+		}
+		if names[p.Name] {
+			return fmt.Errorf(
+				"Provider name %s is used more than once. Each entry in "+
+					"providers must have a unique name.", p.Name,
+			)
+		}
+		names[p.Name] = true
+
+		err := checkForUnsetProviderOptions(p)
+		if err != nil {
+			return fmt.Errorf("provider %s: %v", p.Name, err)
+		}
+	}
+
+	// Lower priority values are pulled and merged first
+	sort.SliceStable(Cfg.Providers, func(i, j int) bool {
+		return Cfg.Providers[i].Priority < Cfg.Providers[j].Priority
+	})
+
+	if Cfg.IdentityKey == "" {
+		Cfg.IdentityKey = "username"
+	}
+	if Cfg.IdentityKey != "username" && Cfg.IdentityKey != "email" {
+		return fmt.Errorf(
+			"Identity key %s not supported, use username or email",
+			Cfg.IdentityKey,
+		)
+	}
+	if Cfg.ConflictPolicy == "" {
+		Cfg.ConflictPolicy = "first"
+	}
+	switch Cfg.ConflictPolicy {
+	case "first", "union", "error":
+	default:
+		return fmt.Errorf(
+			"Conflict policy %s not supported, use first, union or error",
+			Cfg.ConflictPolicy,
+		)
+	}
+	return nil
+}
+
+// checkForUnsetProviderOptions validates and sets defaults for the options
+// of a single provider instance
+func checkForUnsetProviderOptions(p *ProviderConfig) error {
+	switch p.Provider {
+	case "GSUITE":
+		return checkForUnsetGsuiteConfig(&p.ProviderOptions)
+	case "GITLAB":
+		return checkForUnsetGitlabConfig(&p.ProviderOptions)
+	case "KEYCLOAK":
+		return checkForUnsetKeycloakConfig(&p.ProviderOptions)
+	case "FILE":
+		return checkForUnsetFileConfig(&p.ProviderOptions)
+	case "HTTP":
+		return checkForUnsetHTTPConfig(&p.ProviderOptions)
+	case "SCIM":
+		return checkForUnsetSCIMConfig(&p.ProviderOptions)
+	}
+	return fmt.Errorf(
+		"Provider %s not supported! Available choices: %s",
+		p.Provider, strings.Join(supportedProviders, ", "),
+	)
+}
+
+// checkForUnsetGsuiteConfig validates and sets defaults for the GSUITE
+// provider options
+func checkForUnsetGsuiteConfig(opts *ProviderOptions) error {
+	// gsuiteadmin must be set either on the CLI or in config.yml
+	if opts.Email == "" {
+		emailMissingError := errors.New(
+			"If the IAM provider is GSuite (Google Workspace) then you must " +
+				"supply the super admin user's email address that originally " +
+				"delegated the serviceaccount OAuth scopes.",
+		)
+		return emailMissingError
+	}
+	if opts.GsuiteAuth == "" {
+		opts.GsuiteAuth = "key"
+	}
+	switch opts.GsuiteAuth {
+	case "key", "adc", "signjwt":
+	default:
+		return fmt.Errorf(
+			"GSuite auth %s not supported, use one of: %s",
+			opts.GsuiteAuth, strings.Join(gsuiteAuthModes, ", "),
+		)
+	}
+	// Application Default Credentials are looked up when no credentials
+	// file is given, only a service account key has to be a file
+	if opts.Credentials == "" && opts.GsuiteAuth == "key" {
+		credentialsMissingError := errors.New(
+			"IAM Provider service account credentials must be present. " +
+				"Use --credentials <path> or set the value in config.yml.",
+		)
+		return credentialsMissingError
+	}
+	if opts.GsuiteAuth == "signjwt" &&
+		!strings.Contains(opts.GsuiteServiceAccount, "@") {
+		return errors.New(
+			"GSuite auth signjwt needs the email address of the service " +
+				"account to sign for in gsuiteserviceaccount.",
+		)
+	}
+	at := strings.LastIndex(opts.Email, "@")
+	if at < 1 || at == len(opts.Email)-1 {
+		return fmt.Errorf(
+			"GSuite admin %q must be the email address of the super admin "+
+				"user that delegated the serviceaccount OAuth scopes.",
+			opts.Email,
+		)
+	}
+	if opts.Domain == "" {
+		opts.Domain = opts.Email[at+1:]
+
+		log.Printf(
+			"Using domain for user lookup: %s\n",
+			opts.Domain,
+		)
+	}
+	if opts.GsuiteEndpoint != "" {
+		endpoint, err := url.Parse(opts.GsuiteEndpoint)
+		if err != nil || endpoint.Host == "" ||
+			(endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+			return fmt.Errorf(
+				"GSuite endpoint %s must be an http or https URL",
+				opts.GsuiteEndpoint,
+			)
+		}
+		// API paths are resolved relative to the endpoint
+		if !strings.HasSuffix(opts.GsuiteEndpoint, "/") {
+			opts.GsuiteEndpoint += "/"
+		}
+	}
+	if opts.CustomAttributeKey == "" {
+		opts.CustomAttributeKey = "SSHKEY"
+		log.Printf(
+			"Gsuite User CustomAttributeKey not specified. Using default: %s\n",
+			opts.CustomAttributeKey,
+		)
+	}
+	return nil
+}
+
+// checkForUnsetGitlabConfig validates and sets defaults for the GITLAB
+// provider options
+func checkForUnsetGitlabConfig(opts *ProviderOptions) error {
+	if opts.GitlabToken == "" {
+		tokenMissingError := errors.New(
+			"If the IAM provider is GitLab then a personal or group access " +
+				"token must be set using gitlabtoken in config.yml.",
+		)
+		return tokenMissingError
+	}
+	if len(opts.GitlabGroups) == 0 {
+		groupsMissingError := errors.New(
+			"If the IAM provider is GitLab then at least one group must be " +
+				"set using gitlabgroups in config.yml.",
+		)
+		return groupsMissingError
+	}
+	if opts.GitlabURL == "" {
+		opts.GitlabURL = "https://gitlab.com"
+		log.Printf(
+			"GitLab URL not specified. Using default: %s\n",
+			opts.GitlabURL,
+		)
+	}
+	if opts.GitlabMinAccessLevel == 0 {
+		// 10 is the Guest access level, the lowest level a member can hold
+		opts.GitlabMinAccessLevel = 10
+		log.Printf(
+			"GitLab minimum access level not specified. Using default: %d\n",
+			opts.GitlabMinAccessLevel,
+		)
+	}
+	return nil
+}
+
+// checkForUnsetKeycloakConfig validates and sets defaults for the KEYCLOAK
+// provider options
+func checkForUnsetKeycloakConfig(opts *ProviderOptions) error {
+	if opts.KeycloakURL == "" ||
+		opts.KeycloakRealm == "" {
+		realmMissingError := errors.New(
+			"If the IAM provider is Keycloak then keycloakurl and " +
+				"keycloakrealm must be set in config.yml.",
+		)
+		return realmMissingError
+	}
+	if opts.KeycloakClientID == "" ||
+		opts.KeycloakClientSecret == "" {
+		clientMissingError := errors.New(
+			"If the IAM provider is Keycloak then the service account " +
+				"keycloakclientid and keycloakclientsecret must be set " +
+				"in config.yml.",
+		)
+		return clientMissingError
+	}
+	if opts.KeycloakKeyAttribute == "" {
+		opts.KeycloakKeyAttribute = "sshPublicKey"
+		log.Printf(
+			"Keycloak key attribute not specified. Using default: %s\n",
+			opts.KeycloakKeyAttribute,
+		)
+	}
+	return nil
+}
+
+// checkForUnsetFileConfig validates and sets defaults for the FILE
+// provider options
+func checkForUnsetFileConfig(opts *ProviderOptions) error {
+	if opts.File == "" {
+		fileMissingError := errors.New(
+			"If the IAM provider is FILE then the path to the roster file " +
+				"or directory must be set using file in config.yml.",
+		)
+		return fileMissingError
+	}
+	if opts.FileWatchInterval == 0 {
+		opts.FileWatchInterval = 30
+		if opts.FileWatch {
+			log.Printf(
+				"File watch interval not specified. Using default: %ds\n",
+				opts.FileWatchInterval,
+			)
+		}
+	}
+	return nil
+}
+
+// checkForUnsetHTTPConfig validates and sets defaults for the HTTP
+// provider options
+func checkForUnsetHTTPConfig(opts *ProviderOptions) error {
+	httpOpts := &opts.HTTP
+	if httpOpts.URL == "" || httpOpts.UsernamePath == "" ||
+		httpOpts.KeysPath == "" {
+		mappingMissingError := errors.New(
+			"If the IAM provider is HTTP then httpurl, httpusernamepath and " +
+				"httpkeyspath must be set in config.yml.",
+		)
+		return mappingMissingError
+	}
+	if (httpOpts.ClientCert == "") != (httpOpts.ClientKey == "") {
+		clientCertError := errors.New(
+			"Both httpclientcert and httpclientkey must be set to use mTLS.",
+		)
+		return clientCertError
+	}
+	if httpOpts.UsersPath == "" {
+		httpOpts.UsersPath = "$"
+		log.Printf(
+			"HTTP users path not specified. Default: %s\n",
+			httpOpts.UsersPath,
+		)
+	}
+
+	switch strings.ToLower(httpOpts.Pagination) {
+	case "", "none", "link":
+	case "cursor":
+		if httpOpts.CursorPath == "" {
+			cursorMissingError := errors.New(
+				"If httppagination is cursor then httpcursorpath must be set " +
+					"in config.yml.",
+			)
+			return cursorMissingError
+		}
+		if httpOpts.CursorParam == "" {
+			httpOpts.CursorParam = "cursor"
+			log.Printf(
+				"HTTP cursor parameter not specified. Default: %s\n",
+				httpOpts.CursorParam,
+			)
+		}
+	default:
+		return fmt.Errorf(
+			"HTTP pagination %s not supported, use none, link or cursor",
+			httpOpts.Pagination,
+		)
+	}
+
+	if httpOpts.StatusPath != "" && len(httpOpts.ActiveStatuses) == 0 {
+		httpOpts.ActiveStatuses = []string{"active"}
+		log.Printf(
+			"HTTP active statuses not specified. Default: %s\n",
+			strings.Join(httpOpts.ActiveStatuses, ","),
+		)
+	}
+	if httpOpts.SignatureKey != "" && httpOpts.SignatureHeader == "" {
+		httpOpts.SignatureHeader = "X-Signature"
+		log.Printf(
+			"HTTP signature header not specified. Default: %s\n",
+			httpOpts.SignatureHeader,
+		)
+	}
+	return nil
+}
+
+// checkForUnsetSCIMConfig validates and sets defaults for the SCIM
+// provider options
+func checkForUnsetSCIMConfig(opts *ProviderOptions) error {
+	if opts.SCIMToken == "" {
+		tokenMissingError := errors.New(
+			"If the IAM provider is SCIM then the bearer token identity " +
+				"providers authenticate with must be set using scimtoken " +
+				"in config.yml.",
+		)
+		return tokenMissingError
+	}
+	if (opts.SCIMTLSCert == "") !=
+		(opts.SCIMTLSKey == "") {
+		tlsError := errors.New(
+			"Both scimtlscert and scimtlskey must be set to serve SCIM " +
+				"over TLS.",
+		)
+		return tlsError
+	}
+	if opts.SCIMListen == "" {
+		opts.SCIMListen = "127.0.0.1:8080"
+		log.Printf(
+			"SCIM listen address not specified. Default: %s\n",
+			opts.SCIMListen,
+		)
+	}
+	if opts.SCIMState == "" {
+		opts.SCIMState = "/var/lib/iamusersync/scim.json"
+		log.Printf(
+			"SCIM state file not specified. Default: %s\n",
+			opts.SCIMState,
+		)
+	}
+	return nil
+}
+
+// PullUsersFromProvider determines which class to use given a configured
+// provider instance. Requests to the provider's API are made within ctx.
+func PullUsersFromProvider(
+	ctx context.Context,
+	p ProviderConfig,
+) ([]IAMUser, error) {
+	opts := p.ProviderOptions
+	switch p.Provider {
+	case "GSUITE":
+		return PullGsuiteUsers(
+			ctx,
+			opts.Email,
+			opts.Domain,
+			opts.CustomAttributeKey,
+			opts.GsuiteAuth,
+			opts.Credentials,
+			opts.GsuiteServiceAccount,
+			opts.GsuiteEndpoint,
+			gsuiteHTTPClient,
+		)
+	case "GITLAB":
+		return PullGitlabUsers(
+			ctx,
+			opts.GitlabURL,
+			opts.GitlabToken,
+			opts.GitlabGroups,
+			opts.GitlabMinAccessLevel,
+		)
+	case "KEYCLOAK":
+		return PullKeycloakUsers(
+			ctx,
+			opts.KeycloakURL,
+			opts.KeycloakRealm,
+			opts.KeycloakClientID,
+			opts.KeycloakClientSecret,
+			opts.KeycloakGroups,
+			opts.KeycloakKeyAttribute,
+		)
+	case "FILE":
+		return PullFileUsers(opts.File)
+	case "HTTP":
+		return PullHTTPUsers(ctx, opts.HTTP)
+	case "SCIM":
+		return PullSCIMUsers(opts.SCIMState)
+	}
+	return nil, fmt.Errorf("provider %s not supported", p.Provider)
+}
+
+// PullUsersFromIAM pulls the users from every configured provider instance,
+// falling back to each provider's cache where needed, and merges them into a
+// single list. Each user is tagged with the name of the provider that
+// sourced it, usernames are sanitized before merging, and every key is
+// checked against the key policy. When several providers are configured, a
+// failing provider is logged and returned in the failed set so its users are
+// not deleted, an error is only returned if every provider failed.
+func PullUsersFromIAM() ([]IAMUser, map[string]bool, error) {
+	failed := map[string]bool{}
+	results := [][]IAMUser{}
+	var lastErr error
+
+	for _, p := range Cfg.Providers {
+		users, err := PullUsersWithCache(p)
+		if err != nil {
+			if len(Cfg.Providers) == 1 {
+				return nil, nil, err
+			}
+			globalLogger.Error(
+				"Issue pulling users from provider %s: %v\n", p.Name, err,
+			)
+			failed[p.Name] = true
+			lastErr = err
+			continue
+		}
+		for i := range users {
+			users[i].provider = p.Name
+		}
+		results = append(results, sanitizeUsernames(users))
+	}
+	if len(failed) == len(Cfg.Providers) {
+		return nil, nil, fmt.Errorf("every provider failed, last: %v", lastErr)
+	}
+
+	users, err := mergeProviderUsers(
+		results, Cfg.IdentityKey, Cfg.ConflictPolicy,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	return applyKeyPolicy(users), failed, nil
+}
+
+// identityOf returns the value users are merged by. Users without an email
+// address fall back to their username.
+func identityOf(u IAMUser, identityKey string) string {
+	if identityKey == "email" && u.email != "" {
+		return strings.ToLower(u.email)
+	}
+	return u.username
+}
+
+// sameUserConflict returns why two records of the same identity can't be
+// the same user, or an empty string if they can: records returned by one
+// provider are different users, and so are records with different email
+// addresses, even if they map to the same username
+func sameUserConflict(first IAMUser, other IAMUser) string {
+	if first.provider == other.provider {
+		return "are different users of the same provider"
+	}
+	if first.email != "" && other.email != "" &&
+		!strings.EqualFold(first.email, other.email) {
+		return fmt.Sprintf(
+			"have different email addresses %s and %s",
+			first.email, other.email,
+		)
+	}
+	return ""
+}
+
+// mergeProviderUsers merges lists of users, given in priority order, by
+// their identity key. When the same identity is returned by more than one
+// provider the conflict policy decides whether the first provider wins, the
+// keys and groups of both are combined, or the sync is aborted. Two
+// different identities mapping to the same local username are never merged,
+// the first one wins and the conflict is logged. Neither are two records of
+// the same identity returned by one provider, or carrying different email
+// addresses, which are a conflict under every policy: the sync is aborted
+// with the error policy, otherwise the first one wins.
+func mergeProviderUsers(
+	results [][]IAMUser,
+	identityKey string,
+	conflictPolicy string,
+) ([]IAMUser, error) {
+	merged := []IAMUser{}
+	byIdentity := map[string]int{}
+	byUsername := map[string]int{}
+
+	for _, users := range results {
+		for _, u := range users {
+			identity := identityOf(u, identityKey)
+			i, seen := byIdentity[identity]
+			if !seen {
+				if j, taken := byUsername[u.username]; taken {
+					globalLogger.Error(
+						"User %s from provider %s maps to the same local "+
+							"username as %s from provider %s, skipping\n",
+						identity, u.provider,
+						identityOf(merged[j], identityKey), merged[j].provider,
+					)
+					continue
+				}
+				byIdentity[identity] = len(merged)
+				byUsername[u.username] = len(merged)
+				merged = append(merged, u)
+				continue
+			}
+
+			if reason := sameUserConflict(merged[i], u); reason != "" {
+				if conflictPolicy == "error" {
+					return nil, fmt.Errorf(
+						"user %s from provider %s and %s %s",
+						identity, merged[i].provider, u.provider, reason,
+					)
+				}
+				globalLogger.Error(
+					"User %s from provider %s and %s %s, skipping the "+
+						"one from %s\n",
+					identity, merged[i].provider, u.provider, reason,
+					u.provider,
+				)
+				continue
+			}
+
+			switch conflictPolicy {
+			case "error":
+				return nil, fmt.Errorf(
+					"user %s is returned by both provider %s and %s",
+					identity, merged[i].provider, u.provider,
+				)
+			case "union":
+				merged[i].publickeys = unionStrings(
+					merged[i].publickeys, u.publickeys,
+				)
+				merged[i].groups = unionStrings(merged[i].groups, u.groups)
+			default:
+				globalLogger.Info(
+					"User %s is returned by both provider %s and %s, "+
+						"using %s\n",
+					identity, merged[i].provider, u.provider,
+					merged[i].provider,
+				)
+			}
+		}
+	}
+	return merged, nil
+}
+
+// unionStrings returns a with every value of b not already in a appended
+func unionStrings(a []string, b []string) []string {
+	seen := map[string]bool{}
+	union := []string{}
+	for _, v := range append(append([]string{}, a...), b...) {
+		if !seen[v] {
+			seen[v] = true
+			union = append(union, v)
+		}
+	}
+	return union
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckForUnsetProviderConfigNames(t *testing.T) {
+	previousCfg := Cfg
+	t.Cleanup(func() { Cfg = previousCfg })
+
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{"", false},
+		{"employees", false},
+		{"Contractors_2-eu", false},
+		{"../../etc/cron.d/x", true},
+		{"team/a", true},
+		{"..", true},
+		{"with space", true},
+	}
+	for _, tt := range tests {
+		Cfg = Config{Providers: []ProviderConfig{{
+			Name:            tt.name,
+			Provider:        "FILE",
+			ProviderOptions: ProviderOptions{File: "users.yml"},
+		}}}
+		err := CheckForUnsetProviderConfig()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error = %v, want error %t", tt.name, err,
+				tt.wantErr)
+		}
+	}
+}
+
+func TestMergeProviderUsers(t *testing.T) {
+	useTestLogger(t)
+	staff := []IAMUser{
+		{username: "jane", email: "jane@a.example.com", provider: "staff",
+			publickeys: []string{"key-a"}},
+		{username: "jane", email: "jane@b.example.com", provider: "staff",
+			publickeys: []string{"key-b"}},
+		{username: "ada", email: "ada@a.example.com", provider: "staff",
+			publickeys: []string{"key-ada"}},
+	}
+	contractors := []IAMUser{
+		{username: "jane", email: "jane@c.example.com",
+			provider: "contractors", publickeys: []string{"key-c"}},
+		{username: "ada", email: "ADA@a.example.com",
+			provider: "contractors", publickeys: []string{"key-ada2"}},
+	}
+
+	tests := []struct {
+		identityKey string
+		policy      string
+		wantErr     bool
+		want        map[string][]string
+	}{
+		// Only the two ada records agree on their email
+		{"username", "union", false, map[string][]string{
+			"jane": {"key-a"},
+			"ada":  {"key-ada", "key-ada2"},
+		}},
+		{"username", "first", false, map[string][]string{
+			"jane": {"key-a"},
+			"ada":  {"key-ada"},
+		}},
+		{"username", "error", true, nil},
+		// Different emails are different identities mapping to the same
+		// local username, the first one wins
+		{"email", "union", false, map[string][]string{
+			"jane": {"key-a"},
+			"ada":  {"key-ada", "key-ada2"},
+		}},
+	}
+	for _, tt := range tests {
+		merged, err := mergeProviderUsers(
+			[][]IAMUser{staff, contractors}, tt.identityKey, tt.policy,
+		)
+		name := tt.identityKey + "/" + tt.policy
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %t", name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		got := map[string][]string{}
+		for _, u := range merged {
+			if _, dup := got[u.username]; dup {
+				t.Errorf("%s: %s merged twice", name, u.username)
+			}
+			got[u.username] = u.publickeys
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: keys = %v, want %v", name, got, tt.want)
+		}
+	}
+
+	// The same provider returning one identity twice aborts an error sync
+	// even when the records agree
+	_, err := mergeProviderUsers([][]IAMUser{{
+		{username: "ada", provider: "staff"},
+		{username: "ada", provider: "staff"},
+	}}, "username", "error")
+	if err == nil {
+		t.Error("duplicate within one provider merged under error policy")
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Exit codes of a sync run, so monitoring can tell a sync that failed for
+// some users from one that didn't sync anyone. 2 is left to the flag
+// package, which uses it for invalid command line flags.
+const (
+	exitSuccess        = 0
+	exitTotalFailure   = 1
+	exitPartialFailure = 3
+)
+
+// userFailure records an operation that failed for a single user, so the
+// other users are still synced and the failures reported at the end
+type userFailure struct {
+	Username string `json:"username"`
+	Op       string `json:"op"`
+	Error    string `json:"error"`
+	Stderr   string `json:"stderr,omitempty"`
+}
+
+// SyncFailureError is returned by a sync that finished with failed user
+// operations. Total is set when not a single operation succeeded.
+type SyncFailureError struct {
+	Failures []userFailure
+	Total    bool
+}
+
+func (e *SyncFailureError) Error() string {
+	return fmt.Sprintf("%d user operations failed", len(e.Failures))
+}
+
+// forEachParallel calls fn for every index from 0 to n, running at most
+// Cfg.Workers calls at a time, and returns the error of each call once they
+// are done. When onerror is abort, no call is started after one failed.
+func forEachParallel(n int, fn func(i int) error) []error {
+	workers := Cfg.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	errs := make([]error, n)
+	slots := make(chan struct{}, workers)
+	var failed int32
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		slots <- struct{}{}
+		if Cfg.OnError == "abort" && atomic.LoadInt32(&failed) != 0 {
+			<-slots
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			errs[i] = fn(i)
+			if errs[i] != nil {
+				atomic.StoreInt32(&failed, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+// collectFailures returns a failure for every user whose operation returned
+// an error, keeping the order of the users. The stderr of a failed command
+// is recorded on its own for the report.
+func collectFailures(
+	usernames []string,
+	op string,
+	errs []error,
+) []userFailure {
+	failures := []userFailure{}
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		failure := userFailure{
+			Username: usernames[i],
+			Op:       op,
+			Error:    err.Error(),
+		}
+		var commandErr *CommandError
+		if errors.As(err, &commandErr) {
+			failure.Stderr = commandErr.Stderr
+		}
+		failures = append(failures, failure)
+	}
+	return failures
+}
+
+// summarizeFailures logs every failed user operation once the sync is done
+// and returns a SyncFailureError, or nil if there were none. operations is
+// the number of user operations attempted.
+func summarizeFailures(failures []userFailure, operations int) error {
+	if len(failures) == 0 {
+		return nil
+	}
+	globalLogger.Error(
+		"%d of %d user operations failed:\n", len(failures), operations,
+	)
+	for _, f := range failures {
+		globalLogger.Error("  %s %s: %s\n", f.Op, f.Username, f.Error)
+	}
+	return &SyncFailureError{
+		Failures: failures,
+		Total:    len(failures) >= operations,
+	}
+}
+
+// syncReport struct to map the report of the last sync to, which
+// monitoring can read from statedir/report.json
+type syncReport struct {
+	Finished  time.Time        `json:"finished"`
+	Status    string           `json:"status"`
+	Error     string           `json:"error,omitempty"`
+	Failures  []userFailure    `json:"failures"`
+	Providers []providerReport `json:"providers"`
+}
+
+// providerReport records how pulling the users of a provider went. Status
+// is ok, cached when the cached users were used instead, or failed. The
+// category of the error tells a quota or transient failure from one that
+// needs fixing.
+type providerReport struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Category string `json:"category,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Requests int32  `json:"requests"`
+	Retries  int32  `json:"retries"`
+	Duration string `json:"duration"`
+}
+
+// providerReports are the provider pulls of the running sync
+var providerReports = []providerReport{}
+
+// recordProviderReport adds the outcome of a provider pull to the report of
+// the running sync, along with the requests made and how long it took
+func recordProviderReport(
+	report providerReport,
+	stats *providerStats,
+	start time.Time,
+) {
+	report.Requests = atomic.LoadInt32(&stats.Requests)
+	report.Retries = atomic.LoadInt32(&stats.Retries)
+	report.Duration = time.Since(start).Round(time.Millisecond).String()
+	providerReports = append(providerReports, report)
+}
+
+// syncExitCode returns the exit code matching the result of a sync
+func syncExitCode(err error) int {
+	var failureErr *SyncFailureError
+	switch {
+	case err == nil:
+		return exitSuccess
+	case errors.As(err, &failureErr) && !failureErr.Total:
+		return exitPartialFailure
+	}
+	return exitTotalFailure
+}
+
+// writeSyncReport records the outcome of a sync in statedir/report.json
+func writeSyncReport(syncErr error) {
+	report := syncReport{
+		Finished:  time.Now().UTC(),
+		Status:    "success",
+		Failures:  []userFailure{},
+		Providers: providerReports,
+	}
+	var failureErr *SyncFailureError
+	if errors.As(syncErr, &failureErr) {
+		report.Failures = failureErr.Failures
+	}
+	switch syncExitCode(syncErr) {
+	case exitPartialFailure:
+		report.Status = "partial"
+	case exitTotalFailure:
+		report.Status = "failed"
+		report.Error = syncErr.Error()
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(
+			filepath.Join(Cfg.StateDir, "report.json"), data, 0600,
+		)
+	}
+	if err != nil {
+		globalLogger.Error("Issue writing sync report: %v\n", err)
+	}
+}
+
+// lockedBackend serializes the changes an account backend makes, as the
+// account databases can't be safely written by several workers of the same
+// process at once. Lookups still run in parallel.
+type lockedBackend struct {
+	backend AccountBackend
+	mu      *sync.RWMutex
+}
+
+// newLockedBackend wraps a backend so it can be shared between workers
+func newLockedBackend(backend AccountBackend) AccountBackend {
+	return lockedBackend{backend: backend, mu: &sync.RWMutex{}}
+}
+
+func (b lockedBackend) Name() string { return b.backend.Name() }
+
+func (b lockedBackend) AddUser(account LocalAccount, skel string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.backend.AddUser(account, skel)
+}
+
+func (b lockedBackend) ModifyUser(account LocalAccount) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.backend.ModifyUser(account)
+}
+
+func (b lockedBackend) DeleteUser(username string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.backend.DeleteUser(username)
+}
+
+func (b lockedBackend) LookupUser(username string) (LocalAccount, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.backend.LookupUser(username)
+}
+
+func (b lockedBackend) GroupExists(name string) (bool, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.backend.GroupExists(name)
+}
+
+func (b lockedBackend) CreateGroup(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.backend.CreateGroup(name)
+}
+
+func (b lockedBackend) AddUserToGroup(group string, username string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.backend.AddUserToGroup(group, username)
+}
+
+func (b lockedBackend) UsersInGroup(group string) ([]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.backend.UsersInGroup(group)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// RetryConfig defines how provider API requests failing with a quota or
+// transient error are retried, and how long pulling the users of a single
+// provider may take
+type RetryConfig struct {
+	Attempts       int    `yaml:"attempts"`
+	InitialBackoff string `yaml:"initialbackoff"`
+	MaxBackoff     string `yaml:"maxbackoff"`
+	Timeout        string `yaml:"timeout"`
+}
+
+// Categories of provider errors. Only quota and transient errors are
+// retried, auth and permanent errors won't go away by asking again.
+const (
+	errorAuth      = "auth"
+	errorQuota     = "quota"
+	errorTransient = "transient"
+	errorPermanent = "permanent"
+)
+
+// googleQuotaReasons are the reasons Google APIs give for a 403 answered
+// once a quota is used up, rather than for missing permissions
+var googleQuotaReasons = map[string]bool{
+	"rateLimitExceeded":     true,
+	"userRateLimitExceeded": true,
+	"quotaExceeded":         true,
+	"dailyLimitExceeded":    true,
+}
+
+// checkForUnsetRetryConfig sets the default retry options and validates
+// the configured ones
+func checkForUnsetRetryConfig() error {
+	retry := &Cfg.Retry
+	if retry.Attempts == 0 {
+		retry.Attempts = 5
+	}
+	if retry.Attempts < 1 {
+		return fmt.Errorf(
+			"Retry attempts %d must be at least 1", retry.Attempts,
+		)
+	}
+	durations := []struct {
+		name  string
+		value *string
+		def   string
+	}{
+		{"initial backoff", &retry.InitialBackoff, "1s"},
+		{"max backoff", &retry.MaxBackoff, "60s"},
+		{"timeout", &retry.Timeout, "5m"},
+	}
+	for _, d := range durations {
+		if *d.value == "" {
+			*d.value = d.def
+		}
+		parsed, err := time.ParseDuration(*d.value)
+		if err != nil || parsed < 0 {
+			return fmt.Errorf("Retry %s %s is invalid", d.name, *d.value)
+		}
+	}
+	return nil
+}
+
+// HTTPStatusError is returned when a provider API answers a request with
+// an unexpected status
+type HTTPStatusError struct {
+	Request    string
+	Status     string
+	StatusCode int
+	RetryAfter string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("%s failed: %s", e.Request, e.Status)
+}
+
+// checkHTTPResponse returns an HTTPStatusError naming the request unless
+// the response is a 200 OK
+func checkHTTPResponse(resp *http.Response, request string) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	return &HTTPStatusError{
+		Request:    request,
+		Status:     resp.Status,
+		StatusCode: resp.StatusCode,
+		RetryAfter: resp.Header.Get("Retry-After"),
+	}
+}
+
+// ProviderError is returned by a provider request that failed for good,
+// carrying the category of its last error and the number of attempts made
+type ProviderError struct {
+	Category string
+	Attempts int
+	Err      error
+}
+
+func (e *ProviderError) Error() string {
+	if e.Attempts > 1 {
+		return fmt.Sprintf(
+			"%s error after %d attempts: %v", e.Category, e.Attempts, e.Err,
+		)
+	}
+	return fmt.Sprintf("%s error: %v", e.Category, e.Err)
+}
+
+func (e *ProviderError) Unwrap() error { return e.Err }
+
+// statusCategory returns the category of an HTTP error status
+func statusCategory(code int) string {
+	switch {
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return errorAuth
+	case code == http.StatusTooManyRequests:
+		return errorQuota
+	case code == http.StatusRequestTimeout || code >= 500:
+		return errorTransient
+	}
+	return errorPermanent
+}
+
+// classifyError returns the category of an error returned by a provider,
+// along with the delay the provider asked to retry after, if any
+func classifyError(err error) (string, time.Duration) {
+	var providerErr *ProviderError
+	var retrieveErr *oauth2.RetrieveError
+	var statusErr *HTTPStatusError
+	var googleErr *googleapi.Error
+	var netErr net.Error
+	switch {
+	case errors.As(err, &providerErr):
+		return providerErr.Category, 0
+	case errors.Is(err, context.DeadlineExceeded):
+		return errorTransient, 0
+	case errors.As(err, &retrieveErr):
+		// A token the provider refuses to grant is an auth error, unless
+		// the token endpoint itself is unavailable
+		category := errorAuth
+		if retrieveErr.Response != nil {
+			code := retrieveErr.Response.StatusCode
+			if c := statusCategory(code); c == errorQuota ||
+				c == errorTransient {
+				category = c
+			}
+		}
+		return category, 0
+	case errors.As(err, &statusErr):
+		return statusCategory(statusErr.StatusCode),
+			parseRetryAfter(statusErr.RetryAfter, time.Now())
+	case errors.As(err, &googleErr):
+		category := statusCategory(googleErr.Code)
+		for _, item := range googleErr.Errors {
+			if googleQuotaReasons[item.Reason] {
+				category = errorQuota
+			}
+		}
+		return category,
+			parseRetryAfter(googleErr.Header.Get("Retry-After"), time.Now())
+	case errors.As(err, &netErr), errors.Is(err, io.ErrUnexpectedEOF):
+		return errorTransient, 0
+	}
+	return errorPermanent, 0
+}
+
+// parseRetryAfter parses a Retry-After header, given either in seconds or
+// as an HTTP date, returning zero if it is missing or invalid
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// retryBackoff returns the delay before the given retry, counting from 0.
+// The initial backoff is doubled for every retry up to the max backoff,
+// and up to half of it is taken off at random so the hosts synced by the
+// same cron entry don't all retry at once.
+func retryBackoff(retry int) time.Duration {
+	initial, _ := time.ParseDuration(Cfg.Retry.InitialBackoff)
+	max, _ := time.ParseDuration(Cfg.Retry.MaxBackoff)
+	delay := initial
+	for i := 0; i < retry && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// retrySleep waits for d, returning early with an error if ctx is done
+var retrySleep = func(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// providerContext returns the context the users of a provider are pulled
+// within, which is done once the retry timeout has passed
+func providerContext() (context.Context, context.CancelFunc) {
+	timeout, _ := time.ParseDuration(Cfg.Retry.Timeout)
+	if timeout > 0 {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// providerStats counts the requests made while pulling the users of a
+// provider, for the sync report
+type providerStats struct {
+	Requests int32
+	Retries  int32
+}
+
+// providerStatsKey is the context key of the providerStats of a pull
+type providerStatsKey struct{}
+
+// withProviderStats returns a context counting the requests made with it
+func withProviderStats(
+	ctx context.Context,
+) (context.Context, *providerStats) {
+	stats := &providerStats{}
+	return context.WithValue(ctx, providerStatsKey{}, stats), stats
+}
+
+// providerStatsFrom returns the stats counted by ctx, or stats that are
+// thrown away when ctx doesn't count any
+func providerStatsFrom(ctx context.Context) *providerStats {
+	if stats, ok := ctx.Value(providerStatsKey{}).(*providerStats); ok {
+		return stats
+	}
+	return &providerStats{}
+}
+
+// withRetry calls fn until it succeeds, fails with an auth or permanent
+// error, or Cfg.Retry.Attempts calls were made. Quota and transient errors
+// are retried after an exponential backoff, or after the delay asked for
+// with Retry-After when longer. A retry that can't start before the
+// deadline of ctx isn't waited for. The error returned is a ProviderError
+// carrying the category of the last error.
+func withRetry(
+	ctx context.Context,
+	what string,
+	fn func(ctx context.Context) error,
+) error {
+	stats := providerStatsFrom(ctx)
+	for attempt := 1; ; attempt++ {
+		atomic.AddInt32(&stats.Requests, 1)
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+		category, retryAfter := classifyError(err)
+		if ctx.Err() != nil {
+			return &ProviderError{
+				Category: errorTransient,
+				Attempts: attempt,
+				Err:      fmt.Errorf("provider timeout reached: %v", err),
+			}
+		}
+		failed := &ProviderError{
+			Category: category,
+			Attempts: attempt,
+			Err:      err,
+		}
+		if (category != errorQuota && category != errorTransient) ||
+			attempt >= Cfg.Retry.Attempts {
+			return failed
+		}
+
+		delay := retryBackoff(attempt - 1)
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		deadline, ok := ctx.Deadline()
+		if ok && time.Now().Add(delay).After(deadline) {
+			failed.Err = fmt.Errorf(
+				"%v, not retrying as the provider timeout would pass in "+
+					"the %s to wait", err, delay.Round(time.Millisecond),
+			)
+			return failed
+		}
+
+		globalLogger.Error(
+			"%s failed with a %s error (attempt %d of %d), retrying in "+
+				"%s: %v\n",
+			what, category, attempt, Cfg.Retry.Attempts,
+			delay.Round(time.Millisecond), err,
+		)
+		atomic.AddInt32(&stats.Retries, 1)
+		if sleepErr := retrySleep(ctx, delay); sleepErr != nil {
+			failed.Category = errorTransient
+			failed.Err = fmt.Errorf("provider timeout reached: %v", err)
+			return failed
+		}
+	}
+}
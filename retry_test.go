@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// useTestRetries retries up to 3 times for the rest of the test, recording
+// the delays waited for instead of sleeping
+func useTestRetries(t *testing.T) *[]time.Duration {
+	t.Helper()
+	previousRetry := Cfg.Retry
+	previousSleep := retrySleep
+	t.Cleanup(func() {
+		Cfg.Retry = previousRetry
+		retrySleep = previousSleep
+	})
+
+	Cfg.Retry = RetryConfig{
+		Attempts:       3,
+		InitialBackoff: "100ms",
+		MaxBackoff:     "1s",
+		Timeout:        "1m",
+	}
+	delays := &[]time.Duration{}
+	retrySleep = func(ctx context.Context, d time.Duration) error {
+		*delays = append(*delays, d)
+		return ctx.Err()
+	}
+	return delays
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		category   string
+		retryAfter time.Duration
+	}{
+		{"unauthorized", &HTTPStatusError{StatusCode: 401}, errorAuth, 0},
+		{"forbidden", &HTTPStatusError{StatusCode: 403}, errorAuth, 0},
+		{"not found", &HTTPStatusError{StatusCode: 404}, errorPermanent, 0},
+		{"rate limited",
+			&HTTPStatusError{StatusCode: 429, RetryAfter: "30"},
+			errorQuota, 30 * time.Second},
+		{"bad gateway", &HTTPStatusError{StatusCode: 502}, errorTransient, 0},
+		{"wrapped", fmt.Errorf("page 2: %w",
+			&HTTPStatusError{StatusCode: 503, RetryAfter: "2"}),
+			errorTransient, 2 * time.Second},
+		{"token refused", &oauth2.RetrieveError{
+			Response: &http.Response{StatusCode: 400},
+		}, errorAuth, 0},
+		{"token endpoint down", &oauth2.RetrieveError{
+			Response: &http.Response{StatusCode: 503},
+		}, errorTransient, 0},
+		{"deadline", context.DeadlineExceeded, errorTransient, 0},
+		{"decode", errors.New("invalid character"), errorPermanent, 0},
+		{"classified", &ProviderError{Category: errorQuota}, errorQuota, 0},
+	}
+	for _, tt := range tests {
+		category, retryAfter := classifyError(tt.err)
+		if category != tt.category || retryAfter != tt.retryAfter {
+			t.Errorf("%s: got %s after %s, want %s after %s", tt.name,
+				category, retryAfter, tt.category, tt.retryAfter)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"-1", 0},
+		{"Sun, 18 Oct 2026 09:00:45 GMT", 45 * time.Second},
+		{"Sun, 18 Oct 2026 08:59:00 GMT", 0},
+		{"soon", 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	useTestRetries(t)
+	tests := []struct {
+		retry int
+		max   time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{1, 200 * time.Millisecond},
+		{3, 800 * time.Millisecond},
+		{4, time.Second},
+		{20, time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			delay := retryBackoff(tt.retry)
+			if delay < tt.max/2 || delay > tt.max {
+				t.Fatalf("retry %d: delay %s not between %s and %s",
+					tt.retry, delay, tt.max/2, tt.max)
+			}
+		}
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	useTestLogger(t)
+	delays := useTestRetries(t)
+	ctx, stats := withProviderStats(context.Background())
+
+	calls := 0
+	err := withRetry(ctx, "test request", func(context.Context) error {
+		calls++
+		if calls < 3 {
+			return &HTTPStatusError{StatusCode: 503}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 || len(*delays) != 2 {
+		t.Errorf("%d calls and %d delays, want 3 and 2", calls, len(*delays))
+	}
+	if stats.Requests != 3 || stats.Retries != 2 {
+		t.Errorf("stats = %+v, want 3 requests and 2 retries", *stats)
+	}
+
+	// The last error is returned with its category once out of attempts
+	err = withRetry(ctx, "test request", func(context.Context) error {
+		return &HTTPStatusError{StatusCode: 429}
+	})
+	var providerErr *ProviderError
+	if !errors.As(err, &providerErr) || providerErr.Category != errorQuota ||
+		providerErr.Attempts != 3 {
+		t.Errorf("error = %#v, want a quota error after 3 attempts", err)
+	}
+}
+
+func TestWithRetryDeadline(t *testing.T) {
+	useTestLogger(t)
+	delays := useTestRetries(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// A Retry-After past the deadline fails straight away
+	calls := 0
+	err := withRetry(ctx, "test request", func(context.Context) error {
+		calls++
+		return &HTTPStatusError{StatusCode: 429, RetryAfter: "3600"}
+	})
+	if err == nil || calls != 1 || len(*delays) != 0 {
+		t.Errorf("error %v after %d calls and %d delays, want 1 call",
+			err, calls, len(*delays))
+	}
+}
+
+func TestGitlabGetRetries(t *testing.T) {
+	useTestLogger(t)
+	useTestRetries(t)
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&requests, 1) == 1 {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.Header().Set("X-Next-Page", "2")
+			fmt.Fprint(w, `[{"id": 1, "username": "ada"}]`)
+		},
+	))
+	defer server.Close()
+
+	var members []gitlabMember
+	next, err := gitlabGet(
+		context.Background(), server.Client(), server.URL, "token", &members,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 || next != "2" || len(members) != 1 {
+		t.Errorf("%d requests, next page %q, members %v", requests, next,
+			members)
+	}
+}
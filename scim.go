@@ -0,0 +1,860 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SCIM schema URNs used by the embedded server
+const (
+	scimUserSchema       = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema      = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimEnterpriseSchema = "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User"
+	scimSSHKeySchema     = "urn:ietf:params:scim:schemas:extension:iamusersync:2.0:User"
+	scimListSchema       = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimPatchSchema      = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimErrorSchema      = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimConfigSchema     = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+)
+
+// scimExtensionSchemas lists the extension schemas a PATCH path may be
+// qualified with
+var scimExtensionSchemas = []string{scimEnterpriseSchema, scimSSHKeySchema}
+
+// scimSyncDelay is how long the server waits after the last change before
+// syncing, so a burst of provisioning requests results in a single sync
+const scimSyncDelay = 5 * time.Second
+
+// scimMaxBodySize is the largest request body accepted, well above what a
+// user or group with its SSH keys takes
+const scimMaxBodySize = 1 << 20
+
+// scimResource is a SCIM User or Group, kept as the raw attribute map that
+// was pushed so that every attribute and extension is persisted as-is
+type scimResource map[string]interface{}
+
+// scimState struct to map the persisted SCIM state file to
+type scimState struct {
+	Users  map[string]scimResource `json:"users"`
+	Groups map[string]scimResource `json:"groups"`
+}
+
+// scimPatchOp struct to map a single PATCH operation to
+type scimPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// scimPatchRequest struct to map a PATCH request body to
+type scimPatchRequest struct {
+	Schemas    []string      `json:"schemas"`
+	Operations []scimPatchOp `json:"Operations"`
+}
+
+// scimServer holds the state and settings of the embedded SCIM server
+type scimServer struct {
+	mu        sync.Mutex
+	statePath string
+	token     string
+	state     scimState
+	changed   chan struct{}
+}
+
+// loadSCIMState reads the persisted SCIM state, returning an empty state if
+// nothing has been pushed yet
+func loadSCIMState(path string) (scimState, error) {
+	state := scimState{
+		Users:  map[string]scimResource{},
+		Groups: map[string]scimResource{},
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return state, fmt.Errorf("%s: %v", path, err)
+	}
+	if state.Users == nil {
+		state.Users = map[string]scimResource{}
+	}
+	if state.Groups == nil {
+		state.Groups = map[string]scimResource{}
+	}
+	return state, nil
+}
+
+// save persists the current state, atomically replacing the state file
+func (s *scimServer) save() error {
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.statePath, data, 0600)
+}
+
+// newSCIMID returns a random resource ID
+func newSCIMID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// scimLookup returns the value of an attribute, matching the name case
+// insensitively as required by RFC 7643
+func scimLookup(m map[string]interface{}, name string) (string, interface{}) {
+	if v, ok := m[name]; ok {
+		return name, v
+	}
+	for k, v := range m {
+		if strings.EqualFold(k, name) {
+			return k, v
+		}
+	}
+	return name, nil
+}
+
+// scimString returns an attribute as a string, or an empty string
+func scimString(m map[string]interface{}, name string) string {
+	_, v := scimLookup(m, name)
+	s, _ := v.(string)
+	return s
+}
+
+// scimBool returns a boolean attribute, accepting the string form some
+// identity providers send, or def when it isn't set
+func scimBool(m map[string]interface{}, name string, def bool) bool {
+	_, v := scimLookup(m, name)
+	switch val := v.(type) {
+	case bool:
+		return val
+	case string:
+		b, err := strconv.ParseBool(val)
+		if err == nil {
+			return b
+		}
+	}
+	return def
+}
+
+// scimFilterPattern matches the `attribute eq "value"` filters sent by
+// identity providers when looking up existing resources
+var scimFilterPattern = regexp.MustCompile(
+	`(?i)^\s*([\w.:]+)\s+eq\s+"(.*)"\s*$`,
+)
+
+// scimMatches reports whether a resource or multi-valued attribute element
+// matches a parsed `eq` filter
+func scimMatches(m map[string]interface{}, attr string, value string) bool {
+	return strings.EqualFold(scimString(m, attr), value)
+}
+
+// splitSCIMPath splits a PATCH path such as
+// `urn:...:enterprise:2.0:User:department` or `emails[type eq "work"].value`
+// into the extension schema, the attribute, an optional value filter and an
+// optional sub-attribute.
+func splitSCIMPath(path string) (
+	schema string, attr string, filter []string, sub string,
+) {
+	for _, urn := range append(scimExtensionSchemas, scimUserSchema) {
+		if strings.HasPrefix(strings.ToLower(path), strings.ToLower(urn)) {
+			schema = urn
+			path = strings.TrimPrefix(path[len(urn):], ":")
+			if urn == scimUserSchema {
+				schema = ""
+			}
+			break
+		}
+	}
+
+	if open := strings.Index(path, "["); open != -1 {
+		end := strings.Index(path, "]")
+		if end > open {
+			match := scimFilterPattern.FindStringSubmatch(path[open+1 : end])
+			if match != nil {
+				filter = match[1:]
+			}
+			sub = strings.TrimPrefix(path[end+1:], ".")
+			path = path[:open]
+		}
+	} else if dot := strings.Index(path, "."); dot != -1 {
+		sub = path[dot+1:]
+		path = path[:dot]
+	}
+	return schema, path, filter, sub
+}
+
+// applySCIMPatch applies a single add, replace or remove operation to a
+// resource following RFC 7644 section 3.5.2
+func applySCIMPatch(resource scimResource, op scimPatchOp) error {
+	operation := strings.ToLower(op.Op)
+	if operation != "add" && operation != "replace" && operation != "remove" {
+		return fmt.Errorf("unsupported PATCH operation %q", op.Op)
+	}
+
+	// Without a path the value is a set of attributes to add or replace
+	if op.Path == "" {
+		values, ok := op.Value.(map[string]interface{})
+		if !ok || operation == "remove" {
+			return errors.New("PATCH operation without a path needs a value")
+		}
+		for k, v := range values {
+			err := applySCIMPatch(
+				resource, scimPatchOp{Op: op.Op, Path: k, Value: v},
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	schema, attr, filter, sub := splitSCIMPath(op.Path)
+	target := map[string]interface{}(resource)
+	if schema != "" {
+		key, ext := scimLookup(target, schema)
+		extMap, ok := ext.(map[string]interface{})
+		if !ok {
+			extMap = map[string]interface{}{}
+			target[key] = extMap
+		}
+		target = extMap
+		if attr == "" {
+			// The path is the extension itself, merge the value into it
+			values, _ := op.Value.(map[string]interface{})
+			for k, v := range values {
+				target[k] = v
+			}
+			return nil
+		}
+	}
+	key, current := scimLookup(target, attr)
+
+	// Filtered paths select elements of a multi-valued attribute
+	if filter != nil {
+		elements, _ := current.([]interface{})
+		kept := []interface{}{}
+		matched := false
+		for _, e := range elements {
+			element, ok := e.(map[string]interface{})
+			if !ok || !scimMatches(element, filter[0], filter[1]) {
+				kept = append(kept, e)
+				continue
+			}
+			matched = true
+			switch {
+			case operation == "remove" && sub == "":
+				continue
+			case operation == "remove":
+				delete(element, sub)
+			case sub != "":
+				element[sub] = op.Value
+			default:
+				if values, ok := op.Value.(map[string]interface{}); ok {
+					for k, v := range values {
+						element[k] = v
+					}
+				}
+			}
+			kept = append(kept, element)
+		}
+		if !matched && operation != "remove" && sub != "" {
+			kept = append(kept, map[string]interface{}{
+				filter[0]: filter[1],
+				sub:       op.Value,
+			})
+		}
+		target[key] = kept
+		return nil
+	}
+
+	if sub != "" {
+		parent, ok := current.(map[string]interface{})
+		if !ok {
+			parent = map[string]interface{}{}
+			target[key] = parent
+		}
+		if operation == "remove" {
+			delete(parent, sub)
+		} else {
+			parent[sub] = op.Value
+		}
+		return nil
+	}
+
+	switch operation {
+	case "remove":
+		delete(target, key)
+	case "add":
+		// Adding to a multi-valued attribute appends the new values
+		if existing, ok := current.([]interface{}); ok {
+			if values, ok := op.Value.([]interface{}); ok {
+				target[key] = append(existing, values...)
+				return nil
+			}
+		}
+		target[key] = op.Value
+	default:
+		target[key] = op.Value
+	}
+	return nil
+}
+
+// writeSCIM writes a SCIM JSON response with the given status code
+func writeSCIM(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.WriteHeader(status)
+	if body != nil {
+		_ = json.NewEncoder(w).Encode(body)
+	}
+}
+
+// writeSCIMError writes a SCIM error response
+func writeSCIMError(w http.ResponseWriter, status int, detail string) {
+	body := map[string]interface{}{
+		"schemas": []string{scimErrorSchema},
+		"status":  strconv.Itoa(status),
+		"detail":  detail,
+	}
+	if status == http.StatusConflict {
+		body["scimType"] = "uniqueness"
+	}
+	writeSCIM(w, status, body)
+}
+
+// authorized checks the request carries the configured bearer token
+func (s *scimServer) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	presented := []byte(strings.TrimPrefix(auth, "Bearer "))
+	return subtle.ConstantTimeCompare(presented, []byte(s.token)) == 1
+}
+
+// notifyChanged signals the sync loop that the state changed without
+// blocking when a sync is already pending
+func (s *scimServer) notifyChanged() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// ServeHTTP routes requests to the Users and Groups endpoints
+func (s *scimServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		writeSCIMError(w, http.StatusUnauthorized, "Invalid bearer token")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, scimMaxBodySize)
+
+	// Identity providers are configured with a base URL which may include
+	// a /scim/v2 prefix, so only the last path segments are routed on
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	for i, part := range parts {
+		switch part {
+		case "Users", "Groups":
+			id := ""
+			if i+1 < len(parts) {
+				id = parts[i+1]
+			}
+			s.handleResource(w, r, part, id)
+			return
+		case "ServiceProviderConfig":
+			writeSCIM(w, http.StatusOK, map[string]interface{}{
+				"schemas": []string{scimConfigSchema},
+				"patch":   map[string]bool{"supported": true},
+				"bulk":    map[string]bool{"supported": false},
+				"filter": map[string]interface{}{
+					"supported":  true,
+					"maxResults": 1000,
+				},
+				"changePassword": map[string]bool{"supported": false},
+				"sort":           map[string]bool{"supported": false},
+				"etag":           map[string]bool{"supported": false},
+				"authenticationSchemes": []map[string]string{{
+					"type": "oauthbearertoken",
+					"name": "OAuth Bearer Token",
+				}},
+			})
+			return
+		}
+	}
+	writeSCIMError(w, http.StatusNotFound, "Unknown endpoint")
+}
+
+// handleResource implements the list, get, create, replace, patch and
+// delete operations for Users and Groups
+func (s *scimServer) handleResource(
+	w http.ResponseWriter,
+	r *http.Request,
+	resourceType string,
+	id string,
+) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resources := s.state.Users
+	schema := scimUserSchema
+	uniqueAttr := "userName"
+	if resourceType == "Groups" {
+		resources = s.state.Groups
+		schema = scimGroupSchema
+		uniqueAttr = "displayName"
+	}
+
+	if id == "" && r.Method == http.MethodGet {
+		s.listResources(w, r, resources)
+		return
+	}
+
+	if id == "" && r.Method == http.MethodPost {
+		var resource scimResource
+		if !decodeSCIM(w, r, &resource) {
+			return
+		}
+		if !checkSCIMUnique(w, resources, uniqueAttr, resource, "") {
+			return
+		}
+
+		id = newSCIMID()
+		now := time.Now().UTC().Format(time.RFC3339)
+		resource["id"] = id
+		if _, ok := resource["schemas"]; !ok {
+			resource["schemas"] = []string{schema}
+		}
+		resource["meta"] = map[string]interface{}{
+			"resourceType": strings.TrimSuffix(resourceType, "s"),
+			"created":      now,
+			"lastModified": now,
+			"location":     "/" + resourceType + "/" + id,
+		}
+		resources[id] = resource
+		s.commit(w, http.StatusCreated, resource)
+		return
+	}
+
+	resource, ok := resources[id]
+	if !ok {
+		writeSCIMError(
+			w, http.StatusNotFound, resourceType+" "+id+" not found",
+		)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeSCIM(w, http.StatusOK, resource)
+	case http.MethodPut:
+		var replacement scimResource
+		if !decodeSCIM(w, r, &replacement) {
+			return
+		}
+		if !checkSCIMUnique(w, resources, uniqueAttr, replacement, id) {
+			return
+		}
+		replacement["id"] = id
+		replacement["meta"] = resource["meta"]
+		resources[id] = replacement
+		touchSCIMResource(replacement)
+		s.commit(w, http.StatusOK, replacement)
+	case http.MethodPatch:
+		var patch scimPatchRequest
+		if !decodeSCIM(w, r, &patch) {
+			return
+		}
+		// The operations are applied to a copy, so a request failing
+		// halfway leaves the stored resource untouched
+		patched, err := copySCIMResource(resource)
+		if err != nil {
+			writeSCIMError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for _, op := range patch.Operations {
+			if err := applySCIMPatch(patched, op); err != nil {
+				writeSCIMError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		if !checkSCIMUnique(w, resources, uniqueAttr, patched, id) {
+			return
+		}
+		resources[id] = patched
+		touchSCIMResource(patched)
+		s.commit(w, http.StatusOK, patched)
+	case http.MethodDelete:
+		delete(resources, id)
+		s.commit(w, http.StatusNoContent, nil)
+	default:
+		writeSCIMError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// decodeSCIM decodes a request body into v, responding with an error and
+// returning false when it is malformed or too large
+func decodeSCIM(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == nil {
+		return true
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeSCIMError(
+			w, http.StatusRequestEntityTooLarge, "Request body too large",
+		)
+		return false
+	}
+	writeSCIMError(w, http.StatusBadRequest, err.Error())
+	return false
+}
+
+// checkSCIMUnique checks that the userName or displayName of a resource is
+// set and not taken by another resource than the one with the given id,
+// responding with an error and returning false otherwise. Two users with
+// the same name would be merged into one account, dropping either.
+func checkSCIMUnique(
+	w http.ResponseWriter,
+	resources map[string]scimResource,
+	uniqueAttr string,
+	resource scimResource,
+	id string,
+) bool {
+	unique := scimString(resource, uniqueAttr)
+	if unique == "" {
+		writeSCIMError(w, http.StatusBadRequest, uniqueAttr+" is required")
+		return false
+	}
+	for existingID, existing := range resources {
+		if existingID == id {
+			continue
+		}
+		if scimMatches(existing, uniqueAttr, unique) {
+			writeSCIMError(w, http.StatusConflict, unique+" already exists")
+			return false
+		}
+		if uniqueAttr == "userName" && scimLocalName(scimString(
+			existing, uniqueAttr,
+		)) == scimLocalName(unique) {
+			writeSCIMError(w, http.StatusConflict, fmt.Sprintf(
+				"%s maps to the same local account as %s",
+				unique, scimString(existing, uniqueAttr),
+			))
+			return false
+		}
+	}
+	return true
+}
+
+// scimLocalName returns the local account name a userName syncs to, with
+// the domain part of jane.doe@example.com dropped
+func scimLocalName(userName string) string {
+	return strings.SplitN(strings.ToLower(userName), "@", 2)[0]
+}
+
+// copySCIMResource returns a deep copy of a resource
+func copySCIMResource(resource scimResource) (scimResource, error) {
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return nil, err
+	}
+	var copied scimResource
+	if err := json.Unmarshal(data, &copied); err != nil {
+		return nil, err
+	}
+	return copied, nil
+}
+
+// touchSCIMResource updates the lastModified time of a resource
+func touchSCIMResource(resource scimResource) {
+	meta, ok := resource["meta"].(map[string]interface{})
+	if !ok {
+		meta = map[string]interface{}{}
+		resource["meta"] = meta
+	}
+	meta["lastModified"] = time.Now().UTC().Format(time.RFC3339)
+}
+
+// commit persists the state after a change, responds and schedules a sync
+func (s *scimServer) commit(
+	w http.ResponseWriter,
+	status int,
+	body interface{},
+) {
+	if err := s.save(); err != nil {
+		globalLogger.Error("Unable to persist SCIM state: %v\n", err)
+		writeSCIMError(
+			w, http.StatusInternalServerError, "Unable to persist state",
+		)
+		return
+	}
+	writeSCIM(w, status, body)
+	s.notifyChanged()
+}
+
+// listResources responds with the resources matching an optional `eq`
+// filter, paginated with startIndex and count
+func (s *scimServer) listResources(
+	w http.ResponseWriter,
+	r *http.Request,
+	resources map[string]scimResource,
+) {
+	var filter []string
+	if f := r.URL.Query().Get("filter"); f != "" {
+		filter = scimFilterPattern.FindStringSubmatch(f)
+		if filter == nil {
+			writeSCIMError(w, http.StatusBadRequest, "Unsupported filter: "+f)
+			return
+		}
+		filter = filter[1:]
+	}
+
+	ids := []string{}
+	for id, resource := range resources {
+		if filter == nil || scimMatches(resource, filter[0], filter[1]) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	startIndex, err := strconv.Atoi(r.URL.Query().Get("startIndex"))
+	if err != nil || startIndex < 1 {
+		startIndex = 1
+	}
+	count, err := strconv.Atoi(r.URL.Query().Get("count"))
+	if err != nil || count < 0 {
+		count = len(ids)
+	}
+
+	page := []scimResource{}
+	for i := startIndex - 1; i < len(ids) && len(page) < count; i++ {
+		page = append(page, resources[ids[i]])
+	}
+	writeSCIM(w, http.StatusOK, map[string]interface{}{
+		"schemas":      []string{scimListSchema},
+		"totalResults": len(ids),
+		"startIndex":   startIndex,
+		"itemsPerPage": len(page),
+		"Resources":    page,
+	})
+}
+
+// scimUserKeys returns the SSH keys held in the SSH key extension of a user.
+// Keys may be pushed as a list of strings or a list of {"value": key}
+// objects, and a single value may hold several keys on separate lines.
+func scimUserKeys(user scimResource) []string {
+	keys := []string{}
+	_, ext := scimLookup(user, scimSSHKeySchema)
+	extMap, ok := ext.(map[string]interface{})
+	if !ok {
+		return keys
+	}
+
+	_, values := scimLookup(extMap, "sshPublicKeys")
+	list, ok := values.([]interface{})
+	if !ok {
+		list = []interface{}{values}
+	}
+	for _, v := range list {
+		value, ok := v.(string)
+		if m, isMap := v.(map[string]interface{}); isMap {
+			value, ok = scimString(m, "value"), true
+		}
+		if !ok {
+			continue
+		}
+		for _, line := range strings.Split(value, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				keys = append(keys, line)
+			}
+		}
+	}
+	return keys
+}
+
+// scimUserEmail returns the primary email address of a user, falling back
+// to the first email address, or the userName if it is an email address
+func scimUserEmail(user scimResource) string {
+	_, values := scimLookup(user, "emails")
+	emails, _ := values.([]interface{})
+	email := ""
+	for _, v := range emails {
+		e, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if email == "" || scimBool(e, "primary", false) {
+			email = scimString(e, "value")
+		}
+	}
+	if email == "" && strings.Contains(scimString(user, "userName"), "@") {
+		email = scimString(user, "userName")
+	}
+	return email
+}
+
+// scimUserFullName returns the formatted name of a user, building it from
+// the name components or falling back to the display name when unset
+func scimUserFullName(user scimResource) string {
+	_, value := scimLookup(user, "name")
+	if name, ok := value.(map[string]interface{}); ok {
+		if formatted := scimString(name, "formatted"); formatted != "" {
+			return formatted
+		}
+		full := strings.TrimSpace(
+			scimString(name, "givenName") + " " +
+				scimString(name, "familyName"),
+		)
+		if full != "" {
+			return full
+		}
+	}
+	return scimString(user, "displayName")
+}
+
+// PullSCIMUsers reads the state pushed to the embedded SCIM server and
+// returns every active user holding SSH keys as an IAMUser object. The
+// domain part of a userName such as jane.doe@example.com is dropped, and
+// group memberships are taken from the pushed Groups. The server refuses
+// userNames mapping to the same local name, and of any such users left in
+// an older state file only the first by id is synced.
+func PullSCIMUsers(statePath string) ([]IAMUser, error) {
+	// scimUsers List of scimUser objects
+	var scimUsers = []IAMUser{}
+
+	state, err := loadSCIMState(statePath)
+	if err != nil {
+		return nil, err
+	}
+
+	groupNames := []string{}
+	for id := range state.Groups {
+		groupNames = append(groupNames, id)
+	}
+	sort.Strings(groupNames)
+	memberGroups := map[string][]string{}
+	for _, id := range groupNames {
+		group := state.Groups[id]
+		_, members := scimLookup(group, "members")
+		list, _ := members.([]interface{})
+		for _, m := range list {
+			if member, ok := m.(map[string]interface{}); ok {
+				userID := scimString(member, "value")
+				memberGroups[userID] = append(
+					memberGroups[userID], scimString(group, "displayName"),
+				)
+			}
+		}
+	}
+
+	ids := []string{}
+	for id := range state.Users {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	localNames := map[string]string{}
+	for _, id := range ids {
+		user := state.Users[id]
+		if !scimBool(user, "active", true) {
+			continue
+		}
+		keys := scimUserKeys(user)
+		userName := strings.ToLower(scimString(user, "userName"))
+		if userName == "" || len(keys) == 0 {
+			continue
+		}
+
+		username := scimLocalName(userName)
+		if owner, ok := localNames[username]; ok {
+			globalLogger.Error(
+				"SCIM: skipping %s, %s already maps to the account %s\n",
+				userName, owner, username,
+			)
+			continue
+		}
+		localNames[username] = userName
+
+		sUser := IAMUser{
+			username:   username,
+			email:      scimUserEmail(user),
+			publickeys: keys,
+			groups:     memberGroups[id],
+			fullname:   scimUserFullName(user),
+		}
+		scimUsers = append(scimUsers, sUser)
+	}
+	return scimUsers, nil
+}
+
+// ServeSCIM runs the embedded SCIM server on the given address, persisting
+// pushed Users and Groups to the state file. A sync is run at startup and
+// again shortly after each change. It only returns if the server fails.
+func ServeSCIM(
+	listen string,
+	token string,
+	statePath string,
+	tlsCert string,
+	tlsKey string,
+) error {
+	err := os.MkdirAll(filepath.Dir(statePath), 0700)
+	if err != nil {
+		return err
+	}
+	state, err := loadSCIMState(statePath)
+	if err != nil {
+		return err
+	}
+	srv := &scimServer{
+		statePath: statePath,
+		token:     token,
+		state:     state,
+		changed:   make(chan struct{}, 1),
+	}
+
+	// Sync from whatever state was persisted by a previous run, then after
+	// each burst of changes
+	go func() {
+		// Errors are logged as they occur
+		SyncUsers()
+		for range srv.changed {
+			time.Sleep(scimSyncDelay)
+			select {
+			case <-srv.changed:
+			default:
+			}
+			globalLogger.Info("SCIM state changed, syncing users\n")
+			SyncUsers()
+		}
+	}()
+
+	globalLogger.Info("SCIM server listening on %s\n", listen)
+	server := &http.Server{
+		Addr:              listen,
+		Handler:           srv,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if tlsCert != "" {
+		return server.ListenAndServeTLS(tlsCert, tlsKey)
+	}
+	return server.ListenAndServe()
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestSCIMServer returns a SCIM server persisting to a temporary state
+// file, without a sync loop
+func newTestSCIMServer(t *testing.T) *scimServer {
+	t.Helper()
+	useTestLogger(t)
+	return &scimServer{
+		statePath: filepath.Join(t.TempDir(), "scim.json"),
+		token:     "secret",
+		state: scimState{
+			Users:  map[string]scimResource{},
+			Groups: map[string]scimResource{},
+		},
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// do sends a request to the server, returning the status and decoded body
+func (s *scimServer) do(
+	t *testing.T,
+	method string,
+	path string,
+	body string,
+) (int, scimResource) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	var resource scimResource
+	_ = json.Unmarshal(rec.Body.Bytes(), &resource)
+	return rec.Code, resource
+}
+
+// createUser creates a user with the given userName, returning its id
+func (s *scimServer) createUser(t *testing.T, userName string) string {
+	t.Helper()
+	status, user := s.do(t, http.MethodPost, "/Users",
+		`{"userName": "`+userName+`"}`)
+	if status != http.StatusCreated {
+		t.Fatalf("creating %s: status %d", userName, status)
+	}
+	return scimString(user, "id")
+}
+
+func TestSCIMRenameConflicts(t *testing.T) {
+	s := newTestSCIMServer(t)
+	s.createUser(t, "ada")
+	alan := s.createUser(t, "alan")
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		status int
+	}{
+		{"put taken", http.MethodPut, `{"userName": "ADA"}`,
+			http.StatusConflict},
+		{"put empty", http.MethodPut, `{"displayName": "Alan"}`,
+			http.StatusBadRequest},
+		{"patch taken", http.MethodPatch, `{"Operations": [` +
+			`{"op": "replace", "path": "userName", "value": "ada"}]}`,
+			http.StatusConflict},
+		{"patch removed", http.MethodPatch, `{"Operations": [` +
+			`{"op": "remove", "path": "userName"}]}`,
+			http.StatusBadRequest},
+		{"put own name", http.MethodPut, `{"userName": "alan"}`,
+			http.StatusOK},
+	}
+	for _, tt := range tests {
+		status, _ := s.do(t, tt.method, "/Users/"+alan, tt.body)
+		if status != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, status, tt.status)
+		}
+		if name := scimString(s.state.Users[alan], "userName"); name != "alan" {
+			t.Errorf("%s: userName = %q, want alan", tt.name, name)
+		}
+	}
+}
+
+func TestSCIMPatchIsAtomic(t *testing.T) {
+	s := newTestSCIMServer(t)
+	ada := s.createUser(t, "ada")
+
+	status, _ := s.do(t, http.MethodPatch, "/Users/"+ada, `{"Operations": [`+
+		`{"op": "replace", "path": "active", "value": false},`+
+		`{"op": "replace", "path": "name.givenName", "value": "Ada"},`+
+		`{"op": "move", "path": "userName"}]}`)
+	if status != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400 for the unsupported operation", status)
+	}
+	user := s.state.Users[ada]
+	if _, ok := user["active"]; ok {
+		t.Errorf("active set by a failed PATCH: %v", user)
+	}
+	if _, ok := user["name"]; ok {
+		t.Errorf("name set by a failed PATCH: %v", user)
+	}
+}
+
+func TestSCIMBodyTooLarge(t *testing.T) {
+	s := newTestSCIMServer(t)
+	body := `{"userName": "ada", "displayName": "` +
+		strings.Repeat("a", scimMaxBodySize) + `"}`
+	status, _ := s.do(t, http.MethodPost, "/Users", body)
+	if status != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %d, want 413", status)
+	}
+	if len(s.state.Users) != 0 {
+		t.Errorf("users = %v, want none", s.state.Users)
+	}
+}
+
+func TestSCIMLocalNameConflicts(t *testing.T) {
+	s := newTestSCIMServer(t)
+	s.createUser(t, "jane@a.example.com")
+	bob := s.createUser(t, "bob@b.example.com")
+
+	status, body := s.do(t, http.MethodPost, "/Users",
+		`{"userName": "Jane@b.example.com"}`)
+	if status != http.StatusConflict ||
+		scimString(body, "scimType") != "uniqueness" {
+		t.Errorf("create: status %d, body %v, want 409 uniqueness",
+			status, body)
+	}
+	status, _ = s.do(t, http.MethodPut, "/Users/"+bob,
+		`{"userName": "jane"}`)
+	if status != http.StatusConflict {
+		t.Errorf("rename: status %d, want 409", status)
+	}
+	if len(s.state.Users) != 2 {
+		t.Errorf("users = %v, want jane and bob", s.state.Users)
+	}
+
+	// A state file written before the check still syncs one account
+	keys := scimResource{"sshPublicKeys": []interface{}{
+		testPublicKey(t, "jane"),
+	}}
+	s.state.Users = map[string]scimResource{
+		"0": {"id": "0", "userName": "jane@c.example.com",
+			"emails": []interface{}{map[string]interface{}{
+				"value": "jane@c.example.com",
+			}},
+			scimSSHKeySchema: keys},
+		"1": {"id": "1", "userName": "jane@d.example.com",
+			scimSSHKeySchema: keys},
+	}
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+	users, err := PullSCIMUsers(s.statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].username != "jane" ||
+		users[0].email != "jane@c.example.com" {
+		t.Errorf("users = %+v, want only jane@c.example.com", users)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// The modes sshd's StrictModes expects for the files it reads
+const (
+	sshDirMode         = 0700
+	authorizedKeysMode = 0600
+)
+
+// openDirNoFollow opens a directory relative to dirfd, refusing to follow a
+// symlink planted in its place
+func openDirNoFollow(dirfd int, name string) (*os.File, error) {
+	fd, err := syscall.Openat(
+		dirfd, name,
+		syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|
+			syscall.O_CLOEXEC,
+		0,
+	)
+	if errors.Is(err, syscall.ELOOP) || errors.Is(err, syscall.ENOTDIR) {
+		return nil, fmt.Errorf("%s is not a directory or is a symlink", name)
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "openat", Path: name, Err: err}
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// enforceOwnerAndMode makes the open file owned by uid and gid with the
+// given mode, only touching it when it has drifted. It returns whether a
+// change was made.
+func enforceOwnerAndMode(
+	f *os.File,
+	uid int,
+	gid int,
+	mode os.FileMode,
+) (bool, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	changed := false
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok &&
+		(int(stat.Uid) != uid || int(stat.Gid) != gid) {
+		err = f.Chown(uid, gid)
+		if err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	if info.Mode().Perm() != mode {
+		err = f.Chmod(mode)
+		if err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// writeAuthorizedKeys enforces the permissions of the user's home, ~/.ssh
+// and ~/.ssh/authorized_keys, and replaces the keys when they differ from
+// content. A home owned by another non-root user is refused. Every path
+// below the home directory is opened relative to its parent without
+// following symlinks, as the user could otherwise point them at a system
+// file. The keys are written to a temporary file owned by the user and
+// renamed into place, so sshd never reads a partial file.
+func writeAuthorizedKeys(
+	home string,
+	uid int,
+	gid int,
+	content []byte,
+) (bool, error) {
+	homeDir, err := os.OpenFile(
+		home, os.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0,
+	)
+	if errors.Is(err, syscall.ELOOP) || errors.Is(err, syscall.ENOTDIR) {
+		return false, fmt.Errorf("%s is not a directory or is a symlink", home)
+	}
+	if err != nil {
+		return false, err
+	}
+	defer homeDir.Close()
+
+	// A home owned by another user, such as a home shared with or taken
+	// over from another account, is never handed to this one. Only root
+	// owned homes, which the user can't tamper with, are accepted as well.
+	homeInfo, err := homeDir.Stat()
+	if err != nil {
+		return false, err
+	}
+	if stat, ok := homeInfo.Sys().(*syscall.Stat_t); ok &&
+		int(stat.Uid) != uid && stat.Uid != 0 {
+		return false, fmt.Errorf(
+			"%s is owned by UID %d instead of %d, refusing to write keys",
+			home, stat.Uid, uid,
+		)
+	}
+
+	// The home directory must not be writable by the group or others, or
+	// anyone else could replace ~/.ssh
+	changed := false
+	if homeInfo.Mode().Perm()&0022 != 0 {
+		err = homeDir.Chmod(homeInfo.Mode().Perm() &^ 0022)
+		if err != nil {
+			return false, err
+		}
+		changed = true
+	}
+
+	homeFd := int(homeDir.Fd())
+	err = syscall.Mkdirat(homeFd, ".ssh", sshDirMode)
+	if err != nil && !errors.Is(err, syscall.EEXIST) {
+		return false, &os.PathError{Op: "mkdirat", Path: ".ssh", Err: err}
+	}
+	sshDir, err := openDirNoFollow(homeFd, ".ssh")
+	if err != nil {
+		return false, err
+	}
+	defer sshDir.Close()
+	sshChanged, err := enforceOwnerAndMode(sshDir, uid, gid, sshDirMode)
+	if err != nil {
+		return false, err
+	}
+	changed = changed || sshChanged
+
+	// Keep the existing file when its content is already correct
+	sshFd := int(sshDir.Fd())
+	fd, err := syscall.Openat(
+		sshFd, "authorized_keys",
+		syscall.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK|
+			syscall.O_CLOEXEC,
+		0,
+	)
+	if err == nil {
+		existing := os.NewFile(uintptr(fd), "authorized_keys")
+		info, statErr := existing.Stat()
+		if statErr == nil && info.Mode().IsRegular() {
+			data, readErr := ioutil.ReadAll(existing)
+			if readErr == nil && bytes.Equal(data, content) {
+				keysChanged, err := enforceOwnerAndMode(
+					existing, uid, gid, authorizedKeysMode,
+				)
+				existing.Close()
+				return changed || keysChanged, err
+			}
+		}
+		existing.Close()
+	} else if !errors.Is(err, syscall.ENOENT) &&
+		!errors.Is(err, syscall.ELOOP) {
+		return false, &os.PathError{
+			Op: "openat", Path: "authorized_keys", Err: err,
+		}
+	}
+
+	// A symlink or other special file in its place is replaced by rename
+	tmpName := ".authorized_keys." + strconv.FormatInt(
+		time.Now().UnixNano(), 36,
+	)
+	fd, err = syscall.Openat(
+		sshFd, tmpName,
+		syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW|
+			syscall.O_CLOEXEC,
+		authorizedKeysMode,
+	)
+	if err != nil {
+		return false, &os.PathError{Op: "openat", Path: tmpName, Err: err}
+	}
+	tmp := os.NewFile(uintptr(fd), tmpName)
+	_, err = tmp.Write(content)
+	if err == nil {
+		_, err = enforceOwnerAndMode(tmp, uid, gid, authorizedKeysMode)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = syscall.Renameat(sshFd, tmpName, sshFd, "authorized_keys")
+	}
+	if err != nil {
+		syscall.Unlinkat(sshFd, tmpName)
+		return false, err
+	}
+	return true, nil
+}
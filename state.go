@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// SyncState struct to map the persisted sync state file to. Accounts is
+// updated by several workers during a sync, which go through account and
+// setAccount.
+type SyncState struct {
+	Accounts map[string]AccountState `json:"accounts"`
+
+	mu *sync.Mutex
+}
+
+// AccountState records what is known about a single managed local account.
+// Created and Adopted record why the account is managed, as accounts that
+// were neither created nor adopted belong to someone else.
+type AccountState struct {
+	Provider string `json:"provider"`
+	Created  bool   `json:"created,omitempty"`
+	Adopted  bool   `json:"adopted,omitempty"`
+}
+
+// statePath returns the path of the sync state file
+func statePath() string {
+	return filepath.Join(Cfg.StateDir, "state.json")
+}
+
+// LoadState reads the sync state file, returning an empty state if this is
+// the first run
+func LoadState() (SyncState, error) {
+	state := SyncState{Accounts: map[string]AccountState{}, mu: &sync.Mutex{}}
+
+	data, err := ioutil.ReadFile(statePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return state, fmt.Errorf("%s: %v", statePath(), err)
+	}
+	if state.Accounts == nil {
+		state.Accounts = map[string]AccountState{}
+	}
+	return state, nil
+}
+
+// SaveState persists the sync state file, creating the state directory if
+// it doesn't exist yet
+func SaveState(state SyncState) error {
+	err := os.MkdirAll(Cfg.StateDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(statePath(), data, 0600)
+}
+
+// account returns the recorded state of an account
+func (s SyncState) account(username string) (AccountState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, known := s.Accounts[username]
+	return account, known
+}
+
+// setAccount records the state of an account
+func (s SyncState) setAccount(username string, account AccountState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Accounts[username] = account
+}
+
+// owned reports whether the account was created or adopted by the sync
+func (s SyncState) owned(username string) bool {
+	account, _ := s.account(username)
+	return account.Created || account.Adopted
+}
+
+// adoptable reports whether the adoption policy allows taking over an
+// existing account the sync didn't create, depending on whether it is
+// already a member of the managed group
+func adoptable(inGroup bool) bool {
+	switch Cfg.Adoption {
+	case "always":
+		return true
+	case "managed-group":
+		return inGroup
+	}
+	return false
+}
+
+// forgetMissingAccounts removes the accounts that are no longer members of
+// the managed group from the state
+func (s SyncState) forgetMissingAccounts(localUsersList []string) {
+	present := map[string]bool{}
+	for _, localUser := range localUsersList {
+		present[localUser] = true
+	}
+	for username := range s.Accounts {
+		if !present[username] {
+			delete(s.Accounts, username)
+		}
+	}
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory and
+// renames it over path, so a crash never leaves a truncated file behind
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(
+		filepath.Dir(path), "."+filepath.Base(path)+"-*",
+	)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
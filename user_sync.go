@@ -3,21 +3,28 @@ package main
 import (
 	"errors"
 	"flag"
+	"fmt"
 	"gopkg.in/yaml.v2"
-	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
-	"os/user"
-	"strconv"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
 // IAMUser struct for maintaining local users
 type IAMUser struct {
-	username  string
-	publickey string
+	username   string
+	email      string
+	publickeys []string
+	groups     []string
+	provider   string
+	fullname   string
+	shell      string
+	// keysRejected is set when the key policy rejected every key of the
+	// user, who keeps the account but can't log in with a key
+	keysRejected bool
 }
 
 // Config struct defines parameters where user input is necessary
@@ -27,14 +34,29 @@ type Config struct {
 	LogFile         string          `yaml:"logfile"`
 	Provider        string          `yaml:"provider"`
 	ProviderOptions ProviderOptions `yaml:"provider-options"`
-}
 
-// ProviderOptions defines parameters for specified provider
-type ProviderOptions struct {
-	Credentials        string `yaml:"credentials"`
-	CustomAttributeKey string `yaml:"customattributekey"`
-	Email              string `yaml:"gsuiteadmin"`
-	Domain             string `yaml:"oauthdomain"`
+	Providers      []ProviderConfig `yaml:"providers"`
+	IdentityKey    string           `yaml:"identitykey"`
+	ConflictPolicy string           `yaml:"conflictpolicy"`
+	StateDir       string           `yaml:"statedir"`
+	CacheMaxAge    string           `yaml:"cachemaxage"`
+	CacheMaxDrop   int              `yaml:"cachemaxdrop"`
+	AccountBackend string           `yaml:"accountbackend"`
+	Root           string           `yaml:"root"`
+	Accounts       AccountConfig    `yaml:"accounts"`
+	KeysMode       string           `yaml:"keysmode"`
+	KeysFile       string           `yaml:"keysfile"`
+	CA             CAConfig         `yaml:"ca"`
+	KeyPolicy      KeyPolicyConfig  `yaml:"keypolicy"`
+	KeyOptions     []KeyOptionRule  `yaml:"keyoptions"`
+	Protected      ProtectedConfig  `yaml:"protected"`
+	Adoption       string           `yaml:"adoption"`
+	Usernames      UsernameConfig   `yaml:"usernames"`
+	Workers        int              `yaml:"workers"`
+	OnError        string           `yaml:"onerror"`
+	CommandTimeout string           `yaml:"commandtimeout"`
+	Retry          RetryConfig      `yaml:"retry"`
+	Debug          bool             `yaml:"debug"`
 }
 
 // Cfg Globally accessed Config struct
@@ -43,14 +65,27 @@ var Cfg Config
 // globalLogger is a globally accessed pointer to the custom logger
 var globalLogger *Logger
 
+// subcommands maps the name of each subcommand to the function running it
+// and returning the exit code. Without a subcommand, users are synced.
+var subcommands = map[string]func(args []string) int{
+	"authorized-keys": AuthorizedKeysCommand,
+	"sign":            SignCommand,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(run(os.Args[2:]))
+		}
+	}
+
 	start := time.Now()
 
 	// Process Arguments
 	argErr := ProcessInput()
 	if argErr != nil {
 		log.Printf("Fatal Error! Problem processing arguments: %v\n", argErr)
-		return
+		os.Exit(exitTotalFailure)
 	}
 
 	// Initialize Logging
@@ -59,23 +94,119 @@ func main() {
 	if logErr != nil {
 		log.Printf("Error while initializing logging: %v\n", logErr)
 	}
+	globalLogger.SetDebug(Cfg.Debug)
 
 	globalLogger.Info("====== Start Log ======\n")
 	globalLogger.Info(
 		"IAM User Sync starting with configuration settings: "+
-			"Provider: %s | Group: %s | KeepHomeDir: %t | LogFile: %s\n",
-		Cfg.Provider, Cfg.Group, Cfg.KeepHomeDir, Cfg.LogFile)
-	if Cfg.Provider == "GSUITE" {
-		globalLogger.Info(
-			"GSUITE configuration settings: "+
-				"Email: %s | Domain: %s | "+
-				"Custom Attribute Key: %s | Path To Credentials: %s\n",
-			Cfg.ProviderOptions.Email,
-			Cfg.ProviderOptions.Domain,
-			Cfg.ProviderOptions.CustomAttributeKey,
-			Cfg.ProviderOptions.Credentials,
+			"Providers: %s | Group: %s | KeepHomeDir: %t | LogFile: %s | "+
+			"IdentityKey: %s | ConflictPolicy: %s | StateDir: %s | "+
+			"CacheMaxAge: %s | CacheMaxDrop: %d%% | Root: %s | "+
+			"KeysMode: %s | KeysFile: %s | Adoption: %s\n",
+		providerNames(), Cfg.Group, Cfg.KeepHomeDir, Cfg.LogFile,
+		Cfg.IdentityKey, Cfg.ConflictPolicy, Cfg.StateDir,
+		Cfg.CacheMaxAge, Cfg.CacheMaxDrop, rootName(),
+		Cfg.KeysMode, Cfg.KeysFile, Cfg.Adoption)
+	for _, p := range Cfg.Providers {
+		logProviderConfig(p)
+	}
+
+	// Pick the backend that manages local accounts
+	var backendErr error
+	accountBackend, backendErr = NewAccountBackend(
+		Cfg.AccountBackend, Cfg.Root,
+	)
+	if backendErr != nil {
+		globalLogger.Error("Fatal Error! %v\n", backendErr)
+		globalLogger.CloseFile()
+		os.Exit(exitTotalFailure)
+	}
+	globalLogger.Info("Using the %s account backend\n", accountBackend.Name())
+	accountBackend = newLockedBackend(accountBackend)
+
+	// Sync once, keep watching the roster file for changes, or serve SCIM
+	// and sync whenever users are pushed
+	fileProvider := findProvider("FILE")
+	if fileProvider != nil && !fileProvider.ProviderOptions.FileWatch {
+		fileProvider = nil
+	}
+	scimProvider := findProvider("SCIM")
+	exitCode := exitSuccess
+
+	if fileProvider != nil && scimProvider != nil {
+		go WatchFileProvider(
+			fileProvider.ProviderOptions.File,
+			time.Duration(
+				fileProvider.ProviderOptions.FileWatchInterval,
+			)*time.Second,
+		)
+	} else if fileProvider != nil {
+		WatchFileProvider(
+			fileProvider.ProviderOptions.File,
+			time.Duration(
+				fileProvider.ProviderOptions.FileWatchInterval,
+			)*time.Second,
 		)
 	}
+	if scimProvider != nil {
+		scimErr := ServeSCIM(
+			scimProvider.ProviderOptions.SCIMListen,
+			scimProvider.ProviderOptions.SCIMToken,
+			scimProvider.ProviderOptions.SCIMState,
+			scimProvider.ProviderOptions.SCIMTLSCert,
+			scimProvider.ProviderOptions.SCIMTLSKey,
+		)
+		globalLogger.Error("SCIM server stopped: %v\n", scimErr)
+		exitCode = exitTotalFailure
+	} else if fileProvider == nil {
+		// Errors are logged as they occur, the exit code tells a partial
+		// failure from a total one
+		exitCode = syncExitCode(SyncUsers())
+	}
+
+	duration := time.Since(start)
+	globalLogger.Info(
+		"====== End Log (Done in %dms) ======\n",
+		duration.Milliseconds(),
+	)
+
+	// Close Logging
+	closeLogErr := globalLogger.CloseFile()
+	if closeLogErr != nil {
+		log.Printf(
+			"Fatal Error! Error while closing the log file: %v\n",
+			closeLogErr,
+		)
+	}
+	os.Exit(exitCode)
+}
+
+// syncMutex ensures only one sync runs at a time when syncs are triggered
+// by both a roster watcher and the SCIM server
+var syncMutex sync.Mutex
+
+// SyncUsers pulls the list of users from the configured IAM providers and
+// reconciles them against the members of the local group, adding missing
+// users and deleting stale ones. Accounts sourced by a provider that failed
+// during this run are never deleted. A user that fails doesn't stop the
+// others, they are returned in a SyncFailureError. Any error is logged
+// before being returned, and the outcome written to statedir/report.json.
+func SyncUsers() (syncErr error) {
+	syncMutex.Lock()
+	defer syncMutex.Unlock()
+
+	// Keep other processes from syncing at the same time
+	lock, lockErr := acquireSyncLock()
+	if lockErr != nil {
+		globalLogger.Error("Not syncing: %v\n", lockErr)
+		return lockErr
+	}
+	defer lock.release()
+
+	// Record the outcome for monitoring once the lock is held, so a run
+	// skipped for another one doesn't overwrite its report
+	defer func() { writeSyncReport(syncErr) }()
+	providerReports = []providerReport{}
 
 	// If the group does not exist, create a group then continue
 	if !doesGroupExist(Cfg.Group) {
@@ -83,30 +214,59 @@ func main() {
 		createGroupError := createGroup(Cfg.Group)
 		if createGroupError != nil {
 			globalLogger.Error("Problem creating group: %v\n", createGroupError)
-			return
+			return createGroupError
 		}
 		globalLogger.Info("Group %s created successfully.\n", Cfg.Group)
 	}
 
+	// Keep the CA keys sshd trusts up to date
+	if Cfg.KeysMode == "ca" {
+		trustedKeysErr := writeTrustedCAKeys()
+		if trustedKeysErr != nil {
+			globalLogger.Error(
+				"Issue writing trusted CA keys: %v\n", trustedKeysErr,
+			)
+			return trustedKeysErr
+		}
+	}
+
+	// Load the record of which provider sourced each managed account
+	state, stateErr := LoadState()
+	if stateErr != nil {
+		globalLogger.Error("Issue loading sync state: %v\n", stateErr)
+		return stateErr
+	}
+
+	// Finish the operations of a sync that was interrupted, and journal the
+	// operations of this one
+	loadedJournal, journalErr := loadJournal()
+	if journalErr != nil {
+		globalLogger.Error("Issue loading sync journal: %v\n", journalErr)
+		return journalErr
+	}
+	recoverJournal(loadedJournal, state)
+
 	// =======================
 	// CHECK FOR USERS TO ADD
 	// =======================
 
 	// Define the list of user structs from IAM
-	var users = []IAMUser{}
-	var pullUsersError error
-	users, pullUsersError = PullUsersFromIAM()
+	users, failedProviders, pullUsersError := PullUsersFromIAM()
 	if pullUsersError != nil {
 		globalLogger.Error("Issue pulling users from IAM: %v\n", pullUsersError)
-		return
-	}
-	if users == nil {
-		globalLogger.Error("Provider %s not supported!\n", Cfg.Provider)
-		return
+		return pullUsersError
 	}
+
+	// Interrupted deletions are only finished for users still missing
+	recoverDeletes(loadedJournal, state, users, failedProviders)
+	journal = loadedJournal
+	defer func() { journal = nil }()
+
+	// System and break-glass accounts are never touched
+	users = filterProtectedUsers(users)
 	if len(users) < 1 {
 		globalLogger.Error("List of IAM Users is empty!\n")
-		return
+		return errors.New("list of IAM users is empty")
 	}
 
 	// Define and pull the list of local users
@@ -116,17 +276,23 @@ func main() {
 			"Issue pulling list of local users in group with error: %v\n",
 			localUserError,
 		)
-		return
+		return localUserError
 	}
 
-	// compare iam users to local users and add them if any are missing
-	iamUsersList, addUsersErr := AddMissingIAMUsers(users, localUsersList)
-	if addUsersErr != nil {
-		globalLogger.Error(
-			"Issue comparing and adding local users: %v\n",
-			addUsersErr,
-		)
-		return
+	// compare iam users to local users and add them if any are missing. A
+	// user that fails is reported at the end without blocking the others.
+	iamUsersList, failures := AddMissingIAMUsers(
+		users, localUsersList, state,
+	)
+	operations := len(users)
+	for _, usr := range users {
+		if usr.keysRejected {
+			failures = append(failures, userFailure{
+				Username: usr.username,
+				Op:       "keypolicy",
+				Error:    "every key was rejected by the key policy",
+			})
+		}
 	}
 
 	// =======================
@@ -140,120 +306,243 @@ func main() {
 			"Issue pulling list of local users in group with error: %v\n",
 			localUserError,
 		)
-		return
+		return localUserError
 	}
 
-	// Check to see if there are any users locally that aren't in the iam users,
-	// if so then delete user (keep home folder?)
-	if len(localUsersList) > 0 {
-		deleteUsersErr := DeleteMissingLocalUsers(iamUsersList, localUsersList)
-		if deleteUsersErr != nil {
+	// Accounts sourced by a provider that failed, or whose provider is
+	// unknown, are kept until every provider is reachable again. Protected
+	// accounts added to the group by mistake, and accounts the adoption
+	// policy doesn't let the sync own, are never deleted.
+	deletableUsersList := []string{}
+	keptUsers := map[string]bool{}
+	for _, localUser := range localUsersList {
+		if reason := protectedAccount(localUser); reason != "" {
 			globalLogger.Error(
-				"Issue comparing and deleting local users: %v\n",
-				deleteUsersErr,
+				"REFUSING to delete protected account %s as %s\n",
+				localUser, reason,
 			)
-			return
+			continue
 		}
+		if !state.owned(localUser) && !adoptable(true) {
+			globalLogger.Error(
+				"CONFLICT: account %s in group %s was not created by "+
+					"iamusersync, not deleting it (adoption: %s)\n",
+				localUser, Cfg.Group, Cfg.Adoption,
+			)
+			continue
+		}
+		account, known := state.account(localUser)
+		if len(failedProviders) > 0 &&
+			(!known || failedProviders[account.Provider]) {
+			globalLogger.Info(
+				"Keeping user %s as its provider could not be reached.\n",
+				localUser,
+			)
+			keptUsers[localUser] = true
+			continue
+		}
+		deletableUsersList = append(deletableUsersList, localUser)
 	}
 
-	duration := time.Since(start)
-	globalLogger.Info(
-		"====== End Log (Done in %dms) ======\n",
-		duration.Milliseconds(),
-	)
+	// Check to see if there are any users locally that aren't in the iam users,
+	// if so then delete user (keep home folder?)
+	if len(failures) > 0 && Cfg.OnError == "abort" {
+		globalLogger.Error(
+			"Not deleting stale users as %s failed (onerror: abort)\n",
+			failures[0].Username,
+		)
+	} else if len(deletableUsersList) > 0 {
+		deletions, deleteFailures := DeleteMissingLocalUsers(
+			iamUsersList, deletableUsersList,
+		)
+		operations += deletions
+		failures = append(failures, deleteFailures...)
+	}
 
-	// Close Logging
-	closeLogErr := globalLogger.CloseFile()
-	if closeLogErr != nil {
-		log.Printf(
-			"Fatal Error! Error while closing the log file: %v\n",
-			closeLogErr,
+	// Forget accounts that are no longer in the group
+	localUsersList, localUserError = getUsersInGroup(Cfg.Group)
+	if localUserError != nil {
+		globalLogger.Error(
+			"Issue pulling list of local users in group with error: %v\n",
+			localUserError,
 		)
-		return
+		return localUserError
 	}
+	state.forgetMissingAccounts(localUsersList)
+
+	// Publish the keys of the remaining accounts the sync owns for
+	// AuthorizedKeysCommand
+	ownedUsersList := []string{}
+	for _, localUser := range localUsersList {
+		if state.owned(localUser) || (keptUsers[localUser] && adoptable(true)) {
+			ownedUsersList = append(ownedUsersList, localUser)
+		}
+	}
+	publishErr := PublishKeys(users, ownedUsersList, keptUsers)
+	if publishErr != nil {
+		globalLogger.Error("Issue publishing keys: %v\n", publishErr)
+		if Cfg.KeysMode == "command" {
+			return publishErr
+		}
+	}
+
+	saveStateErr := SaveState(state)
+	if saveStateErr != nil {
+		globalLogger.Error("Issue saving sync state: %v\n", saveStateErr)
+		return saveStateErr
+	}
+
+	// The state now records the outcome of every journaled operation
+	clearErr := journal.clear()
+	if clearErr != nil {
+		globalLogger.Error("Issue clearing sync journal: %v\n", clearErr)
+		return clearErr
+	}
+	return summarizeFailures(failures, operations)
 }
 
 // AddMissingIAMUsers compares a list of IAMUsers and local users, then
-// adds any local users that aren't present locally but exist in IAM
+// adds any local users that aren't present locally but exist in IAM. Users
+// are synced by a pool of workers, and a failure only affects its own user:
+// every failure is returned for the summary, along with the list of IAM
+// usernames.
 func AddMissingIAMUsers(
 	users []IAMUser,
 	localUsersList []string,
-) ([]string, error) {
-	// Define the list of iam usernames
-	iamUsersList := []string{}
+	state SyncState,
+) ([]string, []userFailure) {
+	// Index the local users for the existence checks
+	localUsers := map[string]bool{}
+	for _, localUser := range localUsersList {
+		localUsers[localUser] = true
+	}
 
-	// Iterate through iam users list of structs
+	iamUsersList := []string{}
 	for _, usr := range users {
-		// Add the users from the struct to a list for comparison later
 		iamUsersList = append(iamUsersList, usr.username)
+	}
 
-		// Check to see if the iam user already has a local user on this machine
-		localUserExists := false
-		for _, localUser := range localUsersList {
-			if localUser == usr.username {
-				//Local user found, do not add
-				localUserExists = true
-			}
+	errs := forEachParallel(len(users), func(i int) error {
+		return syncIAMUser(users[i], localUsers[users[i].username], state)
+	})
+	return iamUsersList, collectFailures(iamUsersList, "sync", errs)
+}
+
+// syncIAMUser creates the local account of an IAM user, or brings an
+// existing one up to date. Accounts that already exist are only managed if
+// the sync created them or the adoption policy allows taking them over, and
+// the ownership of each account is recorded in state. Conflicting accounts
+// are reported and left alone, so a directory entry can't claim an
+// arbitrary local account.
+func syncIAMUser(usr IAMUser, inGroup bool, state SyncState) error {
+	account, _ := state.account(usr.username)
+
+	if !inGroup {
+		// The account may exist outside of the managed group
+		_, lookupErr := accountBackend.LookupUser(usr.username)
+		if lookupErr != nil && !errors.Is(lookupErr, ErrUnknownAccount) {
+			return lookupErr
 		}
 
 		// IAM user doesn't exist locally, so create a new user
-		if !localUserExists {
+		if lookupErr != nil {
 			addUserError := addUser(usr)
 			if addUserError != nil {
-				return nil, addUserError
+				return addUserError
 			}
 			globalLogger.Info(
 				"New user found in IAM that does not exist locally! "+
 					"Adding user: %s\n",
 				usr.username,
 			)
+			state.setAccount(usr.username, AccountState{
+				Provider: usr.provider,
+				Created:  true,
+			})
+			return nil
+		}
 
-		} else {
-			// User already exists, but ensure the authorized_keys file exists
-			createAuthorizedKeysError := createAuthorizedKeys(usr)
-			if createAuthorizedKeysError != nil {
-				return nil, createAuthorizedKeysError
-			}
+		if !adoptable(false) {
+			globalLogger.Error(
+				"CONFLICT: account %s already exists outside of group "+
+					"%s and was not created by iamusersync, not granting "+
+					"SSH access (adoption: %s)\n",
+				usr.username, Cfg.Group, Cfg.Adoption,
+			)
+			return nil
 		}
+		globalLogger.Info(
+			"Adopting existing account %s into group %s\n",
+			usr.username, Cfg.Group,
+		)
+		addUserError := addUserToGroup(Cfg.Group, usr.username)
+		if addUserError != nil {
+			return addUserError
+		}
+		account.Adopted = true
+
+	} else if !state.owned(usr.username) {
+		if !adoptable(true) {
+			globalLogger.Error(
+				"CONFLICT: account %s in group %s was not created by "+
+					"iamusersync, not granting SSH access (adoption: "+
+					"%s)\n",
+				usr.username, Cfg.Group, Cfg.Adoption,
+			)
+			return nil
+		}
+		globalLogger.Info(
+			"Adopting existing account %s of group %s\n",
+			usr.username, Cfg.Group,
+		)
+		account.Adopted = true
 	}
-	return iamUsersList, nil
+
+	// Tag the account with the provider that sourced it
+	account.Provider = usr.provider
+	state.setAccount(usr.username, account)
+
+	// User already exists, bring its account attributes up to date
+	reconcileError := reconcileAccount(usr, account.Created)
+	if reconcileError != nil {
+		return reconcileError
+	}
+
+	// Ensure the authorized_keys file exists
+	return createAuthorizedKeys(usr)
 }
 
 // DeleteMissingLocalUsers compares a list of IAMUsers and local users, then
-// deletes any local users that aren't present in IAM
+// deletes any local users that aren't present in IAM. Users are deleted by
+// a pool of workers. The number of users to delete is returned along with
+// every failure for the summary.
 func DeleteMissingLocalUsers(
 	iamUsersList []string, localUsersList []string,
-) error {
-	// Iterate through local users list
-	for _, localUser := range localUsersList {
+) (int, []userFailure) {
+	// Index the iam users for the existence checks
+	iamUsers := map[string]bool{}
+	for _, iamUserName := range iamUsersList {
+		iamUsers[iamUserName] = true
+	}
 
-		// Check to see if the local user is in the list of iam users
-		iamUserExists := false
-		for _, iamUserName := range iamUsersList {
-			if localUser == iamUserName {
-				// Local user is in iam user list as intended, proceed
-				iamUserExists = true
-			}
+	// Local users that do not match a record in iam are deleted
+	staleUsersList := []string{}
+	for _, localUser := range localUsersList {
+		if !iamUsers[localUser] {
+			staleUsersList = append(staleUsersList, localUser)
 		}
+	}
 
-		// Local user does not match a record in iam, delete the local user
-		if !iamUserExists {
-			globalLogger.Info(
-				"Stale user found! Deleting user: %s\n",
-				localUser,
-			)
-			if !Cfg.KeepHomeDir {
-				globalLogger.Info(
-					localUser + "'s home folder has been deleted!\n",
-				)
-			}
-			deleteUserError := deleteUser(localUser, Cfg.KeepHomeDir)
-			if deleteUserError != nil {
-				return deleteUserError
-			}
+	errs := forEachParallel(len(staleUsersList), func(i int) error {
+		staleUser := staleUsersList[i]
+		globalLogger.Info("Stale user found! Deleting user: %s\n", staleUser)
+		err := deleteUser(staleUser, Cfg.KeepHomeDir)
+		if err == nil && !Cfg.KeepHomeDir {
+			globalLogger.Info("%s's home folder has been deleted!\n", staleUser)
 		}
-	}
-	return nil
+		return err
+	})
+	return len(staleUsersList), collectFailures(staleUsersList, "delete", errs)
 }
 
 // ProcessInput creates a Config object using supplied parameters
@@ -261,7 +550,8 @@ func DeleteMissingLocalUsers(
 func ProcessInput() error {
 	provider := flag.String(
 		"provider", "",
-		"Available Choices: GSUITE, AWS, AZURE (Default: GSUITE)",
+		"Available Choices: GSUITE, GITLAB, KEYCLOAK, FILE, HTTP, SCIM, "+
+			"AWS, AZURE (Default: GSUITE)",
 	)
 	credentials := flag.String(
 		"credentials", "",
@@ -297,6 +587,11 @@ func ProcessInput() error {
 			"(Default: SSHKEY)",
 	)
 
+	root := flag.String(
+		"root", "",
+		"Apply every account, group, home and authorized_keys change to the "+
+			"system installed under this directory instead of the running one.",
+	)
 	config := flag.String(
 		"config", "",
 		"Full path to config file. Additional arguments supplied on the CLI "+
@@ -307,40 +602,21 @@ func ProcessInput() error {
 
 	// if config path is set, use those values
 	if *config != "" {
-		f, err := os.Open(*config)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-
-		decoder := yaml.NewDecoder(f)
-		err = decoder.Decode(&Cfg)
+		err := LoadConfigFile(*config)
 		if err != nil {
 			return err
 		}
-		log.Printf("Loading config from: %s\n", *config)
 	}
 
 	// if cli parameter is passed, overwite config variables
 	overwriteErr := ArgOverwriteConfig(
 		*group, *keepHomeDir, *logFile, *provider, *credentials,
-		*gsuiteAdminEmail, *gsuiteOAuthDomain, *customAttributeKey,
+		*gsuiteAdminEmail, *gsuiteOAuthDomain, *customAttributeKey, *root,
 	)
 	if overwriteErr != nil {
 		return overwriteErr
 	}
 
-	// if IAM Provider is GSUITE, gsuiteadminemail must be set elsewhere
-	if (*provider == "GSUITE" && *gsuiteAdminEmail == "") ||
-		(Cfg.Provider == "GSUITE" && Cfg.ProviderOptions.Email == "") {
-		emailMissingError := errors.New(
-			"If the IAM provider is GSuite (Google Workspace) then you must " +
-				"supply the super admin user's email address that originally " +
-				"delegated the serviceaccount OAuth scopes.",
-		)
-		return emailMissingError
-	}
-
 	unsetError := CheckForUnsetConfig()
 	if unsetError != nil {
 		return unsetError
@@ -348,12 +624,30 @@ func ProcessInput() error {
 	return nil
 }
 
+// LoadConfigFile decodes the config file at path into Cfg
+func LoadConfigFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	err = decoder.Decode(&Cfg)
+	if err != nil {
+		return err
+	}
+	log.Printf("Loading config from: %s\n", path)
+	return nil
+}
+
 // ArgOverwriteConfig checks for cli passed arguments and overwrites config
 func ArgOverwriteConfig(
 	group string, keepHomeDir bool,
 	logFile string, provider string,
 	credentials string, gsuiteAdminEmail string,
 	gsuiteOAuthDomain string, customAttributeKey string,
+	root string,
 ) error {
 	// general config:
 	if group != "" {
@@ -365,6 +659,37 @@ func ArgOverwriteConfig(
 	if logFile != "" {
 		Cfg.LogFile = logFile
 	}
+	if root != "" {
+		Cfg.Root = root
+	}
+
+	// The provider flags set the single provider, which a providers list
+	// replaces. Rather than ignoring them, ask for them to go into the
+	// provider-options of the right entry.
+	if len(Cfg.Providers) > 0 {
+		providerFlags := []string{}
+		for _, f := range []struct {
+			name  string
+			value string
+		}{
+			{"--provider", provider},
+			{"--credentials", credentials},
+			{"--gsuiteadmin", gsuiteAdminEmail},
+			{"--oauthdomain", gsuiteOAuthDomain},
+			{"--customattributekey", customAttributeKey},
+		} {
+			if f.value != "" {
+				providerFlags = append(providerFlags, f.name)
+			}
+		}
+		if len(providerFlags) > 0 {
+			return fmt.Errorf(
+				"%s can't be used with a providers list in the config, "+
+					"set them in the provider-options of its entries instead",
+				strings.Join(providerFlags, ", "),
+			)
+		}
+	}
 	if provider != "" {
 		Cfg.Provider = provider
 	}
@@ -387,22 +712,6 @@ func ArgOverwriteConfig(
 
 // CheckForUnsetConfig sets default values for unspecified config vars
 func CheckForUnsetConfig() error {
-	// if required parameters are empty, error
-	if Cfg.Provider == "" {
-		providerMissingError := errors.New(
-			"IAM Provider must be set. Please use --provider GSUITE " +
-				"or set the value using --config /path/to/config.yml.",
-		)
-		return providerMissingError
-	}
-	if Cfg.ProviderOptions.Credentials == "" {
-		credentialsMissingError := errors.New(
-			"IAM Provider service account credentials must be present. " +
-				"Use --credentials <path> or set the value in config.yml.",
-		)
-		return credentialsMissingError
-	}
-
 	// Use defaults where arguments not specified
 	if Cfg.Group == "" {
 		Cfg.Group = "iamusersync"
@@ -412,38 +721,169 @@ func CheckForUnsetConfig() error {
 		Cfg.LogFile = "/var/log/iamusersync.log"
 		log.Printf("Log file path not specified. Default: %s\n", Cfg.LogFile)
 	}
-	if Cfg.ProviderOptions.Domain == "" {
-		Cfg.ProviderOptions.Domain = strings.Split(
-			Cfg.ProviderOptions.Email,
-			"@",
-		)[1]
-
+	if Cfg.StateDir == "" {
+		Cfg.StateDir = "/var/lib/iamusersync"
+		log.Printf("State directory not specified. Default: %s\n", Cfg.StateDir)
+	}
+	if Cfg.CacheMaxAge == "" {
+		Cfg.CacheMaxAge = "24h"
 		log.Printf(
-			"Using domain for user lookup: %s\n",
-			Cfg.ProviderOptions.Domain,
+			"Cache max age not specified. Default: %s\n", Cfg.CacheMaxAge,
+		)
+	}
+	if _, err := time.ParseDuration(Cfg.CacheMaxAge); err != nil {
+		return fmt.Errorf(
+			"Cache max age %s is invalid: %v", Cfg.CacheMaxAge, err,
 		)
 	}
-	if Cfg.ProviderOptions.CustomAttributeKey == "" {
-		Cfg.ProviderOptions.CustomAttributeKey = "SSHKEY"
+	if Cfg.CacheMaxDrop == 0 {
+		Cfg.CacheMaxDrop = 50
 		log.Printf(
-			"Gsuite User CustomAttributeKey not specified. Using default: %s\n",
-			Cfg.ProviderOptions.CustomAttributeKey,
+			"Cache max drop not specified or 0. Default: %d%%\n",
+			Cfg.CacheMaxDrop,
 		)
 	}
-	return nil
+	if Cfg.AccountBackend == "" {
+		Cfg.AccountBackend = "auto"
+		log.Printf(
+			"Account backend not specified. Default: %s\n", Cfg.AccountBackend,
+		)
+	}
+	if Cfg.Root != "" {
+		absRoot, err := filepath.Abs(Cfg.Root)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(absRoot)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("Root %s is not a directory", absRoot)
+		}
+		Cfg.Root = absRoot
+	}
+	if Cfg.KeysMode == "" {
+		Cfg.KeysMode = "files"
+	}
+	if Cfg.KeysMode != "files" && Cfg.KeysMode != "command" &&
+		Cfg.KeysMode != "ca" {
+		return fmt.Errorf(
+			"Keys mode %s not supported! Available choices: files, "+
+				"command, ca",
+			Cfg.KeysMode,
+		)
+	}
+	if Cfg.Adoption == "" {
+		Cfg.Adoption = "managed-group"
+	}
+	if Cfg.Adoption != "never" && Cfg.Adoption != "managed-group" &&
+		Cfg.Adoption != "always" {
+		return fmt.Errorf(
+			"Adoption policy %s not supported! Available choices: never, "+
+				"managed-group, always",
+			Cfg.Adoption,
+		)
+	}
+	caErr := checkForUnsetCAConfig()
+	if caErr != nil {
+		return caErr
+	}
+	keyPolicyErr := checkForUnsetKeyPolicyConfig()
+	if keyPolicyErr != nil {
+		return keyPolicyErr
+	}
+	if Cfg.Workers == 0 {
+		Cfg.Workers = 4
+	}
+	if Cfg.Workers < 0 {
+		return fmt.Errorf("Workers %d can't be negative", Cfg.Workers)
+	}
+	if Cfg.CommandTimeout == "" {
+		Cfg.CommandTimeout = "60s"
+	}
+	commandTimeout, timeoutErr := time.ParseDuration(Cfg.CommandTimeout)
+	if timeoutErr != nil || commandTimeout < 0 {
+		return fmt.Errorf(
+			"Command timeout %s is invalid", Cfg.CommandTimeout,
+		)
+	}
+	if Cfg.OnError == "" {
+		Cfg.OnError = "continue"
+	}
+	if Cfg.OnError != "continue" && Cfg.OnError != "abort" {
+		return fmt.Errorf(
+			"On error %s not supported! Available choices: continue, abort",
+			Cfg.OnError,
+		)
+	}
+	retryErr := checkForUnsetRetryConfig()
+	if retryErr != nil {
+		return retryErr
+	}
+	usernamesErr := checkForUnsetUsernameConfig()
+	if usernamesErr != nil {
+		return usernamesErr
+	}
+	protectedErr := checkForUnsetProtectedConfig()
+	if protectedErr != nil {
+		return protectedErr
+	}
+	keyOptionsErr := checkForUnsetKeyOptionsConfig()
+	if keyOptionsErr != nil {
+		return keyOptionsErr
+	}
+	if Cfg.KeysFile == "" {
+		Cfg.KeysFile = filepath.Join(Cfg.StateDir, "keys.json")
+	}
+	accountsErr := checkForUnsetAccountConfig()
+	if accountsErr != nil {
+		return accountsErr
+	}
+	if Cfg.CacheMaxDrop < 1 || Cfg.CacheMaxDrop > 100 {
+		return fmt.Errorf(
+			"Cache max drop %d must be between 1 and 100", Cfg.CacheMaxDrop,
+		)
+	}
+
+	// if required provider parameters are empty, error
+	return CheckForUnsetProviderConfig()
+}
+
+// rootName returns the root accounts are managed under, for logging
+func rootName() string {
+	if Cfg.Root == "" {
+		return "/"
+	}
+	return Cfg.Root
 }
 
-// addUser adds the given IAMUser to the local system using the useradd command.
-// It then adds the user to the group and generates ~/.ssh/authorized_keys.
+// addUser adds the given IAMUser to the local system using the configured
+// account backend. It then adds the user to the group and generates
+// ~/.ssh/authorized_keys.
 func addUser(u IAMUser) error {
-	command := "useradd"
-	param1 := "-m"
-	param2 := "-d"
-	param3 := "/home/" + u.username
-	param4 := u.username
-	cmd := exec.Command(command, param1, param2, param3, param4)
-	_, err := cmd.Output()
+	entry, err := journal.begin(journalEntry{
+		Op:       "add",
+		Username: u.username,
+		Provider: u.provider,
+	})
+	if err != nil {
+		return err
+	}
 
+	err = accountBackend.AddUser(accountFor(u))
+	if err != nil {
+		// The account may exist now, e.g. if useradd refused as one of the
+		// same name was created meanwhile, but it isn't one to claim
+		if dropErr := journal.drop(entry); dropErr != nil {
+			globalLogger.Error(
+				"Issue updating the journal for %s: %v\n",
+				u.username, dropErr,
+			)
+		}
+		return err
+	}
+	err = journal.created(entry)
 	if err != nil {
 		return err
 	}
@@ -458,28 +898,43 @@ func addUser(u IAMUser) error {
 		return createAuthorizedKeysError
 	}
 
-	return nil
+	return journal.done(entry)
 }
 
-// createAuthorizedKeys checks to see if a users home folder, .ssh folder,
-// and authorized_keys file exist, and if not,
-// then creates them with appropriate permissions
-// and the public key pulled from IAM.
+// createAuthorizedKeys makes sure a user's home folder, .ssh folder and
+// authorized_keys file exist with the public keys pulled from IAM. It runs
+// on every sync, so ownership and permissions that drifted from what sshd's
+// StrictModes expects are repaired and changed keys are rewritten.
 func createAuthorizedKeys(u IAMUser) error {
-	homePath := "/home/" + u.username
-	sshPath := homePath + "/.ssh/"
-	authorizedKeysPath := sshPath + "authorized_keys"
+	// sshd asks the authorized-keys subcommand for keys instead, or trusts
+	// certificates issued to the principals of the user
+	switch Cfg.KeysMode {
+	case "command":
+		return nil
+	case "ca":
+		return writeAuthorizedPrincipals(u)
+	}
 
-	// check home path exists, if not then create it
-	_, homeStatErr := os.Stat(homePath)
+	account, err := accountBackend.LookupUser(u.username)
+	if err != nil {
+		return err
+	}
+	homePath := filepath.Join(Cfg.Root, account.Home)
+	authorizedKeysPath := filepath.Join(homePath, ".ssh", "authorized_keys")
+
+	// check home path exists, if not then create it. Only the home itself
+	// is private, missing parents such as the homebase must stay
+	// traversable by every other user whose home is in them.
+	_, homeStatErr := os.Lstat(homePath)
 	if errors.Is(homeStatErr, os.ErrNotExist) {
-		// user home does not exist
-		mkdirErr := os.Mkdir(homePath, 0644)
+		mkdirErr := os.MkdirAll(filepath.Dir(homePath), 0755)
+		if mkdirErr == nil {
+			mkdirErr = os.Mkdir(homePath, 0700)
+		}
 		if mkdirErr != nil {
 			return mkdirErr
 		}
-
-		chownErr := chown(u.username, homePath)
+		chownErr := os.Chown(homePath, account.UID, account.GID)
 		if chownErr != nil {
 			return chownErr
 		}
@@ -489,146 +944,102 @@ func createAuthorizedKeys(u IAMUser) error {
 		)
 	}
 
-	// check .ssh path exists, if not then create it
-	_, sshStatErr := os.Stat(sshPath)
-	if errors.Is(sshStatErr, os.ErrNotExist) {
-		// user home does not exist
-		mkdirErr := os.Mkdir(sshPath, 0644)
-		if mkdirErr != nil {
-			return mkdirErr
-		}
-
-		chownErr := chown(u.username, sshPath)
-		if chownErr != nil {
-			return chownErr
-		}
+	content := []byte{}
+	if lines := authorizedKeyLines(u); len(lines) > 0 {
+		content = []byte(strings.Join(lines, "\n") + "\n")
 	}
+	changed, writeErr := writeAuthorizedKeys(
+		homePath, account.UID, account.GID, content,
+	)
+	if writeErr != nil {
+		return fmt.Errorf("%s: %v", authorizedKeysPath, writeErr)
+	}
+	if changed {
+		globalLogger.Info("Updated %s\n", authorizedKeysPath)
+	}
+	return nil
+}
 
-	// check authorized_keys file exists, if not then create it
-	_, akStatErr := os.Stat(authorizedKeysPath)
-	if errors.Is(akStatErr, os.ErrNotExist) {
-		// authorized_keys file does not exist
-		publicKeyWriteErr := ioutil.WriteFile(
-			authorizedKeysPath,
-			[]byte(u.publickey),
-			0644,
+// deleteUser removes a given user from the system using the configured
+// account backend. If keepHomeDir is set to false, the user's home directory
+// will be deleted.
+func deleteUser(username string, keepHomeDir bool) error {
+	if reason := unsafeUsername(username); reason != "" {
+		return fmt.Errorf(
+			"refusing to delete account %q as %s", username, reason,
 		)
-		if publicKeyWriteErr != nil {
-			return publicKeyWriteErr
-		}
+	}
+	if reason := protectedAccount(username); reason != "" {
+		return fmt.Errorf(
+			"refusing to delete protected account %s as %s", username, reason,
+		)
+	}
 
-		chownErr := chown(u.username, authorizedKeysPath)
-		if chownErr != nil {
-			return chownErr
-		}
+	account, err := accountBackend.LookupUser(username)
+	if err != nil {
+		return err
 	}
 
-	return nil
-}
+	entry, err := journal.begin(journalEntry{
+		Op:       "delete",
+		Username: username,
+		Home:     account.Home,
+		KeepHome: keepHomeDir,
+	})
+	if err != nil {
+		return err
+	}
 
-// deleteUser removes a given user from the system using the deluser command.
-// If keepHomeDir is set to false, the user's home directory will be deleted.
-func deleteUser(username string, keepHomeDir bool) error {
-	command := "deluser"
-	param1 := username
-	out := exec.Command(command, param1)
-	_, err := out.Output()
+	// The account is still there, so there is nothing for the next sync
+	// to finish, and it decides afresh whether to delete it
+	err = accountBackend.DeleteUser(username)
+	if err != nil {
+		if dropErr := journal.drop(entry); dropErr != nil {
+			globalLogger.Error(
+				"Issue updating the journal for %s: %v\n",
+				username, dropErr,
+			)
+		}
+		return err
+	}
+
+	err = removeAuthorizedPrincipals(username)
 	if err != nil {
 		return err
 	}
 
-	if !keepHomeDir {
-		cmd := "rm"
-		p1 := "-rf"
-		p2 := "/home/" + username
-		delout := exec.Command(cmd, p1, p2)
-		_, e := delout.Output()
-		if e != nil {
-			return e
+	// Never remove a shared or root level directory set as the home
+	if !keepHomeDir && account.Home != "" &&
+		filepath.Clean(account.Home) != "/" {
+		err = os.RemoveAll(filepath.Join(Cfg.Root, account.Home))
+		if err != nil {
+			return err
 		}
 	}
-	return nil
+	return journal.done(entry)
 }
 
 // doesGroupExist checks if a group name exists on the local system.
 func doesGroupExist(name string) bool {
-	_, err := user.LookupGroup(name)
+	exists, err := accountBackend.GroupExists(name)
 	if err != nil {
-		if _, ok := err.(user.UnknownGroupError); ok {
-			return false
-		}
+		globalLogger.Error("Issue looking up group %s: %v\n", name, err)
 	}
-	return true
+	return exists
 }
 
 // createGroup creates a local system group with the given localGroupName
-// using the groupadd command.
+// using the configured account backend.
 func createGroup(localGroupName string) error {
-	command := "groupadd"
-	param1 := localGroupName
-	cmd := exec.Command(command, param1)
-	_, err := cmd.Output()
-
-	if err != nil {
-		return err
-	}
-	return nil
+	return accountBackend.CreateGroup(localGroupName)
 }
 
 // getUsersInGroup returns a list of username strings for a given group.
 func getUsersInGroup(group string) ([]string, error) {
-	command := "getent"
-	param1 := "group"
-	param2 := group
-	cmd := exec.Command(command, param1, param2)
-	stdout, err := cmd.Output()
-	if err != nil {
-		return nil, err
-	}
-	groupString := string(stdout)
-
-	concatUsers := strings.Split(groupString, ":")[3]
-	trimmedConcatUsers := strings.TrimSpace(concatUsers)
-	localUsers := strings.Split(trimmedConcatUsers, ",")
-	return localUsers, nil
+	return accountBackend.UsersInGroup(group)
 }
 
 // addUserToGroup adds a given username to a given group.
 func addUserToGroup(group string, username string) error {
-	command := "usermod"
-	param1 := "-aG"
-	param2 := group
-	param3 := username
-	cmd := exec.Command(command, param1, param2, param3)
-	_, err := cmd.Output()
-	return err
-}
-
-// chown makes the given username own the given path on the local system.
-func chown(username string, path string) error {
-	userObject, _ := user.Lookup(username)
-	uid, _ := strconv.Atoi(userObject.Uid)
-	gid, _ := strconv.Atoi(userObject.Gid)
-	err := os.Chown(path, uid, gid)
-	return err
-}
-
-// PullUsersFromIAM determines which class to use given a configured provider
-func PullUsersFromIAM() ([]IAMUser, error) {
-	p := strings.ToUpper(Cfg.Provider)
-	switch p {
-	case "GSUITE":
-		return PullGsuiteUsers(
-			Cfg.ProviderOptions.Email,
-			Cfg.ProviderOptions.Domain,
-			Cfg.ProviderOptions.CustomAttributeKey,
-			Cfg.ProviderOptions.Credentials,
-		)
-	case "AWS":
-		return nil, nil
-	// additional providers coming soon
-	default:
-		return nil, nil
-	}
-	return nil, nil
+	return accountBackend.AddUserToGroup(group, username)
 }
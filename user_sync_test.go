@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestArgOverwriteConfigProviderFlags(t *testing.T) {
+	previousCfg := Cfg
+	t.Cleanup(func() { Cfg = previousCfg })
+
+	// A single provider takes the flags
+	Cfg = Config{}
+	err := ArgOverwriteConfig(
+		"", false, "", "GSUITE", "key.json", "admin@example.com", "", "", "",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Cfg.Provider != "GSUITE" ||
+		Cfg.ProviderOptions.Credentials != "key.json" ||
+		Cfg.ProviderOptions.Email != "admin@example.com" {
+		t.Errorf("config = %+v, want the flags applied", Cfg)
+	}
+
+	// A providers list doesn't, so they must not be silently ignored
+	Cfg = Config{Providers: []ProviderConfig{{Provider: "GSUITE"}}}
+	err = ArgOverwriteConfig(
+		"", false, "", "", "key.json", "admin@example.com", "", "", "",
+	)
+	if err == nil || !strings.Contains(err.Error(),
+		"--credentials, --gsuiteadmin") {
+		t.Errorf("error = %v, want the provider flags rejected", err)
+	}
+
+	// Flags that aren't provider options still apply
+	Cfg = Config{Providers: []ProviderConfig{{Provider: "GSUITE"}}}
+	err = ArgOverwriteConfig("admins", false, "", "", "", "", "", "", "")
+	if err != nil || Cfg.Group != "admins" {
+		t.Errorf("group = %q, error = %v, want admins", Cfg.Group, err)
+	}
+}
+
+func TestCheckForUnsetConfigCacheMaxDrop(t *testing.T) {
+	previousCfg := Cfg
+	t.Cleanup(func() { Cfg = previousCfg })
+
+	tests := []struct {
+		maxDrop int
+		want    int
+		wantErr bool
+	}{
+		{0, 50, false},
+		{1, 1, false},
+		{100, 100, false},
+		{-1, 0, true},
+		{101, 0, true},
+	}
+	for _, tt := range tests {
+		Cfg = Config{
+			StateDir:        t.TempDir(),
+			CacheMaxDrop:    tt.maxDrop,
+			Provider:        "FILE",
+			ProviderOptions: ProviderOptions{File: "users.yml"},
+		}
+		err := CheckForUnsetConfig()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%d: error = %v, want error %t", tt.maxDrop, err,
+				tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && Cfg.CacheMaxDrop != tt.want {
+			t.Errorf("%d: CacheMaxDrop = %d, want %d", tt.maxDrop,
+				Cfg.CacheMaxDrop, tt.want)
+		}
+	}
+}
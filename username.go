@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// UsernameConfig defines how usernames from providers are transliterated
+// and which ones are accepted
+type UsernameConfig struct {
+	Pattern         string            `yaml:"pattern"`
+	MaxLength       int               `yaml:"maxlength"`
+	Transliteration string            `yaml:"transliteration"`
+	Replacements    map[string]string `yaml:"replacements"`
+}
+
+// defaultUsernamePattern is close to the NAME_REGEX of Debian's adduser,
+// also allowing dots as used by the GSuite given.family names
+const defaultUsernamePattern = `^[a-z_][a-z0-9_.-]*\$?$`
+
+// usernamePattern is the compiled pattern usernames must match
+var usernamePattern = regexp.MustCompile(defaultUsernamePattern)
+
+// latinTransliterations maps accented Latin letters to ASCII. Each key
+// lists the letters sharing a replacement.
+var latinTransliterations = map[string]string{
+	"àáâãäåāăą":  "a",
+	"æ":          "ae",
+	"çćĉċč":      "c",
+	"ďđð":        "d",
+	"èéêëēĕėęě":  "e",
+	"ĝğġģ":       "g",
+	"ĥħ":         "h",
+	"ìíîïĩīĭįı":  "i",
+	"ĳ":          "ij",
+	"ĵ":          "j",
+	"ķ":          "k",
+	"ĺļľŀł":      "l",
+	"ñńņňŉ":      "n",
+	"òóôõöøōŏő":  "o",
+	"œ":          "oe",
+	"ŕŗř":        "r",
+	"śŝşšș":      "s",
+	"ß":          "ss",
+	"ţťŧț":       "t",
+	"þ":          "th",
+	"ùúûüũūŭůűų": "u",
+	"ŵ":          "w",
+	"ýÿŷ":        "y",
+	"źżž":        "z",
+}
+
+// usernameTransliterator replaces the configured and built in
+// transliterations, built by checkForUnsetUsernameConfig
+var usernameTransliterator = strings.NewReplacer()
+
+// checkForUnsetUsernameConfig sets the default username options and builds
+// the transliteration
+func checkForUnsetUsernameConfig() error {
+	names := &Cfg.Usernames
+	if names.Pattern == "" {
+		names.Pattern = defaultUsernamePattern
+	}
+	pattern, err := regexp.Compile(names.Pattern)
+	if err != nil {
+		return fmt.Errorf(
+			"Username pattern %s is invalid: %v", names.Pattern, err,
+		)
+	}
+	usernamePattern = pattern
+
+	// useradd refuses longer names
+	if names.MaxLength == 0 {
+		names.MaxLength = 32
+	}
+	if names.MaxLength < 0 {
+		return fmt.Errorf(
+			"Username max length %d can't be negative", names.MaxLength,
+		)
+	}
+
+	if names.Transliteration == "" {
+		names.Transliteration = "latin"
+	}
+	if names.Transliteration != "latin" && names.Transliteration != "none" {
+		return fmt.Errorf(
+			"Username transliteration %s not supported! Available "+
+				"choices: latin, none",
+			names.Transliteration,
+		)
+	}
+
+	// Configured replacements take precedence over the built in ones, the
+	// longest first when they overlap
+	froms := []string{}
+	for from := range names.Replacements {
+		if from == "" {
+			return errors.New("Username replacements can't replace nothing")
+		}
+		froms = append(froms, from)
+	}
+	sort.Slice(froms, func(i, j int) bool {
+		if len(froms[i]) != len(froms[j]) {
+			return len(froms[i]) > len(froms[j])
+		}
+		return froms[i] < froms[j]
+	})
+	pairs := []string{}
+	for _, from := range froms {
+		pairs = append(pairs, from, names.Replacements[from])
+	}
+	if names.Transliteration == "latin" {
+		for letters, to := range latinTransliterations {
+			for _, letter := range letters {
+				pairs = append(pairs, string(letter), to)
+			}
+		}
+	}
+	usernameTransliterator = strings.NewReplacer(pairs...)
+	return nil
+}
+
+// unsafeUsername returns why a username could escape its home directory or
+// be taken for an option by the account tools, or an empty string. These
+// checks apply whatever the configured pattern.
+func unsafeUsername(username string) string {
+	switch {
+	case username == "":
+		return "it is empty"
+	case username == "." || strings.Contains(username, ".."):
+		return "it contains .."
+	case strings.ContainsAny(username, "/\\:"):
+		return "it contains a path separator or colon"
+	case strings.HasPrefix(username, "-"):
+		return "it starts with -"
+	case strings.HasPrefix(username, "+") || strings.HasPrefix(username, "~"):
+		return "it starts with + or ~"
+	}
+	for _, r := range username {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return "it contains whitespace or control characters"
+		}
+	}
+	return ""
+}
+
+// sanitizeUsername lowercases and then transliterates a username from a
+// provider, returning the result or why it is rejected
+func sanitizeUsername(username string) (string, string) {
+	sanitized := usernameTransliterator.Replace(strings.ToLower(username))
+	if reason := unsafeUsername(sanitized); reason != "" {
+		return "", reason
+	}
+	if len(sanitized) > Cfg.Usernames.MaxLength {
+		return "", fmt.Sprintf(
+			"it is longer than %d characters", Cfg.Usernames.MaxLength,
+		)
+	}
+	if !usernamePattern.MatchString(sanitized) {
+		return "", fmt.Sprintf(
+			"it doesn't match the username pattern %s", usernamePattern,
+		)
+	}
+	return sanitized, ""
+}
+
+// sanitizeUsernames sanitizes the usernames of the users pulled from a
+// provider, logging and dropping the users whose names are rejected before
+// they reach any file or command
+func sanitizeUsernames(users []IAMUser) []IAMUser {
+	valid := []IAMUser{}
+	for _, u := range users {
+		sanitized, reason := sanitizeUsername(u.username)
+		if reason != "" {
+			globalLogger.Error(
+				"Rejected username %q from provider %s as %s\n",
+				u.username, u.provider, reason,
+			)
+			continue
+		}
+		u.username = sanitized
+		valid = append(valid, u)
+	}
+	return valid
+}
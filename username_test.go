@@ -0,0 +1,99 @@
+package main
+
+import "testing"
+
+func TestSanitizeUsername(t *testing.T) {
+	previousCfg := Cfg
+	previousPattern := usernamePattern
+	previousTransliterator := usernameTransliterator
+	t.Cleanup(func() {
+		Cfg = previousCfg
+		usernamePattern = previousPattern
+		usernameTransliterator = previousTransliterator
+	})
+	Cfg = Config{Usernames: UsernameConfig{
+		MaxLength:    16,
+		Replacements: map[string]string{"ü": "ue", "'": ""},
+	}}
+	if err := checkForUnsetUsernameConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		username string
+		want     string
+		rejected bool
+	}{
+		{"Ada.Lovelace", "ada.lovelace", false},
+		{"renée.müller", "renee.mueller", false},
+		{"o'brien", "obrien", false},
+		{"Łukasz", "lukasz", false},
+		{"machine$", "machine$", false},
+		{"", "", true},
+		{"..", "", true},
+		{"a..b", "", true},
+		{"../etc", "", true},
+		{"a/b", "", true},
+		{`a\b`, "", true},
+		{"a:b", "", true},
+		{"-rf", "", true},
+		{"+netgroup", "", true},
+		{"~ada", "", true},
+		{"ada lovelace", "", true},
+		{"ada\tlovelace", "", true},
+		{"ada\x00", "", true},
+		{"averyveryverylongname", "", true},
+		{"1ada", "", true},
+		{"ada@example", "", true},
+		{"日本", "", true},
+	}
+	for _, tt := range tests {
+		got, reason := sanitizeUsername(tt.username)
+		if (reason != "") != tt.rejected || got != tt.want {
+			t.Errorf("%q = %q (%s), want %q rejected %t", tt.username, got,
+				reason, tt.want, tt.rejected)
+		}
+	}
+}
+
+func TestCheckForUnsetUsernameConfig(t *testing.T) {
+	previousCfg := Cfg
+	previousPattern := usernamePattern
+	previousTransliterator := usernameTransliterator
+	t.Cleanup(func() {
+		Cfg = previousCfg
+		usernamePattern = previousPattern
+		usernameTransliterator = previousTransliterator
+	})
+
+	tests := []struct {
+		name      string
+		usernames UsernameConfig
+		wantErr   bool
+	}{
+		{"defaults", UsernameConfig{}, false},
+		{"bad pattern", UsernameConfig{Pattern: "^[a-z"}, true},
+		{"negative length", UsernameConfig{MaxLength: -1}, true},
+		{"transliteration", UsernameConfig{Transliteration: "cyrillic"},
+			true},
+		{"empty replacement", UsernameConfig{
+			Replacements: map[string]string{"": "x"}}, true},
+	}
+	for _, tt := range tests {
+		Cfg = Config{Usernames: tt.usernames}
+		err := checkForUnsetUsernameConfig()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %t", tt.name, err,
+				tt.wantErr)
+		}
+	}
+
+	// With transliteration off, accented letters are rejected
+	Cfg = Config{Usernames: UsernameConfig{Transliteration: "none"}}
+	if err := checkForUnsetUsernameConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if _, reason := sanitizeUsername("renée"); reason == "" {
+		t.Error("renée accepted without transliteration")
+	}
+}